@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"atomirex.com/umbrella/razor"
+	"atomirex.com/umbrella/sfu"
+	"github.com/pion/webrtc/v4"
+	"gopkg.in/yaml.v3"
+)
+
+// Everything can come from a YAML file named by UMBRELLA_CONFIG, with any of the older environment variables
+// which are set overriding it. Servers, ICE servers, the log level, the memory limit, the data channel limits and
+// last n are picked up again on SIGHUP or when the file changes, the rest only on restart
+
+// How often the file is checked for changes
+const configPollInterval = 2 * time.Second
+
+type config struct {
+	Listen     string `yaml:"listen"`
+	Prefix     string `yaml:"prefix"`
+	Cloud      bool   `yaml:"cloud"`
+	MinPort    uint16 `yaml:"minPort"`
+	MaxPort    uint16 `yaml:"maxPort"`
+	PublicIP   string `yaml:"publicIp"`
+	PublicHost string `yaml:"publicHost"`
+
+	// The servers page's list is kept here across restarts, empty to not keep it
+	StateFile string `yaml:"stateFile"`
+
+	// kid: secret
+	AuthKeys     map[string]string `yaml:"authKeys"`
+	TrunkSecrets []string          `yaml:"trunkSecrets"`
+
+	// Reloadable
+
+	// Replace the default public STUN server, the built in TURN server is added to these when on
+	ICEServers    []iceServerConfig `yaml:"iceServers"`
+	LogLevel      string            `yaml:"logLevel"`
+	MemoryLimitMB int64             `yaml:"memoryLimitMB"` // 0 for no limit
+
+	// Limits on data channel messages from each browser
+	DataMaxMessageBytes   int     `yaml:"dataMaxMessageBytes"`
+	DataMessagesPerSecond float64 `yaml:"dataMessagesPerSecond"`
+	DataBytesPerSecond    float64 `yaml:"dataBytesPerSecond"`
+
+	// How many recent speakers' video to forward, 0 for everyone, with room -> n overriding it
+	LastN     int            `yaml:"lastN"`
+	RoomLastN map[string]int `yaml:"roomLastN"`
+
+	// Trunk websocket and RTSP urls, as would be added on the servers page
+	Servers []string `yaml:"servers"`
+}
+
+type iceServerConfig struct {
+	URLs       []string `yaml:"urls"`
+	Username   string   `yaml:"username"`
+	Credential string   `yaml:"credential"`
+}
+
+func defaultConfig() *config {
+	dataLimits := sfu.DefaultDataLimits()
+
+	return &config{
+		Listen:                ":8081",
+		StateFile:             "umbrella-state.json",
+		MinPort:               40000,
+		MaxPort:               60000,
+		LogLevel:              "error",
+		MemoryLimitMB:         256,
+		DataMaxMessageBytes:   dataLimits.MaxMessageSize,
+		DataMessagesPerSecond: dataLimits.MessagesPerSecond,
+		DataBytesPerSecond:    dataLimits.BytesPerSecond,
+	}
+}
+
+// Defaults, then the file if there is one, then the environment
+func loadConfig(path string) (*config, error) {
+	c := defaultConfig()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+
+		// An empty file is fine, it just changes nothing
+		if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("config %s: %w", path, err)
+		}
+	}
+
+	if err := c.applyEnv(); err != nil {
+		return nil, err
+	}
+
+	if _, err := razor.ParseLoggingLevel(c.LogLevel); err != nil {
+		return nil, err
+	}
+
+	for _, t := range c.Servers {
+		if err := sfu.ValidateServerURL(t); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.DataMaxMessageBytes <= 0 || c.DataMessagesPerSecond <= 0 || c.DataBytesPerSecond <= 0 {
+		return nil, fmt.Errorf("data channel limits must be more than zero")
+	}
+
+	if c.MemoryLimitMB < 0 {
+		return nil, fmt.Errorf("memoryLimitMB can't be negative")
+	}
+
+	if c.LastN < 0 {
+		return nil, fmt.Errorf("lastN can't be negative")
+	}
+
+	for room, n := range c.RoomLastN {
+		if n < 0 {
+			return nil, fmt.Errorf("lastN for room %s can't be negative", room)
+		}
+	}
+
+	return c, nil
+}
+
+func (c *config) applyEnv() error {
+	if cloudEnv := os.Getenv("UMBRELLA_CLOUD"); cloudEnv != "" {
+		c.Cloud = cloudEnv == "1"
+	}
+
+	// Path from the domain base, to the umbrella sfu base, including any leading slash
+	// For example "/umbrella" serves at https://domain:port/umbrella/sfu etc.
+	// This is the same form traefik uses for PathPrefix, so you can use a common env var
+	if httpPrefixEnv := os.Getenv("UMBRELLA_HTTP_PREFIX"); httpPrefixEnv != "" {
+		c.Prefix = httpPrefixEnv
+	}
+
+	if publicIpEnv := os.Getenv("UMBRELLA_PUBLIC_IP"); publicIpEnv != "" {
+		c.PublicIP = publicIpEnv
+	}
+
+	if publicHostEnv := os.Getenv("UMBRELLA_PUBLIC_HOST"); publicHostEnv != "" {
+		c.PublicHost = publicHostEnv
+	}
+
+	if publicMinPortEnv := os.Getenv("UMBRELLA_MIN_PORT"); publicMinPortEnv != "" {
+		p, err := strconv.Atoi(publicMinPortEnv)
+		if err == nil {
+			c.MinPort = uint16(p)
+		}
+	}
+
+	if publicMaxPortEnv := os.Getenv("UMBRELLA_MAX_PORT"); publicMaxPortEnv != "" {
+		p, err := strconv.Atoi(publicMaxPortEnv)
+		if err == nil {
+			c.MaxPort = uint16(p)
+		}
+	}
+
+	// Comma separated kid:secret pairs for verifying access tokens
+	if authKeysEnv := os.Getenv("UMBRELLA_AUTH_KEYS"); authKeysEnv != "" {
+		keys, err := sfu.ParseAuthKeys(authKeysEnv)
+		if err != nil {
+			return err
+		}
+
+		c.AuthKeys = make(map[string]string)
+		for kid, secret := range keys {
+			c.AuthKeys[kid] = string(secret)
+		}
+	}
+
+	// Comma separated secrets other nodes can present to trunk in here
+	if trunkSecretsEnv := os.Getenv("UMBRELLA_TRUNK_SECRETS"); trunkSecretsEnv != "" {
+		c.TrunkSecrets = nil
+		for _, secret := range sfu.ParseTrunkSecrets(trunkSecretsEnv) {
+			c.TrunkSecrets = append(c.TrunkSecrets, string(secret))
+		}
+	}
+
+	if stateFileEnv := os.Getenv("UMBRELLA_STATE_FILE"); stateFileEnv != "" {
+		c.StateFile = stateFileEnv
+	}
+
+	if httpServeAddrEnv := os.Getenv("UMBRELLA_HTTP_SERVE_ADDR"); httpServeAddrEnv != "" {
+		c.Listen = httpServeAddrEnv
+	}
+
+	return nil
+}
+
+// In bytes, for debug.SetMemoryLimit
+func (c *config) memoryLimit() int64 {
+	if c.MemoryLimitMB == 0 {
+		return math.MaxInt64
+	}
+
+	return c.MemoryLimitMB * 1024 * 1024
+}
+
+func (c *config) authKeys() map[string][]byte {
+	keys := make(map[string][]byte)
+	for kid, secret := range c.AuthKeys {
+		keys[kid] = []byte(secret)
+	}
+
+	return keys
+}
+
+func (c *config) trunkSecrets() [][]byte {
+	secrets := make([][]byte, 0)
+	for _, secret := range c.TrunkSecrets {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			secrets = append(secrets, []byte(secret))
+		}
+	}
+
+	return secrets
+}
+
+// Nil means keep the default
+func (c *config) iceServers() []webrtc.ICEServer {
+	if len(c.ICEServers) == 0 {
+		return nil
+	}
+
+	servers := make([]webrtc.ICEServer, 0, len(c.ICEServers))
+	for _, server := range c.ICEServers {
+		servers = append(servers, webrtc.ICEServer{
+			URLs:       server.URLs,
+			Username:   server.Username,
+			Credential: server.Credential,
+		})
+	}
+
+	return servers
+}
+
+func (c *config) dataLimits() sfu.DataLimits {
+	return sfu.DataLimits{
+		MaxMessageSize:    c.DataMaxMessageBytes,
+		MessagesPerSecond: c.DataMessagesPerSecond,
+		BytesPerSecond:    c.DataBytesPerSecond,
+	}
+}
+
+func (c *config) lastNPolicy() sfu.LastNPolicy {
+	return sfu.LastNPolicy{
+		Default: c.LastN,
+		Rooms:   c.RoomLastN,
+	}
+}
+
+func (c *config) logLevel() razor.LoggingLevel {
+	level, _ := razor.ParseLoggingLevel(c.LogLevel) // Checked when loaded
+	return level
+}
+
+// Whether anything which only applies on restart differs
+func (c *config) needsRestartComparedTo(other *config) bool {
+	a, b := *c, *other
+
+	for _, reloadable := range []*config{&a, &b} {
+		reloadable.ICEServers = nil
+		reloadable.LogLevel = ""
+		reloadable.MemoryLimitMB = 0
+		reloadable.DataMaxMessageBytes = 0
+		reloadable.DataMessagesPerSecond = 0
+		reloadable.DataBytesPerSecond = 0
+		reloadable.LastN = 0
+		reloadable.RoomLastN = nil
+		reloadable.Servers = nil
+	}
+
+	return !reflect.DeepEqual(a, b)
+}
+
+// What to add and remove to get from the servers in one config to another
+func serversDiff(prev []string, next []string) ([]string, []string) {
+	add := make([]string, 0)
+	for _, t := range next {
+		if !slices.Contains(prev, t) {
+			add = append(add, t)
+		}
+	}
+
+	remove := make([]string, 0)
+	for _, t := range prev {
+		if !slices.Contains(next, t) {
+			remove = append(remove, t)
+		}
+	}
+
+	return add, remove
+}
+
+// Calls apply with each new config after SIGHUP or the file changing, skipping any which fail to load
+func watchConfig(path string, current *config, apply func(prev *config, next *config)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	modTime := func() time.Time {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}
+		}
+		return info.ModTime()
+	}
+
+	lastModTime := modTime()
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hup:
+			log.Println("Reloading config on SIGHUP")
+		case <-ticker.C:
+			if path == "" {
+				continue
+			}
+
+			latest := modTime()
+			if latest.Equal(lastModTime) {
+				continue
+			}
+
+			lastModTime = latest
+			log.Println("Reloading config as", path, "changed")
+		}
+
+		next, err := loadConfig(path)
+		if err != nil {
+			log.Println("WARNING: keeping the current config, failed to reload:", err)
+			continue
+		}
+
+		apply(current, next)
+		current = next
+	}
+}
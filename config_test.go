@@ -0,0 +1,196 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// So whatever is set where the tests run doesn't leak into the config
+func clearConfigEnv(t *testing.T) {
+	for _, name := range []string{
+		"UMBRELLA_AUTH_KEYS",
+		"UMBRELLA_CLOUD",
+		"UMBRELLA_HTTP_PREFIX",
+		"UMBRELLA_HTTP_SERVE_ADDR",
+		"UMBRELLA_MAX_PORT",
+		"UMBRELLA_MIN_PORT",
+		"UMBRELLA_PUBLIC_HOST",
+		"UMBRELLA_PUBLIC_IP",
+		"UMBRELLA_STATE_FILE",
+		"UMBRELLA_TRUNK_SECRETS",
+	} {
+		t.Setenv(name, "")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr string
+		check   func(t *testing.T, c *config)
+	}{
+		{
+			name: "empty file gives the defaults",
+			yaml: "",
+			check: func(t *testing.T, c *config) {
+				if c.Listen != ":8081" || c.LogLevel != "error" || c.StateFile != "umbrella-state.json" {
+					t.Errorf("got %+v, want the defaults", c)
+				}
+			},
+		},
+		{
+			name: "values from the file",
+			yaml: "listen: \":9000\"\nlogLevel: info\nlastN: 3\nroomLastN:\n  kitchen: 1\nservers:\n  - wss://example.com/umbrella/wsb\n",
+			check: func(t *testing.T, c *config) {
+				if c.Listen != ":9000" || c.LogLevel != "info" || c.LastN != 3 || c.RoomLastN["kitchen"] != 1 {
+					t.Errorf("got %+v", c)
+				}
+
+				if !slices.Equal(c.Servers, []string{"wss://example.com/umbrella/wsb"}) {
+					t.Errorf("got servers %v", c.Servers)
+				}
+			},
+		},
+		{
+			name:    "unknown key",
+			yaml:    "listne: \":9000\"\n",
+			wantErr: "field listne not found",
+		},
+		{
+			name:    "bad log level",
+			yaml:    "logLevel: loud\n",
+			wantErr: "loud",
+		},
+		{
+			name:    "bad server url",
+			yaml:    "servers:\n  - http://example.com\n",
+			wantErr: "scheme",
+		},
+		{
+			name:    "zero data limit",
+			yaml:    "dataMessagesPerSecond: 0\n",
+			wantErr: "data channel limits",
+		},
+		{
+			name:    "negative memory limit",
+			yaml:    "memoryLimitMB: -1\n",
+			wantErr: "memoryLimitMB",
+		},
+		{
+			name: "zero memory limit is no limit",
+			yaml: "memoryLimitMB: 0\n",
+			check: func(t *testing.T, c *config) {
+				if c.memoryLimit() != math.MaxInt64 {
+					t.Errorf("got a limit of %d bytes", c.memoryLimit())
+				}
+			},
+		},
+		{
+			name: "memory limit in bytes",
+			yaml: "memoryLimitMB: 512\n",
+			check: func(t *testing.T, c *config) {
+				if c.memoryLimit() != 512*1024*1024 {
+					t.Errorf("got a limit of %d bytes", c.memoryLimit())
+				}
+			},
+		},
+		{
+			name:    "negative lastN",
+			yaml:    "lastN: -1\n",
+			wantErr: "lastN can't be negative",
+		},
+		{
+			name:    "negative room lastN",
+			yaml:    "roomLastN:\n  kitchen: -2\n",
+			wantErr: "room kitchen",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clearConfigEnv(t)
+
+			path := filepath.Join(t.TempDir(), "umbrella.yml")
+			if err := os.WriteFile(path, []byte(test.yaml), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			c, err := loadConfig(path)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			test.check(t, c)
+		})
+	}
+}
+
+func TestLoadConfigEnvOverridesFile(t *testing.T) {
+	clearConfigEnv(t)
+	t.Setenv("UMBRELLA_HTTP_SERVE_ADDR", ":7000")
+
+	path := filepath.Join(t.TempDir(), "umbrella.yml")
+	if err := os.WriteFile(path, []byte("listen: \":9000\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Listen != ":7000" {
+		t.Errorf("got listen %s, want the environment's :7000", c.Listen)
+	}
+}
+
+func TestLoadConfigMissingFile(t *testing.T) {
+	clearConfigEnv(t)
+
+	if _, err := loadConfig(filepath.Join(t.TempDir(), "missing.yml")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestServersDiff(t *testing.T) {
+	tests := []struct {
+		name       string
+		prev       []string
+		next       []string
+		wantAdd    []string
+		wantRemove []string
+	}{
+		{name: "nothing", wantAdd: []string{}, wantRemove: []string{}},
+		{name: "unchanged", prev: []string{"a", "b"}, next: []string{"b", "a"}, wantAdd: []string{}, wantRemove: []string{}},
+		{name: "added", prev: []string{"a"}, next: []string{"a", "b"}, wantAdd: []string{"b"}, wantRemove: []string{}},
+		{name: "removed", prev: []string{"a", "b"}, next: []string{"a"}, wantAdd: []string{}, wantRemove: []string{"b"}},
+		{name: "replaced", prev: []string{"a"}, next: []string{"b"}, wantAdd: []string{"b"}, wantRemove: []string{"a"}},
+		{name: "all removed", prev: []string{"a", "b"}, wantAdd: []string{}, wantRemove: []string{"a", "b"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			add, remove := serversDiff(test.prev, test.next)
+
+			if !slices.Equal(add, test.wantAdd) {
+				t.Errorf("add got %v, want %v", add, test.wantAdd)
+			}
+
+			if !slices.Equal(remove, test.wantRemove) {
+				t.Errorf("remove got %v, want %v", remove, test.wantRemove)
+			}
+		})
+	}
+}
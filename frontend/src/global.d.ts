@@ -1,5 +1,6 @@
 interface UmbrellaInjectedParameters {
     HttpPrefix: string;
+    IceServers: RTCIceServer[];
 }
 
 interface Window {
@@ -1,7 +1,7 @@
 import React, { useEffect } from 'react';
 import ReactDOM from 'react-dom';
 import { useRef, useState } from 'react';
-import { SetUpstreamTracks, RemoteNodeMessage, TrackDescriptor, TrackKind, CurrentServers, MidToUmbrellaIDMapping, SFUStatus, SFUStatusClient, SFUStatusPeerConnection } from '../generated/sfu'
+import { DataMessage, SetUpstreamTracks, RemoteNodeMessage, TrackDescriptor, TrackKind, CurrentServers, MidToUmbrellaIDMapping, ServerConnectionState, ServerEntry, ServerState, SFUStatus, SFUStatusCandidate, SFUStatusClient, SFUStatusPeerConnection, SFUStatusRoom, SFUStatusUpdate } from '../generated/sfu'
 
 function trackKindFromString(k: string) : TrackKind  {
     switch(k) {
@@ -119,19 +119,20 @@ const LocalVideo: React.FC<LocalVideoProps> = ({ stream }) => {
 
 interface RemoteVideosProps {
     tracks: remoteTrack[];
+    speaking: Set<string>;
 }
 
-const RemoteVideos: React.FC<RemoteVideosProps> = ({ tracks }) => {
+const RemoteVideos: React.FC<RemoteVideosProps> = ({ tracks, speaking }) => {
     return (
         <>
             {tracks.map((track, index) => (
-                <RemoteVideo key={index} track={track} />
+                <RemoteVideo key={index} track={track} speaking={speaking.has(track.umbrellaId)} />
             ))}
         </>
     );
 };
 
-const RemoteVideo: React.FC<{ track: remoteTrack }> = ({ track }) => {
+const RemoteVideo: React.FC<{ track: remoteTrack, speaking: boolean }> = ({ track, speaking }) => {
     const videoRef = useRef<HTMLVideoElement | null>(null);
 
     useEffect(() => {
@@ -140,7 +141,48 @@ const RemoteVideo: React.FC<{ track: remoteTrack }> = ({ track }) => {
         }
     }, [track]);
 
-    return <div className='video-container'><video key={track.umbrellaId} className="remote-video" ref={videoRef} autoPlay playsInline controls /><p className='video-overlay'>Remote video</p></div>;
+    return <div className='video-container'><video key={track.umbrellaId} className={speaking ? "remote-video speaking" : "remote-video"} ref={videoRef} autoPlay playsInline controls /><p className='video-overlay'>Remote video</p></div>;
+};
+
+// Data channel payloads are ours to define, so everything sent is JSON with a type, of which chat is the only one so far
+interface chatMessage {
+    from: string;
+    text: string;
+}
+
+const encodeChat = (text: string) : Uint8Array => {
+    return new TextEncoder().encode(JSON.stringify({type: "chat", text: text}));
+};
+
+const decodeChat = (message: DataMessage) : chatMessage | null => {
+    try {
+        const payload = JSON.parse(new TextDecoder().decode(message.payload));
+        if(payload.type === "chat" && typeof payload.text === "string") {
+            return { from: message.fromIdentity || message.fromClientId.substring(0, 8), text: payload.text };
+        }
+    } catch(e) {
+        console.log("Ignoring data message which isn't ours: "+e);
+    }
+
+    return null;
+};
+
+const ChatBox: React.FC<{ messages: chatMessage[], send: (text: string) => void }> = ({messages, send}) => {
+    const [text, setText] = useState<string>("");
+
+    const sendText = () => {
+        if(text.trim().length > 0) {
+            send(text);
+            setText("");
+        }
+    };
+
+    return (
+        <div className='chat'>
+            { messages.map((m, index) => <p key={index}><b>{m.from}</b>: {m.text}</p>) }
+            <input type="text" value={text} placeholder="Message the room" onChange={e => setText(e.target.value)} onKeyDown={e => { if(e.key === "Enter") { sendText(); } }} />
+        </div>
+    );
 };
 
 interface SfuAppJoinedProps {
@@ -150,13 +192,31 @@ interface SfuAppJoinedProps {
 const SfuAppJoined: React.FC<SfuAppJoinedProps> = ({requestLocalMediaFirst}) => {
     const [localStream, setLocalStream] = useState<MediaStream | null>(null);
     const [remoteTracks, setRemoteTracks] = useState<remoteTrack[]>([]);
+    const [chatMessages, setChatMessages] = useState<chatMessage[]>([]);
+    const [speakingVideos, setSpeakingVideos] = useState<Set<string>>(new Set());
 
     const websocketRef = useRef<WebSocket | null>(null);
+    const dataReliableRef = useRef<RTCDataChannel | null>(null);
     const offerNeededTimerRef = useRef<number>(-1);
 
     useEffect(() => {
-        const pageUrl = window.location.href;
-        const wsUrl = "wss" + pageUrl.substring(pageUrl.indexOf(":"), pageUrl.lastIndexOf("/")) + "/wsb";
+        const pageUrl = window.location.origin + window.location.pathname;
+
+        // The room and access token come from the page url, e.g. /sfu?room=kitchen&token=..., and are passed straight through to the websocket
+        const pageParams = new URLSearchParams(window.location.search);
+        const wsParams = new URLSearchParams();
+        const room = pageParams.get("room");
+        if(room) {
+            wsParams.set("room", room);
+        }
+
+        const token = pageParams.get("token");
+        if(token) {
+            wsParams.set("token", token);
+        }
+
+        const wsQuery = wsParams.toString();
+        const wsUrl = "wss" + pageUrl.substring(pageUrl.indexOf(":"), pageUrl.lastIndexOf("/")) + "/wsb" + (wsQuery.length > 0 ? "?" + wsQuery : "");
         console.log("Websocket url set to: " + wsUrl);
 
         function log(msg: string) {
@@ -180,8 +240,10 @@ const SfuAppJoined: React.FC<SfuAppJoinedProps> = ({requestLocalMediaFirst}) =>
         .then(streamInit => {
             const stream = requestLocalMediaFirst ? streamInit : null;
 
+            // The server hands these out so they include its TURN server, with fresh credentials, if it has one
+            const injectedIceServers = window.__injected__.IceServers;
             const pcConfig: RTCConfiguration = {
-                iceServers: [
+                iceServers: injectedIceServers && injectedIceServers.length > 0 ? injectedIceServers : [
                     {urls: ["stun:stun.l.google.com:19302","stun:stun2.1.google.com:19302"]}
                 ]
             };
@@ -189,11 +251,30 @@ const SfuAppJoined: React.FC<SfuAppJoinedProps> = ({requestLocalMediaFirst}) =>
             const incoming = new RTCPeerConnection(pcConfig);
             const outgoing = new RTCPeerConnection(pcConfig);
 
-            // Gives the offers something to be about
-            const dataOut = outgoing.createDataChannel("data-out", {ordered: false});
-            const dataIn = incoming.createDataChannel("data-in", {ordered: false});
+            // Negotiated with the same ids as the server uses, so they're there on both ends from the start
+            // We send on outgoing, and get what the rest of the room sent on incoming
+            const unreliable: RTCDataChannelInit = {negotiated: true, id: 1, ordered: false, maxRetransmits: 0};
+            const reliable: RTCDataChannelInit = {negotiated: true, id: 2};
+
+            outgoing.createDataChannel("data", unreliable);
+            dataReliableRef.current = outgoing.createDataChannel("data-reliable", reliable);
+
+            const onData = (event: MessageEvent) => {
+                const chat = decodeChat(DataMessage.fromBinary(new Uint8Array(event.data)));
+                if(chat) {
+                    setChatMessages((prev) => [...prev, chat]);
+                }
+            };
+
+            [incoming.createDataChannel("data", unreliable), incoming.createDataChannel("data-reliable", reliable)].forEach(dc => {
+                dc.binaryType = "arraybuffer";
+                dc.onmessage = onData;
+            });
 
             const midToUmbrellaIDMapping = new Map<string, string>();
+
+            // The server names the dominant speaker by their audio track, so this finds the video that goes with it
+            const umbrellaIDToStreamID = new Map<string, string>();
             let stagedIncomingTracks : stagedIncomingTrack[] = [];
 
             // Should be called whenever the mapping changes or we receive a new track in incoming.ontrack
@@ -414,10 +495,29 @@ const SfuAppJoined: React.FC<SfuAppJoinedProps> = ({requestLocalMediaFirst}) =>
                 if (msg.upstreamTracks) {
                     log("Upstream tracks recevied "+JSON.stringify(msg.upstreamTracks));
 
+                    msg.upstreamTracks.tracks.forEach(descriptor => {
+                        umbrellaIDToStreamID.set(descriptor.umbrellaId, descriptor.streamId);
+                    });
+
                     // Just echoing it for now, unlike pion we don't need to get ready
                     ws.send(RemoteNodeMessage.toBinary({acceptTracks: {tracks: msg.upstreamTracks.tracks}}));
                 }
 
+                if (msg.activeSpeakers) {
+                    const dominantStreamId = umbrellaIDToStreamID.get(msg.activeSpeakers.dominant);
+                    const speaking = new Set<string>();
+
+                    if(dominantStreamId) {
+                        umbrellaIDToStreamID.forEach((streamId, umbrellaId) => {
+                            if(streamId == dominantStreamId) {
+                                speaking.add(umbrellaId);
+                            }
+                        });
+                    }
+
+                    setSpeakingVideos(speaking);
+                }
+
                 if (msg.midMappings) {
                     log("MID <-> Umbrella mappings received "+JSON.stringify(msg.midMappings.mapping));
 
@@ -473,12 +573,22 @@ const SfuAppJoined: React.FC<SfuAppJoinedProps> = ({requestLocalMediaFirst}) =>
         }
     };
 
+    // The server doesn't send our own messages back, so they're shown as soon as they go
+    const sendChat = (text: string) => {
+        const dc = dataReliableRef.current;
+        if(dc !== null && dc.readyState === "open") {
+            dc.send(encodeChat(text));
+            setChatMessages((prev) => [...prev, {from: "me", text: text}]);
+        }
+    };
+
     return (
         <div>
             <div className='centering-container'>
                 { requestLocalMediaFirst && <LocalVideo stream={localStream} /> }
-                <RemoteVideos tracks={remoteTracks} />
+                <RemoteVideos tracks={remoteTracks} speaking={speakingVideos} />
             </div>
+            <ChatBox messages={chatMessages} send={sendChat} />
         </div>
     );
 };
@@ -512,51 +622,104 @@ export const SfuApp = () => {
     )
 };
 
+const serverConnectionStateToString = (state: ServerConnectionState): string => {
+    switch(state) {
+        case ServerConnectionState.Connecting:
+            return "connecting";
+        case ServerConnectionState.Connected:
+            return "connected";
+        case ServerConnectionState.BackingOff:
+            return "backing off";
+        case ServerConnectionState.Stopped:
+            return "stopped";
+    }
+
+    return "unknown";
+};
+
+const ServerStatusListElement: React.FC<{ url: string, state?: ServerState }> = ({url, state}) => {
+    return (
+        <li>{ state?.name ? state.name + " - " : "" }{ url } <ServerStateText state={state} /></li>
+    );
+};
+
+const ServerStateText: React.FC<{ state?: ServerState }> = ({state}) => {
+    if(state == null) {
+        return null;
+    }
+
+    return (
+        <>
+            ({ serverConnectionStateToString(state.state) }
+            { state.state === ServerConnectionState.BackingOff ? ", retrying at " + new Date(Number(state.retryAt)).toLocaleTimeString() : "" }
+            { state.failures > 0 ? ", " + state.failures + " failures" : "" }
+            { state.lastError !== "" ? ", last error: " + state.lastError : "" })
+        </>
+    );
+};
+
 export const ServersApp = () => {
-    const [servers, setServers] = useState<string[]>([]);
+    const [entries, setEntries] = useState<ServerEntry[]>([]);
+    const [states, setStates] = useState<ServerState[]>([]);
     const addServerInputRef = useRef<HTMLInputElement | null>(null);
+    const addServerNameInputRef = useRef<HTMLInputElement | null>(null);
+
+    const applyCurrentServers = (buffer: ArrayBuffer) => {
+        const current = CurrentServers.fromBinary(new Uint8Array(buffer));
+        setEntries([...current.entries].sort((a, b) => a.url.localeCompare(b.url)));
+        setStates(current.states);
+    };
 
     useEffect(() => {
         fetch(window.location.pathname, {method: 'GET', headers:{'Content-Type': "application/x-protobuf"}})
         .then((response) => response.arrayBuffer())
         .then((buffer) => {
-            setServers(CurrentServers.fromBinary(new Uint8Array(buffer)).servers);
+            applyCurrentServers(buffer);
             addServerInputRef.current?.focus();
         }).catch(console.log);
 
         return () => {};
     }, []);
 
-    const addServerClick = () => {
-        const updateVal = addServerInputRef.current!.value!;
-        const serversUpdate = updateVal === "" ? [] : [updateVal];
+    const setServerEntries = (update: ServerEntry[]) => {
+        // With auth on changing the servers takes an admin token, given like /servers?token=...
+        const headers: Record<string, string> = {'Content-Type': "application/x-protobuf"};
+        const token = new URLSearchParams(window.location.search).get("token");
+        if(token) {
+            headers['Authorization'] = "Bearer " + token;
+        }
 
         fetch(window.location.pathname, 
             {
                 method: 'POST', 
-                headers:{'Content-Type': "application/x-protobuf"},
-                body: CurrentServers.toBinary({servers:serversUpdate})
+                headers: headers,
+                body: CurrentServers.toBinary({servers: [], states: [], entries: update})
             }
         ).then((response) => response.arrayBuffer())
-        .then((buffer) => {
-            setServers(CurrentServers.fromBinary(new Uint8Array(buffer)).servers);
-            addServerInputRef.current?.focus();
-        }).catch(console.log);
+        .then(applyCurrentServers)
+        .catch(console.log);
+    };
+
+    const addServerClick = () => {
+        const url = addServerInputRef.current!.value!;
+        const name = addServerNameInputRef.current!.value!;
+
+        if(url !== "") {
+            setServerEntries([...entries.filter((e) => e.url !== url), {url: url, name: name, enabled: true, addedAt: BigInt(0), fromConfig: false}]);
+        }
 
         addServerInputRef.current!.value = "";
+        addServerNameInputRef.current!.value = "";
+        addServerInputRef.current?.focus();
     };
 
     const removeServerClick = (server: string) => {
-        fetch(window.location.pathname, 
-            {
-                method: 'POST', 
-                headers:{'Content-Type': "application/x-protobuf"},
-                body: CurrentServers.toBinary({servers: servers.filter((s) => s !== server)})
-            }
-        ).then((response) => response.arrayBuffer())
-        .then((buffer) => {
-            setServers(CurrentServers.fromBinary(new Uint8Array(buffer)).servers);
-        }).catch(console.log);
+        // With no entries left the empty servers list clears them all
+        setServerEntries(entries.filter((e) => e.url !== server));
+    };
+
+    const toggleServerClick = (server: string) => {
+        setServerEntries(entries.map((e) => e.url === server ? {...e, enabled: !e.enabled} : e));
     };
 
     return (
@@ -565,14 +728,14 @@ export const ServersApp = () => {
                 <h4>Servers</h4>
                 <div style={{ flexBasis: '100%' }}></div>
                 <ul>
-                { servers.length === 0 ? ( <li>No servers</li>) : (<>
-                    { servers.map((server, index) => (
-                        <li>{ server } <button onClick={() => { removeServerClick(server) }}>Remove</button></li>
+                { entries.length === 0 ? ( <li>No servers</li>) : (<>
+                    { entries.map((entry) => (
+                        <li key={entry.url}>{ entry.name !== "" ? entry.name + " - " : "" }{ entry.url } { entry.enabled ? <ServerStateText state={states.find(st => st.url === entry.url)} /> : "(disabled)" } { entry.fromConfig ? "from config" : "added " + new Date(Number(entry.addedAt)).toLocaleString() } <button onClick={() => { toggleServerClick(entry.url) }}>{ entry.enabled ? "Disable" : "Enable" }</button> { entry.fromConfig ? null : <button onClick={() => { removeServerClick(entry.url) }}>Remove</button> }</li>
                     )) }
                 </>) } 
                 </ul>
                 <div style={{ flexBasis: '100%' }}></div>
-                <input ref={addServerInputRef} type='text' /><button onClick={addServerClick}>Add Server</button>
+                <input ref={addServerInputRef} type='text' placeholder='url' /><input ref={addServerNameInputRef} type='text' placeholder='name (optional)' /><button onClick={addServerClick}>Add Server</button>
             </div>
         </>
     )
@@ -584,22 +747,55 @@ const TrackDescriptorStatusListElement: React.FC<{ descriptor: TrackDescriptor }
             <li>Kind {  trackKindToString(descriptor.kind) }</li>
             <li>Track ID { descriptor.id }</li>
             <li>Stream ID { descriptor.streamId }</li>
+            { descriptor.hopPath.length > 0 ? <li>Hop path { descriptor.hopPath.join(" > ") }</li> : null }
         </ul></li>
     );
 };
 
+const formatBitrate = (bps: bigint): string => {
+    return (Number(bps) / 1000).toFixed(0) + " kbps";
+};
+
+const formatCandidate = (c: SFUStatusCandidate | undefined): string => {
+    if(!c) {
+        return "unknown";
+    }
+
+    return c.type + " " + c.protocol + " " + c.address + ":" + c.port + (c.relayProtocol ? " (relayed over " + c.relayProtocol + ")" : "");
+};
+
 const PeerConnectionStatusListElement: React.FC<{ label: string, pc: SFUStatusPeerConnection | undefined }> = ({label, pc}) => {
+    if(!pc) {
+        return (<li key={label}>{ label } none</li>);
+    }
+
+    const pair = pc.selectedCandidatePair;
+
     return (
-        <li key={label}>{ label } <ul>
-            <li></li>
+        <li key={label}>{ label } { pc.connectionState } <ul>
+            <li>ICE { pc.iceConnectionState }, signaling { pc.signalingState }</li>
+            <li>Candidate pair: { pair ? formatCandidate(pair.local) + " to " + formatCandidate(pair.remote) + ", RTT " + pair.roundTripTimeMs.toFixed(1) + " ms" : "none selected" }</li>
+            <li>Sending { formatBitrate(pc.sendBitrate) } ({ pc.bytesSent.toString() } bytes), receiving { formatBitrate(pc.receiveBitrate) } ({ pc.bytesReceived.toString() } bytes)</li>
+            <li>Streams<ul>
+                { pc.tracks.map(t => (
+                    <li key={t.ssrc}>{ t.outbound ? "Out" : "In" } { trackKindToString(t.kind) } { t.umbrellaId || "(unknown track)" } mid { t.mid }{ t.rid ? " rid " + t.rid : "" } ssrc { t.ssrc }<ul>
+                        <li>{ t.packets.toString() } packets, { t.bytes.toString() } bytes, { formatBitrate(t.bitrate) }</li>
+                        <li>Lost { t.packetsLost.toString() }{ t.outbound ? " (" + (t.fractionLost * 100).toFixed(1) + "% in last report)" : "" }, jitter { t.jitterMs.toFixed(1) } ms, RTT { t.roundTripTimeMs > 0 ? t.roundTripTimeMs.toFixed(1) + " ms" : "unknown" }</li>
+                        <li>NACK { t.nackCount }, PLI { t.pliCount }, FIR { t.firCount }</li>
+                    </ul></li>
+                ))}
+            </ul></li>
         </ul></li>
     );
 };
 
 const ClientStatusListElement: React.FC<{ client: SFUStatusClient }> = ({client}) => {
     return (
-        <li key={client.label}>{ client.label } <ul>
+        <li key={client.id}>{ client.label }{ client.statusTimedOut ? " (not responding)" : "" } <ul>
             <li>Trunk url: {  client.trunkUrl }</li>
+            { client.remoteNodeId ? <li>Remote node: { client.remoteNodeId }</li> : null }
+            <li>Subscriptions: { client.subscribeAll ? "all tracks" : client.subscriptions.join(", ") }</li>
+            <li>Estimated bandwidth: { client.estimatedBitrate > 0 ? (Number(client.estimatedBitrate) / 1000).toFixed(0) + " kbps" : "unknown" }</li>
             <PeerConnectionStatusListElement label='Incoming PC' pc={client.incomingPC} />
             <PeerConnectionStatusListElement label='Outgoing PC' pc={client.outgoingPC} />
             <li>Incoming tracks<ul>
@@ -609,11 +805,14 @@ const ClientStatusListElement: React.FC<{ client: SFUStatusClient }> = ({client}
                 { client.outgoingTracks.map(t => <TrackDescriptorStatusListElement descriptor={t}/>)}
             </ul></li>
             <li>Senders<ul>
-                { client.senders.map(s => <li>{s.umbrellaId} { s.hasTrack ? ("Has a track of ID " + s.trackIdIfSet) : "Has no track ID"}</li>)}
+                { client.senders.map(s => <li>{s.umbrellaId} { s.hasTrack ? ("Has a track of ID " + s.trackIdIfSet) : "Has no track ID"}{ s.paused ? " (paused for bandwidth)" : "" }{ s.hidden ? " (hidden by last n)" : "" }</li>)}
             </ul></li>
             <li>MID to Umbrella ID mappings<ul>
                 { client.midMapping.map(m => <li>{m.mid} : {m.umbrellaId}</li>)}
             </ul></li>
+            <li>Tracks the remote refused<ul>
+                { client.rejectedTracks.map(t => <TrackDescriptorStatusListElement descriptor={t}/>)}
+            </ul></li>
             <li>Staged incoming tracks<ul>
                 { client.stagedIncomingTracks.map(sit => <li>{sit.streamId} {sit.trackId} {sit.mid}</li>)}
             </ul></li>
@@ -621,41 +820,118 @@ const ClientStatusListElement: React.FC<{ client: SFUStatusClient }> = ({client}
     );
 };
 
+const RoomStatusElement: React.FC<{ room: SFUStatusRoom }> = ({room}) => {
+    return (
+        <div key={room.id}>
+            <h5>Room { room.id }</h5>
+            <h6>Relaying tracks</h6>
+            <ul>
+            {room.relayingTracks.map(td => (
+                <TrackDescriptorStatusListElement descriptor={td} />
+            ))}
+            </ul>
+            <h6>Clients</h6>
+            {room.clients.map(c => (
+                <ClientStatusListElement key={c.id} client={c} />
+            ))}
+        </div>
+    );
+};
+
+// Applies a delta from the status stream, which only ever sends whole clients and rooms
+const applyStatusUpdate = (status: SFUStatus | null, update: SFUStatusUpdate): SFUStatus | null => {
+    if(update.snapshot) {
+        return update.snapshot;
+    }
+
+    if(status == null) {
+        return null;
+    }
+
+    const next = SFUStatus.clone(status);
+
+    if(update.serversChanged) {
+        next.servers = update.servers;
+        next.serverStates = update.serverStates;
+    }
+
+    if(update.recordings) {
+        next.recordings = update.recordings;
+    }
+
+    next.rooms = next.rooms.filter(r => !update.removedRooms.includes(r.id));
+
+    update.rooms.forEach(roomUpdate => {
+        let room = next.rooms.find(r => r.id == roomUpdate.id);
+        if(!room) {
+            room = SFUStatusRoom.create({ id: roomUpdate.id });
+            next.rooms.push(room);
+        }
+
+        if(roomUpdate.relayingTracksChanged) {
+            room.relayingTracks = roomUpdate.relayingTracks;
+        }
+
+        const changed = new Set(roomUpdate.clients.map(c => c.id));
+        room.clients = room.clients.filter(c => !changed.has(c.id) && !roomUpdate.removedClients.includes(c.id)).concat(roomUpdate.clients);
+        room.clients.sort((a, b) => a.id.localeCompare(b.id));
+    });
+
+    next.rooms.sort((a, b) => a.id.localeCompare(b.id));
+
+    return next;
+};
+
 export const StatusApp = () => {
     const [status, setStatus] = useState<SFUStatus | null>(null);
 
     useEffect(() => {
-        fetch(window.location.pathname, {method: 'GET', headers:{'Content-Type': "application/x-protobuf"}})
-            .then((response) => response.arrayBuffer())
-            .then((buffer) => {
-                setStatus(SFUStatus.fromBinary(new Uint8Array(buffer)));
-            }).catch(console.log);
+        // With auth on the status takes an admin token, given like /status?token=...
+        const pageUrl = window.location.origin + window.location.pathname;
+        const token = new URLSearchParams(window.location.search).get("token");
+        const wsUrl = "wss" + pageUrl.substring(pageUrl.indexOf(":")) + "/ws" + (token ? "?token=" + encodeURIComponent(token) : "");
 
-        return () => {};
+        const ws = new WebSocket(wsUrl);
+        ws.binaryType = "arraybuffer";
+
+        ws.onmessage = e => {
+            const update = SFUStatusUpdate.fromBinary(new Uint8Array(e.data));
+            setStatus(current => applyStatusUpdate(current, update));
+        };
+
+        ws.onclose = e => {
+            console.log("Status stream closed");
+        };
+
+        return () => {
+            ws.close();
+        };
     }, []);
 
     return (
         <>
             <div>
-                <h4>Status</h4>
+                <h4>Status{ status?.nodeId ? " of node " + status.nodeId : "" }</h4>
                 { (status == null) ? (
                     <p>Status is null</p>
                 ) : (
                     <>
-                        <h5>Relaying tracks</h5>
-                        <ul>
-                        {status.relayingTracks.map(td => (
-                            <TrackDescriptorStatusListElement descriptor={td} />
-                        ))}
-                        </ul>
-                        <h5>Clients</h5>
-                        {status.clients.map(c => (
-                            <ClientStatusListElement client={c} />
+                        {status.rooms.map(r => (
+                            <RoomStatusElement key={r.id} room={r} />
                         ))}
                         <h5>servers</h5>
                         <ul>
                         {status.servers.map(t => (
-                            <li>{ t }</li>
+                            <ServerStatusListElement key={t} url={t} state={status.serverStates.find(st => st.url === t)} />
+                        ))}
+                        </ul>
+                        <h5>recordings</h5>
+                        <ul>
+                        {status.recordings?.rooms.map(r => (
+                            <li>Recording everything in room { r }</li>
+                        ))}
+                        {status.recordings?.recordings.map(r => (
+                            <li>{ r.umbrellaId } ({ r.mimeType } { r.layer }) to { r.path }, { r.packetsWritten.toString() } packets written, { r.packetsDropped.toString() } dropped</li>
                         ))}
                         </ul>
                     </>
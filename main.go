@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -56,56 +57,112 @@ func (rr *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 
 type umbrellaInjectedParameters struct {
 	HttpPrefix string
+	IceServers []injectedICEServer
+}
+
+// Just what the browser RTCIceServer wants
+type injectedICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
 }
 
 func main() {
-	cloudEnv := os.Getenv("UMBRELLA_CLOUD")
-	isCloud := cloudEnv == "1"
+	if len(os.Args) > 1 && os.Args[1] == "token" {
+		runTokenCommand(os.Args[2:])
+		return
+	}
+
+	configPath := os.Getenv("UMBRELLA_CONFIG")
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	isCloud := cfg.Cloud
+	httpPrefix := cfg.Prefix
+	publicIp := net.ParseIP(cfg.PublicIP)
+	publicHost := cfg.PublicHost
+	minPort := cfg.MinPort
+	maxPort := cfg.MaxPort
 
-	// Path from the domain base, to the umbrella sfu base, including any leading slash
-	// For example "/umbrella" serves at https://domain:port/umbrella/sfu etc.
-	// This is the same form traefik uses for PathPrefix, so you can use a common env var
-	httpPrefixEnv := os.Getenv("UMBRELLA_HTTP_PREFIX")
-	httpPrefix := ""
+	// Single ports shared by every peer connection, which replace the range above for UDP
+	muxPorts := sfu.ICEMuxPorts{}
 
-	if httpPrefixEnv != "" {
-		httpPrefix = httpPrefixEnv
+	if udpMuxPortEnv := os.Getenv("UMBRELLA_UDP_MUX_PORT"); udpMuxPortEnv != "" {
+		p, err := strconv.Atoi(udpMuxPortEnv)
+		if err == nil {
+			muxPorts.UDP = p
+		}
 	}
 
-	publicIpEnv := os.Getenv("UMBRELLA_PUBLIC_IP")
-	publicIp := net.ParseIP(publicIpEnv)
+	if tcpMuxPortEnv := os.Getenv("UMBRELLA_TCP_MUX_PORT"); tcpMuxPortEnv != "" {
+		p, err := strconv.Atoi(tcpMuxPortEnv)
+		if err == nil {
+			muxPorts.TCP = p
+		}
+	}
 
-	publicHostEnv := os.Getenv("UMBRELLA_PUBLIC_HOST")
+	// With no auth keys auth is off
+	authKeys := cfg.authKeys()
+	trunkSecrets := cfg.trunkSecrets()
+
+	// What we present to, and how we verify, the servers we trunk out to
+	trunkSecurity, err := sfu.NewTrunkSecurity(
+		os.Getenv("UMBRELLA_TRUNK_CREDENTIAL"),
+		os.Getenv("UMBRELLA_TRUNK_CA_FILE"),
+		os.Getenv("UMBRELLA_TRUNK_PINS"),
+		os.Getenv("UMBRELLA_TRUNK_INSECURE") == "1",
+	)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	// Where recordings are written, with none set recording is off
+	recordingDir := os.Getenv("UMBRELLA_RECORDING_DIR")
 
-	publicMinPortEnv := os.Getenv("UMBRELLA_MIN_PORT")
-	publicMaxPortEnv := os.Getenv("UMBRELLA_MAX_PORT")
+	// Listen address for the built in TURN server, with none set it is off
+	turnAddr := os.Getenv("UMBRELLA_TURN_ADDR")
 
-	minPort := uint16(40000)
-	maxPort := uint16(60000)
+	turnRelayIp := publicIp
+	if turnRelayIpEnv := os.Getenv("UMBRELLA_TURN_RELAY_IP"); turnRelayIpEnv != "" {
+		turnRelayIp = net.ParseIP(turnRelayIpEnv)
+	}
+
+	turnMinPort := uint16(0)
+	turnMaxPort := uint16(0)
 
-	if publicMinPortEnv != "" {
-		p, err := strconv.Atoi(publicMinPortEnv)
+	if turnMinPortEnv := os.Getenv("UMBRELLA_TURN_MIN_PORT"); turnMinPortEnv != "" {
+		p, err := strconv.Atoi(turnMinPortEnv)
 		if err == nil {
-			minPort = uint16(p)
+			turnMinPort = uint16(p)
 		}
 	}
 
-	if publicMaxPortEnv != "" {
-		p, err := strconv.Atoi(publicMaxPortEnv)
+	if turnMaxPortEnv := os.Getenv("UMBRELLA_TURN_MAX_PORT"); turnMaxPortEnv != "" {
+		p, err := strconv.Atoi(turnMaxPortEnv)
 		if err == nil {
-			maxPort = uint16(p)
+			turnMaxPort = uint16(p)
 		}
 	}
 
-	httpServeAddrEnv := os.Getenv("UMBRELLA_HTTP_SERVE_ADDR")
-
-	// Default is to serve on 8081
-	httpServeAddr := ":8081"
-	if httpServeAddrEnv != "" {
-		httpServeAddr = httpServeAddrEnv
+	turnCredentialTTL := time.Duration(0)
+	if turnTTLEnv := os.Getenv("UMBRELLA_TURN_TTL"); turnTTLEnv != "" {
+		turnCredentialTTL, err = time.ParseDuration(turnTTLEnv)
+		if err != nil {
+			log.Fatal(err)
+			return
+		}
 	}
 
+	httpServeAddr := cfg.Listen
+
 	log.Println("Hello there", runtime.GOOS, runtime.GOARCH)
+	if configPath != "" {
+		log.Println("Config from", configPath)
+	}
 	if isCloud {
 		log.Println("Running in cloud configuration")
 
@@ -118,7 +175,15 @@ func main() {
 		log.Println("Running in edge configuration")
 	}
 
-	debug.SetMemoryLimit(256 * 1024 * 1024)
+	if len(authKeys) == 0 && len(trunkSecrets) == 0 {
+		log.Println("WARNING: no auth keys or trunk secrets set, anyone who can reach the server can join")
+	}
+
+	if os.Getenv("UMBRELLA_TRUNK_INSECURE") == "1" {
+		log.Println("WARNING: trunk certificates are not being verified")
+	}
+
+	debug.SetMemoryLimit(cfg.memoryLimit())
 
 	host, err := os.Hostname()
 	if err != nil {
@@ -130,8 +195,8 @@ func main() {
 		host = host + ".local"
 	}
 
-	if isCloud && publicHostEnv != "" {
-		host = publicHostEnv
+	if isCloud && publicHost != "" {
+		host = publicHost
 	} else {
 		overriddenhost, overriddenport, err := net.SplitHostPort(httpServeAddr)
 		if err != nil {
@@ -171,8 +236,51 @@ func main() {
 		ipStr = &s
 	}
 
-	logger := razor.NewLogger(razor.LogLevelError, false)
-	s := sfu.NewSfu(logger, minPort, maxPort, ipStr)
+	logger := razor.NewLogger(cfg.logLevel(), false)
+	s := sfu.NewSfu(logger, minPort, maxPort, ipStr, muxPorts, cfg.StateFile)
+	s.SetAuthenticator(sfu.NewAuthenticator(authKeys, trunkSecrets))
+
+	if iceServers := cfg.iceServers(); iceServers != nil {
+		s.SetICEServers(iceServers)
+	}
+
+	s.SetDataLimits(cfg.dataLimits())
+	s.SetLastNPolicy(cfg.lastNPolicy())
+
+	// Random otherwise, which is fine unless you want to recognise the node in hop paths
+	if nodeIdEnv := os.Getenv("UMBRELLA_NODE_ID"); nodeIdEnv != "" {
+		s.SetNodeID(nodeIdEnv)
+	}
+	log.Println("Node ID", s.NodeID())
+
+	if turnAddr != "" {
+		turnPublicHost := ""
+		if isCloud {
+			turnPublicHost = publicHost
+		}
+
+		turnServer, err := sfu.NewTurnServer(sfu.TurnConfig{
+			ListenAddr:    turnAddr,
+			RelayIP:       turnRelayIp,
+			PublicHost:    turnPublicHost,
+			MinPort:       turnMinPort,
+			MaxPort:       turnMaxPort,
+			Username:      os.Getenv("UMBRELLA_TURN_USERNAME"),
+			Password:      os.Getenv("UMBRELLA_TURN_PASSWORD"),
+			Secret:        os.Getenv("UMBRELLA_TURN_SECRET"),
+			CredentialTTL: turnCredentialTTL,
+		}, logger)
+		if err != nil {
+			log.Fatal(err)
+			return
+		}
+
+		defer turnServer.Close()
+
+		s.SetTurnServer(turnServer)
+	}
+	s.SetTrunkSecurity(trunkSecurity)
+	s.SetRecordingDir(recordingDir)
 
 	mux := http.NewServeMux()
 
@@ -188,12 +296,42 @@ func main() {
 		s.WebsocketHandler(w, r)
 	}))
 
+	whip := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.WhipHandler(w, r)
+	})
+
+	addHandler("/whip", whip)
+	addHandler("/whip/", whip)
+
+	whep := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.WhepHandler(w, r)
+	})
+
+	addHandler("/whep", whep)
+	addHandler("/whep/", whep)
+
+	addHandler("/metrics", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.MetricsHandler(w, r)
+	}))
+
+	addHandler("/status/ws", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.StatusStreamHandler(w, r)
+	}))
+
+	addHandler("/api/v1/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.APIHandler(w, r)
+	}))
+
 	addHandler("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(staticFilesSub))))
 
 	generic := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/status" {
 			contentType := r.Header.Get("Content-Type")
 			if contentType == "application/x-protobuf" {
+				if _, authorized := s.AuthorizeAdmin(w, r); !authorized {
+					return
+				}
+
 				status := s.GetStatus()
 
 				log.Println("SFU STATUS", status)
@@ -229,19 +367,41 @@ func main() {
 					w.Write(data)
 					return
 				case http.MethodPost:
+					// The servers page passes on the token from its url
+					actor, authorized := s.AuthorizeAdmin(w, r)
+					if !authorized {
+						return
+					}
+
 					body, err := io.ReadAll(r.Body)
 					if err != nil {
-						http.Error(w, "Failed to read payload", http.StatusInternalServerError)
+						http.Error(w, "Failed to read payload", http.StatusBadRequest)
 						return
 					}
 
 					var update sfu.CurrentServers
 					err = proto.Unmarshal(body, &update)
 					if err != nil {
-						http.Error(w, "Failed to deserialize payload", http.StatusInternalServerError)
+						http.Error(w, "Failed to deserialize payload", http.StatusBadRequest)
 						return
 					}
 
+					for _, t := range update.Servers {
+						if err := sfu.ValidateServerURL(t); err != nil {
+							http.Error(w, err.Error(), http.StatusBadRequest)
+							return
+						}
+					}
+
+					for _, e := range update.Entries {
+						if err := sfu.ValidateServerURL(e.Url); err != nil {
+							http.Error(w, err.Error(), http.StatusBadRequest)
+							return
+						}
+					}
+
+					sfu.Audit(actor, "POST /servers", "set to "+update.String())
+
 					data, err := proto.Marshal(s.SetCurrentServers(&update))
 					if err != nil {
 						http.Error(w, "Failed to serialize Protobuf", http.StatusInternalServerError)
@@ -257,8 +417,80 @@ func main() {
 			}
 		}
 
+		if r.URL.Path == "/recordings" {
+			contentType := r.Header.Get("Content-Type")
+			if contentType == "application/x-protobuf" {
+				var recordings *sfu.Recordings
+
+				switch r.Method {
+				case http.MethodGet:
+					recordings = s.GetRecordings()
+				case http.MethodPost, http.MethodDelete:
+					// Recordings fill the disk, so starting and stopping them is for admins
+					actor, authorized := s.AuthorizeAdmin(w, r)
+					if !authorized {
+						return
+					}
+
+					body, err := io.ReadAll(r.Body)
+					if err != nil {
+						http.Error(w, "Failed to read payload", http.StatusBadRequest)
+						return
+					}
+
+					var request sfu.RecordingRequest
+					err = proto.Unmarshal(body, &request)
+					if err != nil {
+						http.Error(w, "Failed to deserialize payload", http.StatusBadRequest)
+						return
+					}
+
+					if r.Method == http.MethodPost {
+						recordings, err = s.StartRecording(&request)
+					} else {
+						recordings, err = s.StopRecording(&request)
+					}
+
+					action := r.Method + " /recordings " + request.String()
+					if err != nil {
+						sfu.Audit(actor, action, "failed, "+err.Error())
+						http.Error(w, err.Error(), recordingErrorStatus(err))
+						return
+					}
+
+					sfu.Audit(actor, action, "done")
+				default:
+					http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+					return
+				}
+
+				data, err := proto.Marshal(recordings)
+				if err != nil {
+					http.Error(w, "Failed to serialize Protobuf", http.StatusInternalServerError)
+					return
+				}
+
+				w.Header().Set("Content-Type", contentType)
+				w.WriteHeader(http.StatusOK)
+
+				w.Write(data)
+				return
+			}
+		}
+
+		iceServers := make([]injectedICEServer, 0)
+		for _, server := range s.PageICEServers(r) {
+			credential, _ := server.Credential.(string)
+			iceServers = append(iceServers, injectedICEServer{
+				URLs:       server.URLs,
+				Username:   server.Username,
+				Credential: credential,
+			})
+		}
+
 		injectedBytes, err := json.Marshal(&umbrellaInjectedParameters{
 			HttpPrefix: httpPrefix,
+			IceServers: iceServers,
 		})
 
 		if err != nil {
@@ -281,6 +513,7 @@ func main() {
 	addHandler("/sfu", generic)
 	addHandler("/servers", generic)
 	addHandler("/status", generic)
+	addHandler("/recordings", generic)
 
 	wrapped := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
@@ -360,6 +593,48 @@ func main() {
 		}
 	}()
 
+	// Servers from the config sit alongside any added on the servers page, so only the difference is applied
+	// This also starts any restored from the state file
+	s.UpdateServers(cfg.Servers, nil)
+
+	go watchConfig(configPath, cfg, func(prev *config, next *config) {
+		logger.SetLevel(next.logLevel())
+		debug.SetMemoryLimit(next.memoryLimit())
+
+		iceServers := next.iceServers()
+		if iceServers == nil {
+			iceServers = sfu.DefaultICEServers()
+		}
+		s.SetICEServers(iceServers)
+
+		s.SetDataLimits(next.dataLimits())
+		s.SetLastNPolicy(next.lastNPolicy())
+
+		s.UpdateServers(serversDiff(prev.Servers, next.Servers))
+
+		if next.needsRestartComparedTo(prev) {
+			log.Println("WARNING: config changes to anything other than servers, ICE servers, log level, memory limit, data channel limits and last n need a restart")
+		}
+	})
+
 	razor.WaitForOsInterruptSignal()
 
+	s.StopAllRecordings()
+}
+
+func recordingErrorStatus(err error) int {
+	var pathErr *fs.PathError
+
+	switch {
+	case errors.Is(err, sfu.ErrRecordingDisabled):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, sfu.ErrTrackNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, sfu.ErrUnsupportedCodec):
+		return http.StatusUnprocessableEntity
+	case errors.As(err, &pathErr):
+		return http.StatusInternalServerError
+	}
+
+	return http.StatusBadRequest
 }
@@ -1,7 +1,10 @@
 package razor
 
 import (
+	"fmt"
 	"log"
+	"strings"
+	"sync/atomic"
 )
 
 type LoggingLevel int
@@ -37,17 +40,49 @@ func (l LoggingLevel) String() string {
 	return "UNK"
 }
 
+// Takes the names people would write in config, such as "warn" or "verbose"
+func ParseLoggingLevel(name string) (LoggingLevel, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "off", "none":
+		return LoggingLevelOff, nil
+	case "error", "err":
+		return LogLevelError, nil
+	case "warn", "warning", "wrn":
+		return LogLevelWarn, nil
+	case "info", "ifo":
+		return LogLevelInfo, nil
+	case "verbose", "vrb":
+		return LogLevelVerbose, nil
+	case "debug", "dbg":
+		return LogLevelDebug, nil
+	case "trace", "trc":
+		return LogLevelTrace, nil
+	}
+
+	return LoggingLevelOff, fmt.Errorf("unknown logging level %q", name)
+}
+
 type Logger struct {
-	level                LoggingLevel
+	level                atomic.Int32 // Can change while logging from any goroutine
 	panicOnAssertFailure bool
 }
 
 func NewLogger(level LoggingLevel, panicOnAssertFailure bool) *Logger {
-	return &Logger{}
+	l := &Logger{panicOnAssertFailure: panicOnAssertFailure}
+	l.level.Store(int32(level))
+	return l
+}
+
+func (l *Logger) SetLevel(level LoggingLevel) {
+	l.level.Store(int32(level))
+}
+
+func (l *Logger) Level() LoggingLevel {
+	return LoggingLevel(l.level.Load())
 }
 
 func (l *Logger) log(level LoggingLevel, component string, msg string) {
-	if level <= l.level {
+	if level <= l.Level() {
 		log.Println(level, component, "--", msg)
 	}
 }
@@ -32,6 +32,9 @@ func NewMessageHandler[MessageQueueWhat comparable, PayloadType any](logger *Log
 }
 
 func (mh *MessageHandler[MessageQueueWhat, PayloadType]) Size() uint16 {
+	mh.lock.Enter()
+	defer mh.lock.Leave()
+
 	return mh.queue.CurrentSize()
 }
 
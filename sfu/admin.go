@@ -0,0 +1,246 @@
+package sfu
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+var ErrClientNotFound = errors.New("client not found")
+
+// Operators acting on participants. Everything goes through the SFU handler, which decides what is forwarded to
+// whom, and then on to the clients as the usual adding and removing of outgoing tracks or stopping them outright
+
+type adminResult struct {
+	state *AdminState
+	err   error
+}
+
+// Disconnects the client, which for a trunk or RTSP server we connect out to means it will be retried
+func (s *Sfu) KickClient(clientId string) error {
+	_, err := s.sendAdminCommand(sfuKickClient, &sfuCommandMessage{clientId: clientId})
+	return err
+}
+
+// Stops forwarding the track to everyone, or starts again
+func (s *Sfu) SetTrackMuted(umbrellaId string, muted bool) (*AdminState, error) {
+	return s.sendAdminCommand(sfuSetTrackMuted, &sfuCommandMessage{umbrellaId: umbrellaId, enabled: muted})
+}
+
+// Stops forwarding the track to the client, or every track when umbrellaId is empty, or starts again
+func (s *Sfu) SetForwardingBlocked(clientId string, umbrellaId string, blocked bool) (*AdminState, error) {
+	return s.sendAdminCommand(sfuSetForwardingBlocked, &sfuCommandMessage{clientId: clientId, umbrellaId: umbrellaId, enabled: blocked})
+}
+
+func (s *Sfu) GetAdminState() *AdminState {
+	state, _ := s.sendAdminCommand(sfuGetAdminState, &sfuCommandMessage{})
+	return state
+}
+
+func (s *Sfu) sendAdminCommand(command sfuCommand, msg *sfuCommandMessage) (*AdminState, error) {
+	msg.result = &sfuCommandResult{admin: make(chan adminResult, 1)}
+
+	s.handler.Send(command, msg)
+
+	result := <-msg.result.admin
+	return result.state, result.err
+}
+
+// Whether a track should go to a client at all, before anything the client itself wants
+func (s *Sfu) shouldForward(intrack *incomingTrack, c RemoteClient) bool {
+	if s.mutedTracks[intrack.UmbrellaID()] {
+		return false
+	}
+
+	blocks := s.forwardingBlocks[c.ID()]
+	return !blocks[""] && !blocks[intrack.UmbrellaID()]
+}
+
+func (s *Sfu) findClient(clientId string) RemoteClient {
+	for _, r := range s.rooms {
+		for _, c := range r.clients {
+			if c.ID() == clientId {
+				return c
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *Sfu) adminState() *AdminState {
+	state := &AdminState{
+		MutedTracks:      make([]string, 0, len(s.mutedTracks)),
+		ForwardingBlocks: make([]*ForwardingBlock, 0),
+	}
+
+	for umbrellaId := range s.mutedTracks {
+		state.MutedTracks = append(state.MutedTracks, umbrellaId)
+	}
+	slices.Sort(state.MutedTracks)
+
+	for clientId, blocks := range s.forwardingBlocks {
+		for umbrellaId := range blocks {
+			state.ForwardingBlocks = append(state.ForwardingBlocks, &ForwardingBlock{ClientId: clientId, UmbrellaId: umbrellaId})
+		}
+	}
+	slices.SortFunc(state.ForwardingBlocks, func(a, b *ForwardingBlock) int {
+		if c := strings.Compare(a.ClientId, b.ClientId); c != 0 {
+			return c
+		}
+		return strings.Compare(a.UmbrellaId, b.UmbrellaId)
+	})
+
+	return state
+}
+
+func (s *Sfu) kickClient(clientId string) error {
+	c := s.findClient(clientId)
+	if c == nil {
+		return ErrClientNotFound
+	}
+
+	// WHIP and WHEP clients have no websocket closing to take them out of the room
+	if session, isSession := c.(httpSession); isSession {
+		s.endSession(session)
+	} else {
+		c.stop()
+	}
+
+	return nil
+}
+
+// Returns the room the track is in, so the caller knows who to signal
+func (s *Sfu) setTrackMuted(umbrellaId string, muted bool) (*room, error) {
+	var r *room
+	var intrack *incomingTrack
+	for _, candidate := range s.rooms {
+		if t, exists := candidate.localTracks[umbrellaId]; exists {
+			r, intrack = candidate, t
+			break
+		}
+	}
+
+	// Unmuting a track which has gone is fine, it's just forgotten
+	if intrack == nil {
+		if muted {
+			return nil, ErrTrackNotFound
+		}
+
+		delete(s.mutedTracks, umbrellaId)
+		return nil, nil
+	}
+
+	if s.mutedTracks[umbrellaId] == muted {
+		return r, nil
+	}
+
+	if muted {
+		s.mutedTracks[umbrellaId] = true
+
+		for _, c := range r.clients {
+			c.RemoveOutgoingTracksForIncomingTrack(intrack)
+		}
+	} else {
+		delete(s.mutedTracks, umbrellaId)
+
+		for _, c := range r.clients {
+			if s.shouldForward(intrack, c) {
+				c.AddOutgoingTracksForIncomingTrack(intrack)
+			}
+		}
+	}
+
+	return r, nil
+}
+
+func (s *Sfu) setForwardingBlocked(clientId string, umbrellaId string, blocked bool) (*room, error) {
+	c := s.findClient(clientId)
+	if c == nil {
+		// Unblocking someone who has left is fine, it's just forgotten
+		if !blocked {
+			delete(s.forwardingBlocks[clientId], umbrellaId)
+			if len(s.forwardingBlocks[clientId]) == 0 {
+				delete(s.forwardingBlocks, clientId)
+			}
+			return nil, nil
+		}
+
+		return nil, ErrClientNotFound
+	}
+
+	r := s.rooms[c.Room()]
+
+	if s.forwardingBlocks[clientId][umbrellaId] == blocked {
+		return r, nil
+	}
+
+	// Who could get what before the change, so only the tracks it actually affects are touched
+	wasForwarded := make(map[string]bool)
+	for id, intrack := range r.localTracks {
+		wasForwarded[id] = s.shouldForward(intrack, c)
+	}
+
+	if blocked {
+		if s.forwardingBlocks[clientId] == nil {
+			s.forwardingBlocks[clientId] = make(map[string]bool)
+		}
+		s.forwardingBlocks[clientId][umbrellaId] = true
+	} else {
+		delete(s.forwardingBlocks[clientId], umbrellaId)
+		if len(s.forwardingBlocks[clientId]) == 0 {
+			delete(s.forwardingBlocks, clientId)
+		}
+	}
+
+	for id, intrack := range r.localTracks {
+		forwarded := s.shouldForward(intrack, c)
+
+		switch {
+		case wasForwarded[id] && !forwarded:
+			c.RemoveOutgoingTracksForIncomingTrack(intrack)
+		case !wasForwarded[id] && forwarded:
+			c.AddOutgoingTracksForIncomingTrack(intrack)
+		}
+	}
+
+	return r, nil
+}
+
+// With auth on only tokens with the admin claim get in, without it the API is as open as the pages are
+func (s *Sfu) AuthorizeAdmin(w http.ResponseWriter, r *http.Request) (string, bool) {
+	return s.authorizeAdminToken(w, r, bearerToken(r))
+}
+
+func (s *Sfu) authorizeAdminToken(w http.ResponseWriter, r *http.Request, token string) (string, bool) {
+	if !s.auth.TokensRequired() {
+		return "anonymous@" + r.RemoteAddr, true
+	}
+
+	if token == "" {
+		writeAPIError(w, http.StatusUnauthorized, "admin token required")
+		return "", false
+	}
+
+	claims, err := s.auth.Verify(token)
+	if err != nil {
+		s.logger.Warn("sfu", "Rejecting admin request from "+r.RemoteAddr+": "+err.Error())
+		writeAPIError(w, http.StatusUnauthorized, "invalid token")
+		return "", false
+	}
+
+	if !claims.Admin {
+		Audit(claims.Identity+"@"+r.RemoteAddr, r.Method+" "+r.URL.Path, "refused, token is not for an admin")
+		writeAPIError(w, http.StatusForbidden, "token is not for an admin")
+		return "", false
+	}
+
+	return claims.Identity + "@" + r.RemoteAddr, true
+}
+
+// Always written, whatever the log level, so there's a record of who did what
+func Audit(actor string, action string, result string) {
+	log.Println("AUDIT", actor, action+":", result)
+}
@@ -0,0 +1,218 @@
+package sfu
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Remembers which tracks the SFU started and stopped forwarding to it
+type trackRecipient struct {
+	dataRecipient
+	changes []string
+}
+
+func (c *trackRecipient) AddOutgoingTracksForIncomingTrack(intrack *incomingTrack) {
+	c.changes = append(c.changes, "+"+intrack.UmbrellaID())
+}
+
+func (c *trackRecipient) RemoveOutgoingTracksForIncomingTrack(intrack *incomingTrack) {
+	c.changes = append(c.changes, "-"+intrack.UmbrellaID())
+}
+
+// Whatever changed since last asked
+func (c *trackRecipient) takeChanges() []string {
+	changes := c.changes
+	c.changes = nil
+	return changes
+}
+
+func newTestAdminRoom() (*Sfu, *trackRecipient, *trackRecipient) {
+	s := newTestDataSfu()
+	s.mutedTracks = make(map[string]bool)
+
+	r := s.getOrCreateRoom("kitchen")
+	for _, umbrellaId := range []string{"cam", "mic"} {
+		r.localTracks[umbrellaId] = newIncomingTrack(&TrackDescriptor{UmbrellaId: umbrellaId}, "kitchen")
+	}
+
+	alice := &trackRecipient{dataRecipient: dataRecipient{BaseClient: BaseClient{id: "alice", room: "kitchen"}}}
+	bob := &trackRecipient{dataRecipient: dataRecipient{BaseClient: BaseClient{id: "bob", room: "kitchen"}}}
+	r.clients = append(r.clients, alice, bob)
+
+	return s, alice, bob
+}
+
+func TestSetTrackMuted(t *testing.T) {
+	s, alice, bob := newTestAdminRoom()
+
+	if _, err := s.setTrackMuted("cam", true); err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(alice.takeChanges(), []string{"-cam"}) || !slices.Equal(bob.takeChanges(), []string{"-cam"}) {
+		t.Error("muting didn't stop the track going to everyone")
+	}
+
+	if state := s.adminState(); !slices.Equal(state.MutedTracks, []string{"cam"}) {
+		t.Errorf("got muted tracks %v", state.MutedTracks)
+	}
+
+	// Already muted, so nothing to do
+	s.setTrackMuted("cam", true)
+	if len(alice.takeChanges()) != 0 {
+		t.Error("muting twice changed what was forwarded")
+	}
+
+	// Unmuting doesn't get round a block
+	s.setForwardingBlocked("bob", "", true)
+	bob.takeChanges()
+
+	s.setTrackMuted("cam", false)
+	if !slices.Equal(alice.takeChanges(), []string{"+cam"}) || len(bob.takeChanges()) != 0 {
+		t.Error("unmuting didn't forward the track to only those it isn't blocked to")
+	}
+
+	if _, err := s.setTrackMuted("gone", true); !errors.Is(err, ErrTrackNotFound) {
+		t.Errorf("muting a missing track got %v", err)
+	}
+
+	if _, err := s.setTrackMuted("gone", false); err != nil {
+		t.Errorf("unmuting a missing track got %v", err)
+	}
+}
+
+func TestSetForwardingBlocked(t *testing.T) {
+	s, alice, bob := newTestAdminRoom()
+
+	steps := []struct {
+		name        string
+		umbrellaId  string
+		blocked     bool
+		wantChanges []string
+		wantBlocks  int
+	}{
+		{name: "one track", umbrellaId: "cam", blocked: true, wantChanges: []string{"-cam"}, wantBlocks: 1},
+		{name: "everything else", blocked: true, wantChanges: []string{"-mic"}, wantBlocks: 2},
+		{name: "everything again", blocked: true, wantBlocks: 2},
+		{name: "unblocking everything leaves the track", blocked: false, wantChanges: []string{"+mic"}, wantBlocks: 1},
+		{name: "unblocking the track", umbrellaId: "cam", blocked: false, wantChanges: []string{"+cam"}, wantBlocks: 0},
+	}
+
+	for _, step := range steps {
+		if _, err := s.setForwardingBlocked("bob", step.umbrellaId, step.blocked); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+
+		if changes := bob.takeChanges(); !slices.Equal(changes, step.wantChanges) {
+			t.Errorf("%s changed %v, want %v", step.name, changes, step.wantChanges)
+		}
+
+		if blocks := s.adminState().ForwardingBlocks; len(blocks) != step.wantBlocks {
+			t.Errorf("%s left blocks %v", step.name, blocks)
+		}
+	}
+
+	if len(alice.takeChanges()) != 0 {
+		t.Error("blocking bob changed what alice gets")
+	}
+
+	if _, err := s.setForwardingBlocked("nobody", "", true); !errors.Is(err, ErrClientNotFound) {
+		t.Errorf("blocking a missing client got %v", err)
+	}
+
+	if _, err := s.setForwardingBlocked("nobody", "", false); err != nil {
+		t.Errorf("unblocking a missing client got %v", err)
+	}
+}
+
+func adminRequest(method string, path string, body string, token string) *http.Request {
+	return sessionRequest(method, path, "application/json", body, token)
+}
+
+func TestAdminAPIRefusals(t *testing.T) {
+	s, _, user := newTestAdminAuth(t)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		token      string
+		wantStatus int
+	}{
+		{name: "state without a token", method: http.MethodGet, path: "/api/v1/admin", wantStatus: http.StatusUnauthorized},
+		{name: "kick without a token", method: http.MethodPost, path: "/api/v1/admin/kick", wantStatus: http.StatusUnauthorized},
+		{name: "mute not an admin", method: http.MethodPost, path: "/api/v1/admin/mute", token: user, wantStatus: http.StatusForbidden},
+		{name: "block not an admin", method: http.MethodPost, path: "/api/v1/admin/block", token: user, wantStatus: http.StatusForbidden},
+		{name: "kick with get", method: http.MethodGet, path: "/api/v1/admin/kick", wantStatus: http.StatusMethodNotAllowed},
+		{name: "state with post", method: http.MethodPost, path: "/api/v1/admin", wantStatus: http.StatusMethodNotAllowed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.APIHandler(w, adminRequest(test.method, test.path, `{"clientId": "alice"}`, test.token))
+
+			if w.Code != test.wantStatus {
+				t.Errorf("got status %d, want %d", w.Code, test.wantStatus)
+			}
+		})
+	}
+}
+
+func TestAdminAPIKick(t *testing.T) {
+	s := newTestSfu(t)
+	_, offer := newTestOffer(t, publishingOffer)
+
+	w := httptest.NewRecorder()
+	s.WhipHandler(w, sessionRequest(http.MethodPost, "/whip?room=kitchen", "application/sdp", offer, ""))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got status %d, %s", w.Code, w.Body.String())
+	}
+
+	location := w.Header().Get("Location")
+
+	status := s.GetStatus()
+	if len(status.Rooms) != 1 || len(status.Rooms[0].Clients) != 1 {
+		t.Fatalf("got status %v", status)
+	}
+
+	clientId := status.Rooms[0].Clients[0].Id
+
+	steps := []struct {
+		name       string
+		path       string
+		body       string
+		wantStatus int
+	}{
+		{name: "kick nobody", path: "/api/v1/admin/kick", body: `{"clientId": "nobody"}`, wantStatus: http.StatusNotFound},
+		{name: "mute a missing track", path: "/api/v1/admin/mute", body: `{"umbrellaId": "gone"}`, wantStatus: http.StatusNotFound},
+		{name: "bad body", path: "/api/v1/admin/block", body: `{"clientId": 7}`, wantStatus: http.StatusBadRequest},
+		{name: "block", path: "/api/v1/admin/block", body: `{"clientId": "` + clientId + `"}`, wantStatus: http.StatusOK},
+		{name: "kick", path: "/api/v1/admin/kick", body: `{"clientId": "` + clientId + `"}`, wantStatus: http.StatusOK},
+		{name: "kick again", path: "/api/v1/admin/kick", body: `{"clientId": "` + clientId + `"}`, wantStatus: http.StatusNotFound},
+	}
+
+	for _, step := range steps {
+		w := httptest.NewRecorder()
+		s.APIHandler(w, adminRequest(http.MethodPost, step.path, step.body, ""))
+
+		if w.Code != step.wantStatus {
+			t.Errorf("%s got status %d, want %d: %s", step.name, w.Code, step.wantStatus, w.Body.String())
+		}
+
+		if step.name == "block" && !strings.Contains(w.Body.String(), clientId) {
+			t.Errorf("block answered %s, want the block in the state", w.Body.String())
+		}
+	}
+
+	// Kicking a WHIP client ends its session too
+	w = httptest.NewRecorder()
+	s.WhipHandler(w, sessionRequest(http.MethodDelete, location, "", "", ""))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("session still there after kicking, got status %d", w.Code)
+	}
+}
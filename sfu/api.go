@@ -0,0 +1,297 @@
+package sfu
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// A JSON version of what the pages get as protobuf, for curl and scripts
+//
+//	GET    /api/v1/servers
+//
+// and for admins, see AuthorizeAdmin
+//
+//	GET    /api/v1/status
+//	GET    /api/v1/clients
+//	GET    /api/v1/tracks
+//	POST   /api/v1/servers            AddServerRequest
+//	DELETE /api/v1/servers?url=URL
+//	GET    /api/v1/admin
+//	POST   /api/v1/admin/kick         KickRequest
+//	POST   /api/v1/admin/mute         MuteRequest
+//	POST   /api/v1/admin/block        BlockRequest
+
+const apiPrefix = "/api/v1"
+
+// Plenty for anything the API takes
+const maxAPIBodySize = 64 * 1024
+
+var apiMarshal = protojson.MarshalOptions{EmitUnpopulated: true}
+var apiUnmarshal = protojson.UnmarshalOptions{}
+
+func (s *Sfu) APIHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/")
+
+	switch path {
+	case "status":
+		if !apiMethodAllowed(w, r, http.MethodGet) {
+			return
+		}
+
+		// Who is connected and what they publish isn't for everyone, so with tokens on these are for admins
+		if _, authorized := s.AuthorizeAdmin(w, r); !authorized {
+			return
+		}
+
+		writeAPIResponse(w, http.StatusOK, s.GetStatus())
+	case "servers":
+		switch r.Method {
+		case http.MethodGet:
+			writeAPIResponse(w, http.StatusOK, s.GetCurrentServers())
+		case http.MethodPost:
+			s.apiAddServer(w, r)
+		case http.MethodDelete:
+			s.apiRemoveServer(w, r)
+		default:
+			apiMethodAllowed(w, r, http.MethodGet, http.MethodPost, http.MethodDelete)
+		}
+	case "clients":
+		if !apiMethodAllowed(w, r, http.MethodGet) {
+			return
+		}
+
+		if _, authorized := s.AuthorizeAdmin(w, r); !authorized {
+			return
+		}
+
+		clients := &ClientList{Clients: make([]*RoomClient, 0)}
+		for _, room := range s.GetStatus().Rooms {
+			for _, c := range room.Clients {
+				clients.Clients = append(clients.Clients, &RoomClient{Room: room.Id, Client: c})
+			}
+		}
+
+		writeAPIResponse(w, http.StatusOK, clients)
+	case "tracks":
+		if !apiMethodAllowed(w, r, http.MethodGet) {
+			return
+		}
+
+		if _, authorized := s.AuthorizeAdmin(w, r); !authorized {
+			return
+		}
+
+		tracks := &TrackList{Tracks: make([]*RoomTrack, 0)}
+		for _, room := range s.GetStatus().Rooms {
+			for _, t := range room.RelayingTracks {
+				tracks.Tracks = append(tracks.Tracks, &RoomTrack{Room: room.Id, Track: t})
+			}
+		}
+
+		writeAPIResponse(w, http.StatusOK, tracks)
+	case "admin", "admin/kick", "admin/mute", "admin/block":
+		s.apiAdmin(w, r, path)
+	default:
+		writeAPIError(w, http.StatusNotFound, "no such endpoint")
+	}
+}
+
+// Servers make this node dial wherever they say, and are kept across restarts, so changing them is for admins
+func (s *Sfu) apiAddServer(w http.ResponseWriter, r *http.Request) {
+	actor, authorized := s.AuthorizeAdmin(w, r)
+	if !authorized {
+		return
+	}
+
+	var request AddServerRequest
+	if !readAPIRequest(w, r, &request) {
+		return
+	}
+
+	if err := ValidateServerURL(request.Url); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	action := "add server " + request.Url
+
+	servers, err := s.AddServer(&ServerEntry{Url: request.Url, Name: request.Name, Enabled: !request.Disabled})
+	if errors.Is(err, ErrServerExists) {
+		Audit(actor, action, "failed, "+err.Error())
+		writeAPIError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	Audit(actor, action, "done")
+	writeAPIResponse(w, http.StatusCreated, servers)
+}
+
+func (s *Sfu) apiRemoveServer(w http.ResponseWriter, r *http.Request) {
+	actor, authorized := s.AuthorizeAdmin(w, r)
+	if !authorized {
+		return
+	}
+
+	serverUrl := r.URL.Query().Get("url")
+	if serverUrl == "" {
+		writeAPIError(w, http.StatusBadRequest, "url query parameter is required")
+		return
+	}
+
+	action := "remove server " + serverUrl
+
+	servers, err := s.RemoveServer(serverUrl)
+	if err != nil {
+		Audit(actor, action, "failed, "+err.Error())
+
+		status := http.StatusConflict
+		if errors.Is(err, ErrServerNotFound) {
+			status = http.StatusNotFound
+		}
+
+		writeAPIError(w, status, err.Error())
+		return
+	}
+
+	Audit(actor, action, "done")
+	writeAPIResponse(w, http.StatusOK, servers)
+}
+
+func (s *Sfu) apiAdmin(w http.ResponseWriter, r *http.Request, path string) {
+	method := http.MethodPost
+	if path == "admin" {
+		method = http.MethodGet
+	}
+
+	if !apiMethodAllowed(w, r, method) {
+		return
+	}
+
+	actor, authorized := s.AuthorizeAdmin(w, r)
+	if !authorized {
+		return
+	}
+
+	var action string
+	var state *AdminState
+	var err error
+
+	switch path {
+	case "admin":
+		writeAPIResponse(w, http.StatusOK, s.GetAdminState())
+		return
+	case "admin/kick":
+		var request KickRequest
+		if !readAPIRequest(w, r, &request) {
+			return
+		}
+
+		action = "kick client " + request.ClientId
+		if err = s.KickClient(request.ClientId); err == nil {
+			state = s.GetAdminState()
+		}
+	case "admin/mute":
+		var request MuteRequest
+		if !readAPIRequest(w, r, &request) {
+			return
+		}
+
+		action = "mute track " + request.UmbrellaId
+		if request.Unmute {
+			action = "unmute track " + request.UmbrellaId
+		}
+
+		state, err = s.SetTrackMuted(request.UmbrellaId, !request.Unmute)
+	case "admin/block":
+		var request BlockRequest
+		if !readAPIRequest(w, r, &request) {
+			return
+		}
+
+		what := "all tracks"
+		if request.UmbrellaId != "" {
+			what = "track " + request.UmbrellaId
+		}
+
+		action = "block " + what + " to client " + request.ClientId
+		if request.Unblock {
+			action = "unblock " + what + " to client " + request.ClientId
+		}
+
+		state, err = s.SetForwardingBlocked(request.ClientId, request.UmbrellaId, !request.Unblock)
+	}
+
+	if err != nil {
+		Audit(actor, action, "failed, "+err.Error())
+
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrClientNotFound) || errors.Is(err, ErrTrackNotFound) {
+			status = http.StatusNotFound
+		}
+
+		writeAPIError(w, status, err.Error())
+		return
+	}
+
+	Audit(actor, action, "done")
+	writeAPIResponse(w, http.StatusOK, state)
+}
+
+func apiMethodAllowed(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+	return false
+}
+
+// Writes a 400 and returns false if the body isn't the message as JSON
+func readAPIRequest(w http.ResponseWriter, r *http.Request, message proto.Message) bool {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxAPIBodySize+1))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "failed to read body")
+		return false
+	}
+
+	if len(body) > maxAPIBodySize {
+		writeAPIError(w, http.StatusRequestEntityTooLarge, "body too large")
+		return false
+	}
+
+	if err := apiUnmarshal.Unmarshal(body, message); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
+		return false
+	}
+
+	return true
+}
+
+func writeAPIResponse(w http.ResponseWriter, status int, message proto.Message) {
+	data, err := apiMarshal.Marshal(message)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "failed to serialize response")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	data, _ := json.Marshal(map[string]string{"error": message})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
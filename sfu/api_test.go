@@ -0,0 +1,136 @@
+package sfu
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPIReadsNeedAdmin(t *testing.T) {
+	s, _, user := newTestAdminAuth(t)
+
+	tests := []struct {
+		name       string
+		path       string
+		token      string
+		wantStatus int
+	}{
+		{name: "status without a token", path: "/api/v1/status", wantStatus: http.StatusUnauthorized},
+		{name: "status not an admin", path: "/api/v1/status", token: user, wantStatus: http.StatusForbidden},
+		{name: "clients without a token", path: "/api/v1/clients", wantStatus: http.StatusUnauthorized},
+		{name: "clients not an admin", path: "/api/v1/clients", token: user, wantStatus: http.StatusForbidden},
+		{name: "tracks without a token", path: "/api/v1/tracks", wantStatus: http.StatusUnauthorized},
+		{name: "tracks bad token", path: "/api/v1/tracks", token: "guess", wantStatus: http.StatusUnauthorized},
+		{name: "unknown endpoint", path: "/api/v1/nothing", wantStatus: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, test.path, nil)
+			if test.token != "" {
+				r.Header.Set("Authorization", "Bearer "+test.token)
+			}
+
+			w := httptest.NewRecorder()
+			s.APIHandler(w, r)
+
+			if w.Code != test.wantStatus {
+				t.Fatalf("got status %d, want %d", w.Code, test.wantStatus)
+			}
+
+			var body struct {
+				Error string `json:"error"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Error == "" {
+				t.Errorf("got body %q, want a JSON error", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestAPIServers(t *testing.T) {
+	s := newTestStateSfu(t, "")
+
+	const url = "wss://a.example/ws"
+
+	steps := []struct {
+		name       string
+		method     string
+		target     string
+		body       string
+		wantStatus int
+	}{
+		{name: "add", method: http.MethodPost, target: "/api/v1/servers", body: `{"url": "` + url + `", "name": "Upstairs"}`, wantStatus: http.StatusCreated},
+		{name: "add again", method: http.MethodPost, target: "/api/v1/servers", body: `{"url": "` + url + `"}`, wantStatus: http.StatusConflict},
+		{name: "add not a server", method: http.MethodPost, target: "/api/v1/servers", body: `{"url": "https://a.example"}`, wantStatus: http.StatusBadRequest},
+		{name: "add unknown field", method: http.MethodPost, target: "/api/v1/servers", body: `{"address": "` + url + `"}`, wantStatus: http.StatusBadRequest},
+		{name: "add too much", method: http.MethodPost, target: "/api/v1/servers", body: `{"name": "` + strings.Repeat("a", maxAPIBodySize) + `"}`, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "list", method: http.MethodGet, target: "/api/v1/servers", wantStatus: http.StatusOK},
+		{name: "put", method: http.MethodPut, target: "/api/v1/servers", wantStatus: http.StatusMethodNotAllowed},
+		{name: "remove without a url", method: http.MethodDelete, target: "/api/v1/servers", wantStatus: http.StatusBadRequest},
+		{name: "remove", method: http.MethodDelete, target: "/api/v1/servers?url=" + url, wantStatus: http.StatusOK},
+		{name: "remove again", method: http.MethodDelete, target: "/api/v1/servers?url=" + url, wantStatus: http.StatusNotFound},
+	}
+
+	for _, step := range steps {
+		w := httptest.NewRecorder()
+		s.APIHandler(w, adminRequest(step.method, step.target, step.body, ""))
+
+		if w.Code != step.wantStatus {
+			t.Fatalf("%s got status %d, want %d: %s", step.name, w.Code, step.wantStatus, w.Body.String())
+		}
+
+		if w.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s answered with %q", step.name, w.Header().Get("Content-Type"))
+		}
+
+		if step.name == "list" {
+			var servers struct {
+				Entries []struct {
+					Url     string `json:"url"`
+					Name    string `json:"name"`
+					Enabled bool   `json:"enabled"`
+				} `json:"entries"`
+			}
+
+			if err := json.Unmarshal(w.Body.Bytes(), &servers); err != nil || len(servers.Entries) != 1 ||
+				servers.Entries[0].Url != url || servers.Entries[0].Name != "Upstairs" || !servers.Entries[0].Enabled {
+				t.Errorf("listed %s", w.Body.String())
+			}
+		}
+	}
+}
+
+func TestAPIClients(t *testing.T) {
+	s := newTestSfu(t)
+	_, offer := newTestOffer(t, publishingOffer)
+
+	w := httptest.NewRecorder()
+	s.WhipHandler(w, sessionRequest(http.MethodPost, "/whip?room=kitchen", "application/sdp", offer, ""))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got status %d, %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	s.APIHandler(w, adminRequest(http.MethodGet, "/api/v1/clients", "", ""))
+
+	var list struct {
+		Clients []struct {
+			Room   string `json:"room"`
+			Client struct {
+				Id    string `json:"id"`
+				Label string `json:"label"`
+			} `json:"client"`
+		} `json:"clients"`
+	}
+
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Clients) != 1 {
+		t.Fatalf("got %s", w.Body.String())
+	}
+
+	if c := list.Clients[0]; c.Room != "kitchen" || c.Client.Id == "" || !strings.HasPrefix(c.Client.Label, "WHIP") {
+		t.Errorf("got client %+v", c)
+	}
+}
@@ -0,0 +1,240 @@
+package sfu
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Access tokens are HS256 JWTs signed with one of a set of shared keys
+// The kid in the header picks the key, so keys can be rotated by adding the new one before removing the old
+type AccessClaims struct {
+	Identity     string `json:"sub"`
+	Room         string `json:"room,omitempty"` // Empty means the token is good for any room
+	CanPublish   bool   `json:"publish"`
+	CanSubscribe bool   `json:"subscribe"`
+	Admin        bool   `json:"admin,omitempty"` // Can use the admin parts of the API
+	Trunk        bool   `json:"trunk,omitempty"` // Another umbrella node trunking in, rather than a browser
+
+	ExpiresAt int64 `json:"exp,omitempty"`
+	NotBefore int64 `json:"nbf,omitempty"`
+	IssuedAt  int64 `json:"iat,omitempty"`
+}
+
+type tokenHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ,omitempty"`
+	KeyID     string `json:"kid,omitempty"`
+}
+
+// Allow for clocks on APs being a bit off
+const tokenClockLeeway = 30 * time.Second
+
+type Authenticator struct {
+	keys map[string][]byte // kid -> secret
+
+	// Shared secrets other umbrella nodes present as bearer tokens to trunk in
+	trunkSecrets [][]byte
+}
+
+func NewAuthenticator(keys map[string][]byte, trunkSecrets [][]byte) *Authenticator {
+	return &Authenticator{keys: keys, trunkSecrets: trunkSecrets}
+}
+
+// Parses the "kid:secret,kid2:secret2" format used in the env var
+func ParseAuthKeys(spec string) (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		kid, secret, found := strings.Cut(entry, ":")
+		if !found || kid == "" || secret == "" {
+			return nil, fmt.Errorf("auth key entry %q is not of the form kid:secret", entry)
+		}
+
+		keys[kid] = []byte(secret)
+	}
+
+	return keys, nil
+}
+
+// Comma separated, like the auth keys but with no ids since nothing is signed with them
+func ParseTrunkSecrets(spec string) [][]byte {
+	secrets := make([][]byte, 0)
+
+	for _, secret := range strings.Split(spec, ",") {
+		secret = strings.TrimSpace(secret)
+		if secret != "" {
+			secrets = append(secrets, []byte(secret))
+		}
+	}
+
+	return secrets
+}
+
+// With no keys configured anyone can connect, as before tokens existed, even if there are trunk secrets
+// since those are only for other nodes to say they are one
+func (a *Authenticator) TokensRequired() bool {
+	return a != nil && len(a.keys) > 0
+}
+
+// Once there are trunk secrets only those holding one get to be nodes
+func (a *Authenticator) HasTrunkSecrets() bool {
+	return a != nil && len(a.trunkSecrets) > 0
+}
+
+func (a *Authenticator) IsTrunkSecret(credential string) bool {
+	if a == nil {
+		return false
+	}
+
+	matched := false
+	for _, secret := range a.trunkSecrets {
+		// Check all of them so the time taken doesn't say which matched
+		if subtle.ConstantTimeCompare([]byte(credential), secret) == 1 {
+			matched = true
+		}
+	}
+
+	return matched
+}
+
+func (a *Authenticator) Sign(kid string, claims *AccessClaims) (string, error) {
+	key, exists := a.keys[kid]
+	if !exists {
+		return "", fmt.Errorf("no auth key with id %s", kid)
+	}
+
+	header, err := json.Marshal(&tokenHeader{Algorithm: "HS256", Type: "JWT", KeyID: kid})
+	if err != nil {
+		return "", err
+	}
+
+	body, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(tokenSignature(key, signingInput)), nil
+}
+
+func (a *Authenticator) Verify(token string) (*AccessClaims, error) {
+	if a == nil || len(a.keys) == 0 {
+		return nil, fmt.Errorf("no auth keys configured")
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token header")
+	}
+
+	var header tokenHeader
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		return nil, fmt.Errorf("malformed token header")
+	}
+
+	if header.Algorithm != "HS256" {
+		return nil, fmt.Errorf("unsupported token algorithm %s", header.Algorithm)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature")
+	}
+
+	signingInput := parts[0] + "." + parts[1]
+
+	verified := false
+	if header.KeyID != "" {
+		key, exists := a.keys[header.KeyID]
+		verified = exists && hmac.Equal(signature, tokenSignature(key, signingInput))
+	} else {
+		for _, key := range a.keys {
+			if hmac.Equal(signature, tokenSignature(key, signingInput)) {
+				verified = true
+				break
+			}
+		}
+	}
+
+	if !verified {
+		return nil, fmt.Errorf("token signature invalid")
+	}
+
+	claimsBytes, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token claims")
+	}
+
+	var claims AccessClaims
+	if err := json.Unmarshal(claimsBytes, &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims")
+	}
+
+	now := time.Now()
+	if claims.ExpiresAt != 0 && now.After(time.Unix(claims.ExpiresAt, 0).Add(tokenClockLeeway)) {
+		return nil, fmt.Errorf("token expired")
+	}
+
+	if claims.NotBefore != 0 && now.Before(time.Unix(claims.NotBefore, 0).Add(-tokenClockLeeway)) {
+		return nil, fmt.Errorf("token not yet valid")
+	}
+
+	return &claims, nil
+}
+
+func tokenSignature(key []byte, signingInput string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signingInput))
+	return mac.Sum(nil)
+}
+
+// What a client is allowed to do, decided before the client is created
+type clientPermissions struct {
+	identity     string
+	canPublish   bool
+	canSubscribe bool
+	fromTrunk    bool // Authenticated with a trunk secret or trunk token, so known to be another umbrella node
+}
+
+var allPermissions = clientPermissions{canPublish: true, canSubscribe: true}
+
+var trunkPermissions = clientPermissions{identity: "trunk", canPublish: true, canSubscribe: true, fromTrunk: true}
+
+func permissionsFromClaims(claims *AccessClaims) clientPermissions {
+	return clientPermissions{
+		identity:     claims.Identity,
+		canPublish:   claims.CanPublish,
+		canSubscribe: claims.CanSubscribe,
+		fromTrunk:    claims.Trunk,
+	}
+}
+
+// Works out the room a token holder ends up in, requestedRoom is "" if the client didn't ask for one
+func roomForClaims(claims *AccessClaims, requestedRoom string) (string, error) {
+	if claims.Room == "" {
+		return validateRoomID(requestedRoom)
+	}
+
+	if requestedRoom != "" && requestedRoom != claims.Room {
+		return "", fmt.Errorf("token is not valid for room %s", requestedRoom)
+	}
+
+	return validateRoomID(claims.Room)
+}
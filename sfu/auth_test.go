@@ -0,0 +1,215 @@
+package sfu
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	auth := NewAuthenticator(map[string][]byte{"main": []byte("mainsecret"), "old": []byte("oldsecret")}, nil)
+	other := NewAuthenticator(map[string][]byte{"main": []byte("othersecret"), "new": []byte("mainsecret")}, nil)
+
+	now := time.Now()
+	claims := func(modify func(c *AccessClaims)) *AccessClaims {
+		c := &AccessClaims{Identity: "alice", Room: "kitchen", CanPublish: true, ExpiresAt: now.Add(time.Hour).Unix()}
+		if modify != nil {
+			modify(c)
+		}
+		return c
+	}
+
+	sign := func(a *Authenticator, kid string, c *AccessClaims) string {
+		token, err := a.Sign(kid, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	valid := sign(auth, "main", claims(nil))
+	parts := strings.Split(valid, ".")
+
+	// Signed with the second key, so all have to be tried
+	noKidInput := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + parts[1]
+	noKid := noKidInput + "." + base64.RawURLEncoding.EncodeToString(tokenSignature([]byte("oldsecret"), noKidInput))
+
+	noneAlg := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"main"}`)) + "." + parts[1] + "."
+
+	tests := []struct {
+		name         string
+		auth         *Authenticator
+		token        string
+		wantErr      string
+		wantIdentity string
+	}{
+		{name: "valid", auth: auth, token: valid, wantIdentity: "alice"},
+		{name: "other key", auth: auth, token: sign(auth, "old", claims(nil)), wantIdentity: "alice"},
+		{name: "no kid tries every key", auth: auth, token: noKid, wantIdentity: "alice"},
+		{name: "no expiry", auth: auth, token: sign(auth, "main", claims(func(c *AccessClaims) { c.ExpiresAt = 0 })), wantIdentity: "alice"},
+		{name: "expired within leeway", auth: auth, token: sign(auth, "main", claims(func(c *AccessClaims) { c.ExpiresAt = now.Add(-10 * time.Second).Unix() })), wantIdentity: "alice"},
+		{name: "expired", auth: auth, token: sign(auth, "main", claims(func(c *AccessClaims) { c.ExpiresAt = now.Add(-time.Hour).Unix() })), wantErr: "token expired"},
+		{name: "not yet valid", auth: auth, token: sign(auth, "main", claims(func(c *AccessClaims) { c.NotBefore = now.Add(time.Hour).Unix() })), wantErr: "not yet valid"},
+		{name: "unknown kid", auth: auth, token: sign(other, "new", claims(nil)), wantErr: "signature invalid"},
+		{name: "wrong key for kid", auth: auth, token: sign(other, "main", claims(nil)), wantErr: "signature invalid"},
+		{name: "tampered claims", auth: auth, token: parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"mallory","publish":true}`)) + "." + parts[2], wantErr: "signature invalid"},
+		{name: "unsigned", auth: auth, token: noneAlg, wantErr: "unsupported token algorithm"},
+		{name: "two parts", auth: auth, token: parts[0] + "." + parts[1], wantErr: "malformed token"},
+		{name: "garbage header", auth: auth, token: "!!!." + parts[1] + "." + parts[2], wantErr: "malformed token header"},
+		{name: "empty", auth: auth, token: "", wantErr: "malformed token"},
+		{name: "no keys", auth: NewAuthenticator(nil, [][]byte{[]byte("trunk")}), token: valid, wantErr: "no auth keys"},
+		{name: "nil authenticator", auth: nil, token: valid, wantErr: "no auth keys"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.auth.Verify(test.token)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, test.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got.Identity != test.wantIdentity {
+				t.Errorf("got identity %s, want %s", got.Identity, test.wantIdentity)
+			}
+		})
+	}
+}
+
+func TestParseAuthKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "empty", spec: "", want: map[string]string{}},
+		{name: "one", spec: "main:secret", want: map[string]string{"main": "secret"}},
+		{name: "several with spaces", spec: " main:secret , old:other,", want: map[string]string{"main": "secret", "old": "other"}},
+		{name: "colon in secret", spec: "main:a:b", want: map[string]string{"main": "a:b"}},
+		{name: "no colon", spec: "mainsecret", wantErr: true},
+		{name: "no kid", spec: ":secret", wantErr: true},
+		{name: "no secret", spec: "main:", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseAuthKeys(test.spec)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(got) != len(test.want) {
+				t.Fatalf("got %d keys, want %d", len(got), len(test.want))
+			}
+
+			for kid, secret := range test.want {
+				if string(got[kid]) != secret {
+					t.Errorf("key %s got %q, want %q", kid, got[kid], secret)
+				}
+			}
+		})
+	}
+}
+
+func TestTokensRequired(t *testing.T) {
+	tests := []struct {
+		name string
+		auth *Authenticator
+		want bool
+	}{
+		{name: "nil", auth: nil, want: false},
+		{name: "nothing", auth: NewAuthenticator(nil, nil), want: false},
+		{name: "only trunk secrets", auth: NewAuthenticator(nil, [][]byte{[]byte("trunk")}), want: false},
+		{name: "keys", auth: NewAuthenticator(map[string][]byte{"main": []byte("secret")}, nil), want: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.auth.TokensRequired(); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAuthorizeRequest(t *testing.T) {
+	keys := map[string][]byte{"main": []byte("mainsecret")}
+	trunkSecrets := [][]byte{[]byte("trunksecret")}
+
+	minted, err := NewAuthenticator(keys, nil).Sign("main", &AccessClaims{Identity: "alice", CanPublish: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		auth       *Authenticator
+		token      string
+		wantStatus int
+		wantTrunk  bool
+	}{
+		{name: "open", auth: NewAuthenticator(nil, nil), wantStatus: http.StatusOK},
+		{name: "open ignores tokens", auth: NewAuthenticator(nil, nil), token: "anything", wantStatus: http.StatusOK},
+		{name: "trunk secret", auth: NewAuthenticator(nil, trunkSecrets), token: "trunksecret", wantStatus: http.StatusOK, wantTrunk: true},
+		{name: "browser with only trunk secrets", auth: NewAuthenticator(nil, trunkSecrets), wantStatus: http.StatusOK},
+		{name: "wrong trunk secret", auth: NewAuthenticator(nil, trunkSecrets), token: "guess", wantStatus: http.StatusUnauthorized},
+		{name: "minted token", auth: NewAuthenticator(keys, trunkSecrets), token: minted, wantStatus: http.StatusOK},
+		{name: "trunk secret with keys", auth: NewAuthenticator(keys, trunkSecrets), token: "trunksecret", wantStatus: http.StatusOK, wantTrunk: true},
+		{name: "bad token with keys", auth: NewAuthenticator(keys, trunkSecrets), token: "guess", wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &Sfu{auth: test.auth}
+
+			_, permissions, status, err := s.authorizeRequest(httptest.NewRequest(http.MethodGet, "/ws?room=kitchen", nil), test.token)
+			if status != test.wantStatus {
+				t.Fatalf("got status %d (%v), want %d", status, err, test.wantStatus)
+			}
+
+			if status == http.StatusOK && permissions.fromTrunk != test.wantTrunk {
+				t.Errorf("got trunk %v, want %v", permissions.fromTrunk, test.wantTrunk)
+			}
+		})
+	}
+}
+
+func TestHelloWithoutTrunkSecret(t *testing.T) {
+	s := &Sfu{nodeId: "here", auth: NewAuthenticator(nil, [][]byte{[]byte("trunksecret")})}
+	hello := &RemoteNodeMessage{Hello: &NodeHello{NodeId: "there"}}
+
+	browser := newTestClient(s, allPermissions)
+	browser.handleWsMessage(hello, s)
+
+	if browser.failure.get() == "" {
+		t.Error("node without a trunk secret was let in")
+	}
+
+	if browser.remoteNodeId != "" {
+		t.Errorf("believed it was node %s", browser.remoteNodeId)
+	}
+
+	trunk := newTestClient(s, trunkPermissions)
+	trunk.handleWsMessage(hello, s)
+
+	if trunk.failure.get() != "" || trunk.remoteNodeId != "there" {
+		t.Errorf("trunk with a secret got failure %q and node %q", trunk.failure.get(), trunk.remoteNodeId)
+	}
+}
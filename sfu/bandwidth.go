@@ -0,0 +1,105 @@
+package sfu
+
+import (
+	"sort"
+	"time"
+)
+
+// Where GCC starts before any feedback has arrived, enough for a middling simulcast layer
+const initialBitrateEstimate = 1_000_000
+
+// How often each client fits its video into the current estimate
+const bandwidthAllocationInterval = time.Second
+
+// Only plan to use this much of the estimate, since it swings around and overshooting causes loss
+const bandwidthHeadroom = 0.85
+
+// Fits the video sent to one subscriber into its estimated bandwidth
+// Audio is always forwarded and is paid for first, then every video track gets its lowest layer if it fits,
+// and is paused if not, before whatever is left upgrades layers one track at a time
+// Video hidden by last n isn't being sent, so costs nothing and is left alone
+func allocateBandwidth(estimate int, downTracks map[string]*downTrack) {
+	if estimate <= 0 {
+		// No estimate yet, so don't hold anything back
+		for _, dt := range downTracks {
+			dt.setAllocation("", false)
+		}
+		return
+	}
+
+	budget := int64(float64(estimate) * bandwidthHeadroom)
+
+	video := make([]*downTrack, 0, len(downTracks))
+	for _, dt := range downTracks {
+		if dt.source.descriptor.Kind == TrackKind_Video {
+			if !dt.isHidden() {
+				video = append(video, dt)
+			}
+		} else {
+			// Audio is never simulcast
+			budget -= int64(dt.source.layerBitrate(""))
+		}
+	}
+
+	// Video already flowing keeps priority over paused video so tracks don't take turns being paused
+	sort.Slice(video, func(i, j int) bool {
+		_, pausedI := video[i].getAllocation()
+		_, pausedJ := video[j].getAllocation()
+		if pausedI != pausedJ {
+			return !pausedI
+		}
+
+		return video[i].source.UmbrellaID() < video[j].source.UmbrellaID()
+	})
+
+	// The index into each track's wanted layers it has been given, -1 for paused
+	wanted := make([][]string, len(video))
+	given := make([]int, len(video))
+
+	for i, dt := range video {
+		wanted[i] = dt.wantedLayers()
+		given[i] = -1
+
+		if len(wanted[i]) == 0 {
+			continue
+		}
+
+		lowest := len(wanted[i]) - 1
+		cost := int64(dt.source.layerBitrate(wanted[i][lowest]))
+		if cost <= budget {
+			given[i] = lowest
+			budget -= cost
+		}
+	}
+
+	for i, dt := range video {
+		if given[i] <= 0 {
+			continue
+		}
+
+		current := int64(dt.source.layerBitrate(wanted[i][given[i]]))
+
+		// Best first, so the first which fits is the one to take
+		for better := 0; better < given[i]; better++ {
+			extra := int64(dt.source.layerBitrate(wanted[i][better])) - current
+			if extra <= budget {
+				given[i] = better
+				budget -= extra
+				break
+			}
+		}
+	}
+
+	for i, dt := range video {
+		switch {
+		case len(wanted[i]) == 0:
+			dt.setAllocation("", false)
+		case given[i] < 0:
+			dt.setAllocation("", true)
+		case given[i] == 0 && len(wanted[i]) == len(dt.source.getRankedLayers()):
+			dt.setAllocation("", false)
+		default:
+			dt.setAllocation(wanted[i][given[i]], false)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package sfu
+
+import (
+	"testing"
+
+	"atomirex.com/umbrella/razor"
+)
+
+// A track with the bitrates given for its layers as if they had been measured, where audio has the single layer ""
+func newTestMeasuredTrack(umbrellaId string, kind TrackKind, bitrates map[string]uint64) *incomingTrack {
+	it := newIncomingTrack(&TrackDescriptor{UmbrellaId: umbrellaId, StreamId: "stream", Kind: kind}, "room")
+
+	for rid, bitrate := range bitrates {
+		it.addLayer(rid)
+		it.layers[rid].bitrate.Store(bitrate)
+	}
+	it.rankLayers()
+
+	return it
+}
+
+func TestAllocateBandwidth(t *testing.T) {
+	simulcast := map[string]uint64{"q": 150_000, "h": 500_000, "f": 1_500_000}
+
+	type allocation struct {
+		maxLayer string
+		paused   bool
+	}
+
+	tests := []struct {
+		name        string
+		estimate    int
+		pausedFirst []string // Paused by the previous allocation
+		hidden      []string
+		preferred   map[string]string
+		want        map[string]allocation
+	}{
+		{
+			name:     "no estimate holds nothing back",
+			estimate: 0,
+			want:     map[string]allocation{"a": {}, "b": {}},
+		},
+		{
+			name:     "plenty for everything",
+			estimate: 10_000_000,
+			want:     map[string]allocation{"a": {}, "b": {}},
+		},
+		{
+			// 1.2M less headroom and audio leaves 980k, both lowest layers take 300k, and the rest upgrades a
+			name:     "upgrades one track at a time",
+			estimate: 1_200_000,
+			want:     map[string]allocation{"a": {maxLayer: "h"}, "b": {maxLayer: "q"}},
+		},
+		{
+			name:     "pauses what doesn't fit",
+			estimate: 100_000,
+			want:     map[string]allocation{"a": {paused: true}, "b": {paused: true}},
+		},
+		{
+			// Room for one lowest layer, which goes to what is already flowing
+			name:        "flowing video keeps priority",
+			estimate:    250_000,
+			pausedFirst: []string{"a"},
+			want:        map[string]allocation{"a": {paused: true}, "b": {maxLayer: "q"}},
+		},
+		{
+			// Enough for a to take the top layer only if b isn't paying for its lowest
+			name:     "hidden video costs nothing",
+			estimate: 1_900_000,
+			hidden:   []string{"b"},
+			want:     map[string]allocation{"a": {}, "b": {}},
+		},
+		{
+			name:      "never better than preferred",
+			estimate:  10_000_000,
+			preferred: map[string]string{"a": "q"},
+			want:      map[string]allocation{"a": {maxLayer: "q"}, "b": {}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			logger := razor.NewLogger(razor.LoggingLevelOff, false)
+			downTracks := make(map[string]*downTrack)
+
+			for _, it := range []*incomingTrack{
+				newTestMeasuredTrack("a", TrackKind_Video, simulcast),
+				newTestMeasuredTrack("b", TrackKind_Video, simulcast),
+				newTestMeasuredTrack("audio", TrackKind_Audio, map[string]uint64{"": 40_000}),
+			} {
+				d, err := newDownTrack(it, logger, "test")
+				if err != nil {
+					t.Fatal(err)
+				}
+				downTracks[it.UmbrellaID()] = d
+			}
+
+			for _, id := range test.pausedFirst {
+				downTracks[id].setAllocation("", true)
+			}
+
+			for _, id := range test.hidden {
+				downTracks[id].hidden = true
+			}
+
+			for id, rid := range test.preferred {
+				downTracks[id].setPreferredLayer(rid)
+			}
+
+			allocateBandwidth(test.estimate, downTracks)
+
+			for id, want := range test.want {
+				maxLayer, paused := downTracks[id].getAllocation()
+				if maxLayer != want.maxLayer || paused != want.paused {
+					t.Errorf("%s got max layer %q paused %v, want %q paused %v", id, maxLayer, paused, want.maxLayer, want.paused)
+				}
+			}
+		})
+	}
+}
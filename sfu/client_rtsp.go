@@ -1,8 +1,8 @@
 package sfu
 
 import (
+	"fmt"
 	"log"
-	"time"
 
 	"atomirex.com/umbrella/razor"
 	"github.com/bluenviron/gortsplib/v4"
@@ -35,12 +35,22 @@ type RtspClient struct {
 
 	rtsplibClient   *gortsplib.Client
 	rtspDescription *description.Session
+
+	failure failureReason
 }
 
 func (r *RtspClient) stop() {
 	r.handler.Send(rtspClientStop, nil)
 }
 
+// Gives up on this connection, the SFU starts another after backing off
+func (r *RtspClient) fail(err error) {
+	log.Println(err)
+
+	r.failure.set(err.Error())
+	r.stop()
+}
+
 func (r *RtspClient) run(s *Sfu) {
 	r.handler = razor.NewMessageHandler(r.logger, r.label, 16, func(what rtspClientCommand, payload *rtspClientCommandMessage) bool {
 		switch what {
@@ -57,61 +67,57 @@ func (r *RtspClient) run(s *Sfu) {
 				return true
 			}
 
-			failedCheck := func(err error) bool {
-				if err == nil {
-					return false
-				}
-
-				log.Println(err)
-
-				if r.rtsplibClient != nil {
-					r.rtsplibClient.Close()
-					r.rtsplibClient = nil
-				}
-
-				r.handler.Timeout(rtspClientDial, nil, 5000*time.Millisecond)
-				return true
-			}
-
 			u, err := base.ParseURL(r.url)
 			if err != nil {
-				log.Println("Invalid url", err)
+				r.fail(fmt.Errorf("invalid url: %w", err))
 				return true
 			}
 
 			r.rtsplibClient = &gortsplib.Client{}
 			err = r.rtsplibClient.Start(u.Scheme, u.Host)
-			if failedCheck(err) {
+			if err != nil {
+				r.fail(err)
 				return true
 			}
 
 			r.rtspDescription, _, err = r.rtsplibClient.Describe(u)
-			if failedCheck(err) {
+			if err != nil {
+				r.fail(err)
 				return true
 			}
 
+			// The goroutine gets its own references, since stopping clears them
+			client := r.rtsplibClient
+			rtspDescription := r.rtspDescription
+
 			// Video only for now with the eufy
 			// Audio breaks things massively, and doesn't work at all
 			// Might be best to work out how to use go2rtc libraries
-			videointrack := &incomingTrack{
-				descriptor: &TrackDescriptor{
-					UmbrellaId: "UMB_ID" + uuid.NewString(),
-					Kind:       TrackKind_Video,
-				},
-			}
-
-			videorelay, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{
+			videointrack := newIncomingTrack(&TrackDescriptor{
+				UmbrellaId:   "UMB_ID" + uuid.NewString(),
+				Kind:         TrackKind_Video,
+				StreamId:     "rtsp-src-stream-id" + uuid.NewString(),
+				OriginNodeId: s.nodeId,
+				HopPath:      []string{s.nodeId},
+			}, r.room)
+
+			videointrack.codec = webrtc.RTPCodecCapability{
 				MimeType:     webrtc.MimeTypeH264,
 				ClockRate:    90000,
 				Channels:     0,
 				SDPFmtpLine:  "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f",
 				RTCPFeedback: nil,
-			}, "UMB_RSTP_SRC"+uuid.New().String(), "rtsp-src-stream-id"+uuid.NewString())
+			}
 
-			videointrack.relay = videorelay
+			videointrack.addLayer("")
 
-			if failedCheck(err) {
-				return true
+			// Only ever one waiting, since the camera only needs asking once
+			keyframeRequests := make(chan struct{}, 1)
+			videointrack.keyframeRequester = func(rid string) {
+				select {
+				case keyframeRequests <- struct{}{}:
+				default:
+				}
 			}
 
 			go func() {
@@ -119,32 +125,26 @@ func (r *RtspClient) run(s *Sfu) {
 
 				// setup all medias
 				// this must be called before StartRecording(), since it overrides the control attribute.
-				err = r.rtsplibClient.SetupAll(r.rtspDescription.BaseURL, r.rtspDescription.Medias)
-				if failedCheck(err) {
+				err := client.SetupAll(rtspDescription.BaseURL, rtspDescription.Medias)
+				if err != nil {
+					r.fail(err)
 					return
 				}
 
 				// read RTP packets from the reader and route them to the publisher
-				r.rtsplibClient.OnPacketRTPAny(func(medi *description.Media, forma format.Format, pkt *rtp.Packet) {
+				client.OnPacketRTPAny(func(medi *description.Media, forma format.Format, pkt *rtp.Packet) {
 					if medi.Type == description.MediaTypeVideo {
 						p := pkt.Clone()
 						p.Extension = false
 						p.Extensions = nil
 
-						if err := videointrack.relay.WriteRTP(p); err != nil {
-							r.logger.Error(r.label, "Error writing rtp from "+videointrack.String()+" to relay "+err.Error())
-							return
-						}
+						videointrack.writeRTP("", p)
 					}
 				})
 
 				rtcpStop := make(chan struct{})
 
 				go func() {
-					// Otherwise it basically never does this!
-					keyframehack := time.NewTicker(12 * time.Second)
-					defer keyframehack.Stop()
-
 					// Ugh
 					defer func() {
 						if r := recover(); r != nil {
@@ -158,20 +158,25 @@ func (r *RtspClient) run(s *Sfu) {
 							if !ok {
 								return
 							}
-						case <-keyframehack.C:
-							err := r.rtsplibClient.WritePacketRTCP(r.rtspDescription.Medias[0], &rtcp.PictureLossIndication{})
+						case <-keyframeRequests:
+							err := client.WritePacketRTCP(rtspDescription.Medias[0], &rtcp.PictureLossIndication{})
 							if err != nil {
 								return
 							}
+
+							s.metrics.keyframeRequests.Add(1)
 						}
 					}
 				}()
 
 				// start playing
-				_, err = r.rtsplibClient.Play(nil)
-				failedCheck(err)
+				_, err = client.Play(nil)
+				if err == nil {
+					s.serverConnected(r)
+					err = client.Wait()
+				}
 
-				failedCheck(r.rtsplibClient.Wait())
+				r.fail(err)
 
 				// Properly stop the other goroutines
 				// Dislike this, especially needing to check for panics
@@ -188,6 +193,7 @@ func (r *RtspClient) run(s *Sfu) {
 	r.handler.Send(rtspClientDial, nil)
 
 	r.handler.Loop(func() {
+		s.serverStopped(r, r.failure.get())
 	})
 }
 
@@ -199,10 +205,22 @@ func (r *RtspClient) RemoveOutgoingTracksForIncomingTrack(intrack *incomingTrack
 	// Do nothing
 }
 
+func (r *RtspClient) SendData(data *relayedData) {
+	// Cameras have no data channels
+}
+
+func (r *RtspClient) SetActiveSpeakers(speakers *ActiveSpeakers) {
+	// Nobody to tell
+}
+
 func (r *RtspClient) RequestEvalState() {
 
 }
 
+func (r *RtspClient) queueLength() int {
+	return int(r.handler.Size())
+}
+
 func (r *RtspClient) getStatus() *SFUStatusClient {
 	return nil
 }
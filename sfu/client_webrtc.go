@@ -2,18 +2,20 @@ package sfu
 
 import (
 	"context"
-	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"atomirex.com/umbrella/razor"
-	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
 	"github.com/pion/webrtc/v4"
 	"google.golang.org/protobuf/proto"
 )
@@ -26,12 +28,14 @@ const (
 	clientStop
 	clientAddOutgoingTrackForIncomingTrack
 	clientRemoveOutgoingTracksForIncomingTrack
-	clientKeyframeTick
-	clientKeyframeGateUnlock
 	clientEvalState
 	clientDialWs
 	clientIncomingTrackAdded
 	clientGetStatus
+	clientRequestKeyframe
+	clientAllocateBandwidth
+	clientRetryRejectedTracks
+	clientSetActiveSpeakers
 )
 
 type rawIncomingTrack struct {
@@ -43,6 +47,8 @@ type clientCommandMessage struct {
 	message          *RemoteNodeMessage
 	incomingTrack    *incomingTrack
 	newincomingTrack *rawIncomingTrack
+	rid              string
+	activeSpeakers   *ActiveSpeakers
 	result           *clientCommandResult
 }
 
@@ -58,6 +64,14 @@ type client struct {
 	outgoing  *PeerConnection
 	websocket *websocket.Conn
 
+	permissions clientPermissions
+
+	// Why a trunk stopped, for the SFU to report
+	failure failureReason
+
+	// The node at the other end, from its hello, empty for browsers
+	remoteNodeId string
+
 	// The umbrellaId -> incomingTrack
 	incomingTracks map[string]*incomingTrackWithClientState
 
@@ -67,6 +81,18 @@ type client struct {
 	// The umbrellaId -> RTPSender
 	senders map[string]*webrtc.RTPSender
 
+	// The umbrellaId -> downTrack feeding the sender
+	downTracks map[string]*downTrack
+
+	// The umbrellaId -> simulcast rid the remote asked for
+	layerPreferences map[string]string
+
+	// Until the remote says otherwise it gets sent everything, like before subscriptions existed
+	subscribeAll bool
+
+	// The umbrellaIds the remote has explicitly subscribed to, only used when not subscribing to all
+	subscriptions map[string]bool
+
 	handler *razor.MessageHandler[clientCommand, clientCommandMessage]
 
 	// mid <-> umbrella track ID mappings - only set when known to be valid!
@@ -74,6 +100,23 @@ type client struct {
 
 	// Incoming tracks that have yet to be attached to MIDs
 	stagedIncomingTracks []*rawIncomingTrack
+
+	// Where data for the remote goes, on the outgoing pc
+	dataReliable   *webrtc.DataChannel
+	dataUnreliable *webrtc.DataChannel
+
+	// Data arrives on pion's goroutines, so is limited there before it goes on to the relay
+	dataLimiterMutex sync.Mutex
+	dataLimiter      dataRateLimiter
+
+	// remoteNodeId for the data relay, which sends from its own goroutine
+	dataRemoteNodeId atomic.Pointer[string]
+
+	// The latest from the SFU, for picking the last n
+	activeSpeakers *ActiveSpeakers
+
+	// Asked for by the remote, negative means the room's
+	lastN int
 }
 
 func (c *client) getStatus() *SFUStatusClient {
@@ -81,7 +124,9 @@ func (c *client) getStatus() *SFUStatusClient {
 		status: make(chan *SFUStatusClient, 1),
 	}}
 
-	c.handler.Send(clientGetStatus, &msg)
+	if !c.handler.Send(clientGetStatus, &msg) {
+		return nil
+	}
 
 	return <-msg.result.status
 }
@@ -95,38 +140,53 @@ func (c *client) run(ws *websocket.Conn, s *Sfu) {
 	c.stagedIncomingTracks = make([]*rawIncomingTrack, 0)
 
 	c.senders = make(map[string]*webrtc.RTPSender)
+	c.downTracks = make(map[string]*downTrack)
+	c.layerPreferences = make(map[string]string)
+
+	c.subscribeAll = true
+	c.subscriptions = make(map[string]bool)
+
+	c.lastN = -1
 
 	incoming, err := s.peerConnectionFactory.NewPeerConnection(fmt.Sprintf("incoming for %s", c.label))
 	if c.logger.NilErrCheck(c.label, "Failed to create an incoming peer connection", err) {
+		c.runFailed(s, err)
 		return
 	}
 
 	outgoing, err := s.peerConnectionFactory.NewPeerConnection(fmt.Sprintf("outgoing for %s", c.label))
 	if c.logger.NilErrCheck(c.label, "Failed to create an outgoing peer connection", err) {
+		c.runFailed(s, err)
 		return
 	}
 
 	c.incoming = incoming
 	c.outgoing = outgoing
 
-	falseptr := false
-
-	_, err = incoming.CreateDataChannel("data-out", &webrtc.DataChannelInit{Ordered: &falseptr})
-	c.logger.NilErrCheck(c.label, "Failed to create an incoming data channel", err)
+	for _, reliable := range []bool{false, true} {
+		in, err := incoming.CreateDataChannel(dataChannelLabel(reliable), dataChannelInit(reliable))
+		if !c.logger.NilErrCheck(c.label, "Failed to create an incoming data channel", err) {
+			in.OnMessage(func(msg webrtc.DataChannelMessage) {
+				c.onDataChannelMessage(s, msg.Data, reliable)
+			})
+		}
 
-	_, err = outgoing.CreateDataChannel("data-in", &webrtc.DataChannelInit{Ordered: &falseptr})
-	c.logger.NilErrCheck(c.label, "Failed to create an outgoing data channel", err)
+		out, err := outgoing.CreateDataChannel(dataChannelLabel(reliable), dataChannelInit(reliable))
+		if !c.logger.NilErrCheck(c.label, "Failed to create an outgoing data channel", err) {
+			if reliable {
+				c.dataReliable = out
+			} else {
+				c.dataUnreliable = out
+			}
+		}
+	}
 
 	_, err = c.outgoing.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{
 		Direction: webrtc.RTPTransceiverDirectionSendonly,
 	})
 	c.logger.NilErrCheck(c.label, "Error adding fake transceiver to outgoing pc", err)
 
-	// keyframe throttling
-	sendKeyFrameGate := false
-
 	c.handler = razor.NewMessageHandler(c.logger, c.label, 1024, func(what clientCommand, payload *clientCommandMessage) bool {
-		shouldSendKeyframe := false
 		shouldEvalState := false
 
 		stop := func() {
@@ -138,10 +198,6 @@ func (c *client) run(ws *websocket.Conn, s *Sfu) {
 		}
 
 		switch what {
-		case clientKeyframeTick:
-			shouldSendKeyframe = true
-		case clientKeyframeGateUnlock:
-			sendKeyFrameGate = false
 		case clientSendProto:
 			if c.websocket == nil {
 				c.logger.Error(c.label, "Attempting send when not connected to websocket")
@@ -170,6 +226,15 @@ func (c *client) run(ws *websocket.Conn, s *Sfu) {
 			stop()
 			return true
 		case clientAddOutgoingTrackForIncomingTrack:
+			if !c.permissions.canSubscribe {
+				return true
+			}
+
+			// Nodes the track has been through already have it, or are where it came from
+			if !canForwardTo(payload.incomingTrack.descriptor, c.remoteNodeId) {
+				return true
+			}
+
 			// Add it to our outgoing if it's not on incoming
 			if _, incomingExists := c.incomingTracks[payload.incomingTrack.UmbrellaID()]; !incomingExists {
 				c.outgoingTracks[payload.incomingTrack.UmbrellaID()] = &outgoingTrackWithClientState{
@@ -195,8 +260,7 @@ func (c *client) run(ws *websocket.Conn, s *Sfu) {
 
 			shouldEvalState = true
 		case clientGetStatus:
-			// Like the SFU this is horribly blocking
-			// Also could cause problems if the client goes AWOL while the SFU is wanting to get status (i.e. would need a timeout)
+			// The SFU only waits so long for this, so a stuck client just drops out of the status
 
 			intd := make([]*TrackDescriptor, 0)
 			for _, t := range c.incomingTracks {
@@ -213,7 +277,22 @@ func (c *client) run(ws *websocket.Conn, s *Sfu) {
 				if t != nil {
 					id = t.ID()
 				}
-				senderStatus = append(senderStatus, &SFUStatusSender{HasTrack: t != nil, TrackIdIfSet: id, UmbrellaId: umbrellaId})
+				layer, preferredLayer, maxLayer, paused, hidden := "", "", "", false, false
+				if dt, exists := c.downTracks[umbrellaId]; exists {
+					layer, preferredLayer = dt.getLayers()
+					maxLayer, paused = dt.getAllocation()
+					hidden = dt.isHidden()
+				}
+				senderStatus = append(senderStatus, &SFUStatusSender{
+					HasTrack:       t != nil,
+					TrackIdIfSet:   id,
+					UmbrellaId:     umbrellaId,
+					Layer:          layer,
+					PreferredLayer: preferredLayer,
+					MaxLayer:       maxLayer,
+					Paused:         paused,
+					Hidden:         hidden,
+				})
 			}
 			midMapping := make([]*MidToUmbrellaIDMapping, 0)
 			for mid, umbrellaId := range c.incomingMidToUmbrellaTrackID {
@@ -225,19 +304,38 @@ func (c *client) run(ws *websocket.Conn, s *Sfu) {
 					StreamId: s.track.StreamID(),
 					TrackId:  s.track.ID(),
 					Mid:      s.receiver.RTPTransceiver().Mid(),
+					Rid:      s.track.RID(),
 				})
 			}
 
+			subscriptions := make([]string, 0)
+			for umbrellaId := range c.subscriptions {
+				subscriptions = append(subscriptions, umbrellaId)
+			}
+
+			rejected := make([]*TrackDescriptor, 0)
+			for _, ot := range c.outgoingTracks {
+				if ot.remoteRejected {
+					rejected = append(rejected, ot.track.descriptor)
+				}
+			}
+
 			status := &SFUStatusClient{
 				Label:                c.label,
 				TrunkUrl:             c.trunkurl,
-				IncomingPC:           c.incoming.GetStatus(),
-				OutgoingPC:           c.outgoing.GetStatus(),
+				Identity:             c.permissions.identity,
+				IncomingPC:           c.incoming.GetStatus(func(t *webrtc.RTPTransceiver) string { return c.incomingMidToUmbrellaTrackID[t.Mid()] }),
+				OutgoingPC:           c.outgoing.GetStatus(c.senderUmbrellaID),
 				IncomingTracks:       intd,
 				OutgoingTracks:       outtd,
 				Senders:              senderStatus,
 				MidMapping:           midMapping,
 				StagedIncomingTracks: stagedIncoming,
+				SubscribeAll:         c.subscribeAll,
+				Subscriptions:        subscriptions,
+				EstimatedBitrate:     int64(c.outgoing.TargetBitrate()),
+				RemoteNodeId:         c.remoteNodeId,
+				RejectedTracks:       rejected,
 			}
 
 			payload.result.status <- status
@@ -247,7 +345,7 @@ func (c *client) run(ws *websocket.Conn, s *Sfu) {
 			}
 
 			dialer := websocket.Dialer{
-				TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // TODO remove this bad ignoring of certs, but useful for local testing
+				TLSClientConfig: s.trunkSecurity.tlsConfig(),
 
 				NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
 					host, port, err := net.SplitHostPort(addr)
@@ -269,9 +367,11 @@ func (c *client) run(ws *websocket.Conn, s *Sfu) {
 				},
 			}
 
-			conn, _, err := dialer.Dial(c.trunkurl, nil)
+			conn, _, err := dialer.Dial(c.trunkurl, s.trunkSecurity.requestHeader())
 			if c.logger.NilErrCheck(c.label, "Error dialling ws "+c.trunkurl, err) {
-				c.handler.Timeout(clientDialWs, nil, time.Second*10)
+				// The SFU dials again with a fresh client after backing off
+				c.failure.set(err.Error())
+				stop()
 				return true
 			}
 
@@ -279,6 +379,45 @@ func (c *client) run(ws *websocket.Conn, s *Sfu) {
 			go func() {
 				c.continueWebsocket(s)
 			}()
+
+			s.serverConnected(c)
+		case clientRequestKeyframe:
+			intrack, exists := c.incomingTracks[payload.incomingTrack.UmbrellaID()]
+			if !exists {
+				return true
+			}
+
+			remote, exists := intrack.remotes[payload.rid]
+			if exists {
+				s.metrics.keyframeRequests.Add(1)
+				_ = c.incoming.WriteRTCP([]rtcp.Packet{
+					&rtcp.PictureLossIndication{
+						MediaSSRC: uint32(remote.SSRC()),
+					},
+				})
+			}
+		case clientAllocateBandwidth:
+			// Picks up any change to the room's last n too
+			c.applyLastN(s)
+			allocateBandwidth(c.outgoing.TargetBitrate(), c.downTracks)
+
+			c.handler.Timeout(clientAllocateBandwidth, nil, bandwidthAllocationInterval)
+		case clientRetryRejectedTracks:
+			for _, ot := range c.outgoingTracks {
+				if ot.remoteRejected {
+					ot.remoteRejected = false
+					ot.remoteNotified = false
+				}
+			}
+
+			shouldEvalState = true
+		case clientSetActiveSpeakers:
+			// Other nodes work it out for themselves from the levels in the packets
+			if !c.isKnownNode() {
+				c.activeSpeakers = payload.activeSpeakers
+				c.writeProto(&RemoteNodeMessage{ActiveSpeakers: payload.activeSpeakers})
+				c.applyLastN(s)
+			}
 		case clientIncomingTrackAdded:
 			t := payload.newincomingTrack.track
 			tsc := payload.newincomingTrack.receiver.RTPTransceiver()
@@ -293,32 +432,9 @@ func (c *client) run(ws *websocket.Conn, s *Sfu) {
 		if shouldEvalState {
 			c.handler.Cancel(clientEvalState)
 
-			shouldSendKeyframe = true
 			c.evalState(s)
 		}
 
-		if shouldSendKeyframe {
-			// Throttled
-			if !sendKeyFrameGate {
-				c.handler.Cancel(clientKeyframeTick)
-
-				sendKeyFrameGate = true
-				c.handler.Timeout(clientKeyframeGateUnlock, nil, time.Millisecond*500)
-
-				for _, receiver := range c.incoming.GetReceivers() {
-					if receiver.Track() != nil {
-						_ = c.incoming.WriteRTCP([]rtcp.Packet{
-							&rtcp.PictureLossIndication{
-								MediaSSRC: uint32(receiver.Track().SSRC()),
-							},
-						})
-					}
-				}
-
-				c.handler.Timeout(clientKeyframeTick, nil, time.Second*3)
-			}
-		}
-
 		return true
 	})
 
@@ -326,11 +442,17 @@ func (c *client) run(ws *websocket.Conn, s *Sfu) {
 		c.handler.Send(clientDialWs, nil)
 	}
 
+	c.handler.Timeout(clientAllocateBandwidth, nil, bandwidthAllocationInterval)
+
 	c.handler.Loop(func() {
 		for _, it := range c.incomingTracks {
 			s.removeOutgoingTracksForIncomingTrack(it.track)
 		}
 
+		for _, dt := range c.downTracks {
+			dt.detach()
+		}
+
 		if ws != nil {
 			ws.Close()
 			ws = nil
@@ -346,15 +468,36 @@ func (c *client) run(ws *websocket.Conn, s *Sfu) {
 		}
 		incoming = nil
 
+		if c.trunkurl != "" {
+			s.serverStopped(c, c.failure.get())
+		}
+
 		c.logger.Info(c.label, "Post clean up finished")
 	})
 }
 
+// Without peer connections there's no handler either, so stop is never going to be able to say so
+func (c *client) runFailed(s *Sfu, err error) {
+	if c.trunkurl != "" {
+		s.serverStopped(c, err.Error())
+	}
+}
+
 func (c *client) stop() {
+	// Never got as far as running, so there's nothing to stop
+	if c.handler == nil {
+		return
+	}
+
 	c.handler.CancelAll()
 	c.handler.Send(clientStop, nil)
 }
 
+func (c *client) fail(reason string) {
+	c.failure.set(reason)
+	c.stop()
+}
+
 func (c *client) pcTerminated() bool {
 	return c.incoming.IsTerminated() || c.outgoing.IsTerminated()
 }
@@ -434,12 +577,35 @@ func (c *client) handleWsMessage(message *RemoteNodeMessage, s *Sfu) {
 		c.logger.Info(c.label, "WS PROTO RECEIVED accept tracks "+message.AcceptTracks.String())
 
 		// Mark the accepted tracks and schedule an evaluation
+		accepted := make(map[string]bool)
 		for _, td := range message.AcceptTracks.Tracks {
+			accepted[td.UmbrellaId] = true
+
 			ot := c.outgoingTracks[td.UmbrellaId]
 			if ot != nil {
 				ot.remoteNotified = true
 				ot.remoteAccepted = true
+				ot.remoteRejected = false
+			}
+		}
+
+		// Anything we told the remote about which it left out it doesn't want, for now anyway
+		anyRejected := false
+		for umbrellaId, ot := range c.outgoingTracks {
+			if ot.remoteNotified && !ot.remoteAccepted && !accepted[umbrellaId] {
+				if !ot.remoteRejected {
+					c.logger.Info(c.label, "Remote rejected track "+umbrellaId)
+				}
+
+				ot.remoteRejected = true
 			}
+
+			anyRejected = anyRejected || ot.remoteRejected
+		}
+
+		c.handler.Cancel(clientRetryRejectedTracks)
+		if anyRejected {
+			c.handler.Timeout(clientRetryRejectedTracks, nil, rejectedTrackRetryInterval)
 		}
 
 		c.handler.Send(clientEvalState, nil)
@@ -450,10 +616,38 @@ func (c *client) handleWsMessage(message *RemoteNodeMessage, s *Sfu) {
 
 		// Any previously unknown upstream tracks need to have transceivers created for them
 		// Then we acknowledge with the complete set of expected upstream tracks
+		// Clients without publish permission just get an empty acknowledgement
+		if !c.permissions.canPublish && len(message.UpstreamTracks.Tracks) > 0 {
+			c.logger.Warn(c.label, "Ignoring upstream tracks from client without publish permission")
+		}
+
 		for _, td := range message.UpstreamTracks.Tracks {
+			if !c.permissions.canPublish {
+				break
+			}
+
 			_, exists := c.incomingTracks[td.UmbrellaId]
 			if !exists {
 				if td.Kind != TrackKind_Unknown {
+					fromNode := c.remoteNodeId != ""
+					if fromNode && s.hasVisited(td) {
+						c.logger.Info(c.label, "Rejecting track "+td.UmbrellaId+" which has already been through this node")
+						continue
+					}
+
+					s.stampArrival(td, fromNode)
+
+					// Claimed before the transceiver exists so a rejected track costs nothing
+					intrack := &incomingTrackWithClientState{
+						track:   newIncomingTrack(td, c.room),
+						remotes: make(map[string]*webrtc.TrackRemote),
+					}
+
+					if !s.claimTrack(intrack.track) {
+						c.logger.Info(c.label, "Rejecting track "+td.UmbrellaId+" which the room already has from elsewhere")
+						continue
+					}
+
 					c.logger.Info(c.label, "Adding transceiver "+td.Id+" "+td.Kind.String())
 
 					_, err := c.incoming.AddTransceiverFromKind(trackKindToWebrtcKind(td.Kind), webrtc.RTPTransceiverInit{
@@ -462,11 +656,8 @@ func (c *client) handleWsMessage(message *RemoteNodeMessage, s *Sfu) {
 
 					if err != nil {
 						c.logger.Error(c.label, "Failed to add transceiver "+err.Error())
+						s.releaseTrack(intrack.track)
 					} else {
-						intrack := &incomingTrackWithClientState{
-							track: &incomingTrack{descriptor: td},
-						}
-
 						c.incomingTracks[intrack.UmbrellaID()] = intrack
 					}
 				}
@@ -483,6 +674,80 @@ func (c *client) handleWsMessage(message *RemoteNodeMessage, s *Sfu) {
 		s.handler.Send(sfuSignalClients, nil)
 	}
 
+	if message.Hello != nil && !c.isTrunk() && s.auth.HasTrunkSecrets() {
+		// Nodes have to prove they are one, so this is someone trying to trunk in without the secret
+		c.logger.Warn(c.label, "Refusing hello from node "+message.Hello.NodeId+" without a trunk secret")
+		c.fail("node without a trunk secret")
+		return
+	} else if message.Hello != nil {
+		if c.isTrunk() {
+			c.logger.Info(c.label, "WS PROTO RECEIVED hello from node "+message.Hello.NodeId)
+		} else {
+			// Anyone could say this, so it's only believed as far as keeping things from going back where they came from
+			c.logger.Warn(c.label, "Hello from node "+message.Hello.NodeId+" without a trunk secret, only used to stop loops")
+		}
+
+		if message.Hello.NodeId == s.nodeId {
+			c.logger.Warn(c.label, "Trunk goes back to this node")
+		}
+
+		c.remoteNodeId = message.Hello.NodeId
+		c.dataRemoteNodeId.Store(&message.Hello.NodeId)
+
+		// Tracks lined up before we knew who the remote was may have come from it
+		for umbrellaId, ot := range c.outgoingTracks {
+			if !canForwardTo(ot.source.descriptor, c.remoteNodeId) {
+				delete(c.outgoingTracks, umbrellaId)
+			}
+		}
+
+		c.handler.Send(clientEvalState, nil)
+	}
+
+	if message.Subscriptions != nil {
+		c.logger.Info(c.label, "WS PROTO RECEIVED subscriptions "+message.Subscriptions.String())
+
+		if message.Subscriptions.SubscribeAll {
+			c.subscribeAll = true
+			c.subscriptions = make(map[string]bool)
+		} else {
+			// Switching out of subscribe all starts from nothing, so only what is named here gets sent
+			c.subscribeAll = false
+
+			for _, umbrellaId := range message.Subscriptions.Subscribe {
+				c.subscriptions[umbrellaId] = true
+			}
+
+			for _, umbrellaId := range message.Subscriptions.Unsubscribe {
+				delete(c.subscriptions, umbrellaId)
+			}
+		}
+
+		c.handler.Send(clientEvalState, nil)
+	}
+
+	if message.LayerPreference != nil {
+		c.logger.Info(c.label, "WS PROTO RECEIVED layer preference "+message.LayerPreference.String())
+
+		umbrellaId := message.LayerPreference.UmbrellaId
+		if message.LayerPreference.Rid == "" {
+			delete(c.layerPreferences, umbrellaId)
+		} else {
+			c.layerPreferences[umbrellaId] = message.LayerPreference.Rid
+		}
+
+		if dt, exists := c.downTracks[umbrellaId]; exists {
+			dt.setPreferredLayer(message.LayerPreference.Rid)
+		}
+	}
+
+	if message.LastN != nil {
+		c.logger.Info(c.label, "WS PROTO RECEIVED last n "+message.LastN.String())
+
+		c.lastN = max(int(message.LastN.N), -1)
+		c.applyLastN(s)
+	}
+
 	if message.MidMappings != nil {
 		c.logger.Info(c.label, "WS PROTO RECEIVED mid <-> umbrella mapping "+message.MidMappings.String())
 		// Review all incoming tracks to assign MIDs, and if newly so then fan out appropriately
@@ -500,6 +765,7 @@ func (c *client) evalIncomingState(s *Sfu) {
 	c.logger.Info(c.label, "Eval incoming state")
 
 	// Review staged incoming tracks to see if any can be updated as a result
+	// With simulcast there is one staged track per layer, all sharing the transceiver and so the mid
 	for i := 0; i < len(c.stagedIncomingTracks); i++ {
 		sit := c.stagedIncomingTracks[i]
 
@@ -512,30 +778,40 @@ func (c *client) evalIncomingState(s *Sfu) {
 		if midKnown {
 			intrack, trackExists := c.incomingTracks[umbrellaId]
 			if trackExists {
-				if intrack.track.remote == nil {
-					c.logger.Info(c.label, "Ready to fan out track: "+umbrellaId)
+				rid := sit.track.RID()
+				isFirstLayer := intrack.track.receiver == nil
+
+				if !isFirstLayer && intrack.track.receiver != sit.receiver {
+					continue
+				}
 
-					// Assign it, remove from staged, and launch fan out
-					intrack.track.remote = sit.track
+				if isFirstLayer {
+					c.logger.Info(c.label, "Ready to fan out track: "+umbrellaId)
 
 					intrack.track.descriptor.Id = sit.track.ID()
 					intrack.track.descriptor.StreamId = sit.track.StreamID()
+					intrack.track.codec = sit.track.Codec().RTPCodecCapability
 					intrack.track.receiver = sit.receiver
 					intrack.transceiverMid = mid
 
-					// Remove from staged
-					c.stagedIncomingTracks = append(c.stagedIncomingTracks[:i], c.stagedIncomingTracks[i+1:]...)
-					i--
-
-					relay, err := webrtc.NewTrackLocalStaticRTP(intrack.track.remote.Codec().RTPCodecCapability, "UMB_RELAY"+uuid.New().String(), intrack.track.remote.StreamID())
-					if err != nil {
-						panic(err)
+					track := intrack.track
+					track.keyframeRequester = func(rid string) {
+						c.handler.Send(clientRequestKeyframe, &clientCommandMessage{incomingTrack: track, rid: rid})
 					}
+				} else {
+					c.logger.Info(c.label, "Adding simulcast layer "+rid+" to track: "+umbrellaId)
+				}
 
-					intrack.track.relay = relay
+				// Remove from staged
+				c.stagedIncomingTracks = append(c.stagedIncomingTracks[:i], c.stagedIncomingTracks[i+1:]...)
+				i--
 
-					go c.fanoutIncoming(intrack.track, s)
+				intrack.remotes[rid] = sit.track
+				intrack.track.addLayer(rid)
 
+				go fanoutIncoming(c.logger, c.label, intrack.track, sit.track, s)
+
+				if isFirstLayer {
 					s.handler.Send(sfuAddOutgoingTracksForIncomingTrack, &sfuCommandMessage{intrack: intrack.track})
 					c.logger.Info(c.label, "New incoming track sent to SFU: "+umbrellaId)
 				}
@@ -544,36 +820,50 @@ func (c *client) evalIncomingState(s *Sfu) {
 	}
 }
 
-func (c *client) fanoutIncoming(intrack *incomingTrack, s *Sfu) {
-	defer s.removeOutgoingTracksForIncomingTrack(intrack)
+// Reads one layer of an incoming track, passing the packets to everything subscribed to the track
+func fanoutIncoming(logger *razor.Logger, label string, intrack *incomingTrack, remote *webrtc.TrackRemote, s *Sfu) {
+	rid := remote.RID()
+
+	defer func() {
+		if intrack.removeLayer(rid) {
+			s.removeOutgoingTracksForIncomingTrack(intrack)
+		}
+	}()
 
 	bufSize := 32768
 
-	if intrack.remote.Kind() == webrtc.RTPCodecTypeVideo {
+	if remote.Kind() == webrtc.RTPCodecTypeVideo {
 		bufSize = bufSize * 8
 	}
 
 	buf := make([]byte, bufSize)
 
+	// Read for the speaker detection, and passed on by each subscriber's down track with its own id
+	audioLevelID := 0
+	if remote.Kind() == webrtc.RTPCodecTypeAudio && intrack.receiver != nil {
+		audioLevelID = headerExtensionID(intrack.receiver.GetParameters().HeaderExtensions, sdp.AudioLevelURI)
+	}
+
 	rtpPkt := &rtp.Packet{}
 	for {
-		i, _, err := intrack.remote.Read(buf)
-		if c.logger.NilErrCheck(c.label, "Fan out error reading rtp on track "+intrack.String(), err) {
+		i, _, err := remote.Read(buf)
+		if logger.NilErrCheck(label, "Fan out error reading rtp on track "+intrack.String()+" layer "+rid, err) {
 			return
 		}
 
 		if err = rtpPkt.Unmarshal(buf[:i]); err != nil {
-			c.logger.Error(c.label, "Error unmarshaling rtp on track "+intrack.String()+" "+err.Error())
+			logger.Error(label, "Error unmarshaling rtp on track "+intrack.String()+" "+err.Error())
 			return
 		}
 
+		if audioLevelID != 0 {
+			intrack.levels.read(rtpPkt.GetExtension(uint8(audioLevelID)))
+		}
+
 		rtpPkt.Extension = false
 		rtpPkt.Extensions = nil
 
-		if err := intrack.relay.WriteRTP(rtpPkt); err != nil {
-			c.logger.Error(c.label, "Error writing rtp from "+intrack.String()+" to relay "+err.Error())
-			return
-		}
+		intrack.writeRTP(rid, rtpPkt)
 	}
 }
 
@@ -602,7 +892,7 @@ func (c *client) evalState(s *Sfu) {
 	// If we have any we're waiting on confirmation of we should return and wait before evalling again
 	needsConfirmation := false
 	for _, ot := range c.outgoingTracks {
-		needsConfirmation = needsConfirmation || !ot.remoteAccepted
+		needsConfirmation = needsConfirmation || (!ot.remoteAccepted && !ot.remoteRejected)
 	}
 
 	if needsConfirmation {
@@ -621,10 +911,10 @@ func (c *client) evalState(s *Sfu) {
 	}
 
 	senderRemovalFailed := false
-	// Find any senders that don't have a track, and remove them
+	// Find any senders that don't have a track, or that the remote is no longer subscribed to, and remove them
 	for umbrellaId, sender := range c.senders {
 		_, exists := c.outgoingTracks[umbrellaId]
-		if !exists {
+		if !exists || !c.isSubscribed(umbrellaId) {
 			c.logger.Debug(c.label, "eval state removing sender for track with umb id "+umbrellaId)
 
 			if err := c.outgoing.RemoveTrack(sender); err != nil {
@@ -632,6 +922,7 @@ func (c *client) evalState(s *Sfu) {
 				senderRemovalFailed = true
 			} else {
 				delete(c.senders, umbrellaId)
+				c.removeDownTrack(umbrellaId)
 			}
 		}
 	}
@@ -643,17 +934,45 @@ func (c *client) evalState(s *Sfu) {
 		return
 	}
 
+	hidden := c.hiddenVideo(s)
+
 	addingTrackFailed := false
-	// Find any tracks which don't have a sender, and add them
+	// Find any subscribed tracks which don't have a sender, and add them
 	for umbrellaId, ot := range c.outgoingTracks {
+		if !c.isSubscribed(umbrellaId) || ot.remoteRejected {
+			continue
+		}
+
 		sender, exists := c.senders[umbrellaId]
 		if !exists || sender.Track() == nil {
 			c.logger.Debug(c.label, "eval state creating sender for track with umb id "+umbrellaId)
-			if sender, err := c.outgoing.AddTrack(ot.source.relay); err != nil {
+			c.removeDownTrack(umbrellaId)
+
+			dt, err := newDownTrack(ot.source, c.logger, c.label)
+			if err != nil {
+				c.logger.Error(c.label, "Error creating down track for track with umb id "+umbrellaId+" "+err.Error())
+				addingTrackFailed = true
+				continue
+			}
+
+			if sender, err := c.outgoing.AddTrack(dt.local); err != nil {
 				c.logger.Error(c.label, "Error creating sender for track with umb id "+umbrellaId+" "+err.Error())
 				addingTrackFailed = true
 			} else {
 				c.senders[umbrellaId] = sender
+
+				dt.setPreferredLayer(c.layerPreferences[umbrellaId])
+				dt.setHidden(hidden[umbrellaId])
+				dt.transport = sender.Transport()
+				c.downTracks[umbrellaId] = dt
+				ot.source.addSink(dt)
+
+				go readSenderRTCP(sender, dt.keyframeRequested)
+
+				// Simulcast down tracks ask for their own keyframe before starting
+				if ot.source.descriptor.Kind == TrackKind_Video && !ot.source.isSimulcast() {
+					ot.source.requestKeyframe("")
+				}
 			}
 		}
 	}
@@ -699,6 +1018,94 @@ func (c *client) evalState(s *Sfu) {
 	})
 }
 
+func (c *client) removeDownTrack(umbrellaId string) {
+	if dt, exists := c.downTracks[umbrellaId]; exists {
+		dt.detach()
+		delete(c.downTracks, umbrellaId)
+	}
+}
+
+func (c *client) senderUmbrellaID(t *webrtc.RTPTransceiver) string {
+	for umbrellaId, sender := range c.senders {
+		if sender == t.Sender() {
+			return umbrellaId
+		}
+	}
+
+	return ""
+}
+
+// Dialled by us, or authenticated as another node, so its hello can be believed
+func (c *client) isTrunk() bool {
+	return c.trunkurl != "" || c.permissions.fromTrunk
+}
+
+// A node which is trusted as one, rather than only having said hello
+func (c *client) isKnownNode() bool {
+	return c.isTrunk() && c.remoteNodeId != ""
+}
+
+func (c *client) isSubscribed(umbrellaId string) bool {
+	return c.subscribeAll || c.subscriptions[umbrellaId]
+}
+
+// Other nodes send on everything from their rooms so get more leeway, with the size of what's wrapped up inside
+// checked once it's unwrapped
+func (c *client) onDataChannelMessage(s *Sfu, data []byte, reliable bool) {
+	limits := s.getDataLimits()
+	if c.isTrunk() {
+		limits = limits.forTrunk()
+	}
+
+	c.dataLimiterMutex.Lock()
+	allowed := len(data) <= limits.MaxMessageSize && c.dataLimiter.allow(len(data), limits, time.Now())
+	c.dataLimiterMutex.Unlock()
+
+	if !allowed {
+		s.metrics.dataMessagesDropped.Add(1)
+		c.logger.Verbose(c.label, fmt.Sprintf("Dropping %d byte data message over the limits", len(data)))
+		return
+	}
+
+	if message := s.receivedDataMessage(c, data, reliable); message != nil {
+		s.relayData(c, message)
+	}
+}
+
+// Nodes the message has been through already have it
+func (c *client) remoteHasData(message *DataMessage) bool {
+	remoteNodeId := c.dataRemoteNodeId.Load()
+	return remoteNodeId != nil && slices.Contains(message.HopPath, *remoteNodeId)
+}
+
+// Called on the data relay's goroutine, the data channels being set before the client is added to the SFU
+func (c *client) SendData(data *relayedData) {
+	if !c.permissions.canSubscribe {
+		return
+	}
+
+	if c.remoteHasData(data.message) {
+		return
+	}
+
+	dc := c.dataUnreliable
+	if data.message.Reliable {
+		dc = c.dataReliable
+	}
+
+	if dc == nil || dc.ReadyState() != webrtc.DataChannelStateOpen {
+		return
+	}
+
+	if dc.BufferedAmount() > maxDataBufferedAmount {
+		c.logger.Warn(c.label, "Dropping data message as too much is waiting to go out")
+		return
+	}
+
+	err := dc.Send(data.encoded)
+	c.logger.NilErrCheck(c.label, "Failed to send data message", err)
+}
+
 func (c *client) writeProto(m *RemoteNodeMessage) {
 	c.handler.Send(clientSendProto, &clientCommandMessage{message: m})
 }
@@ -713,6 +1120,9 @@ func (c *client) continueWebsocket(s *Sfu) {
 	incoming := c.incoming
 	outgoing := c.outgoing
 
+	// Ahead of anything about tracks, so the remote knows where they're from
+	c.writeProto(&RemoteNodeMessage{Hello: &NodeHello{NodeId: s.nodeId}})
+
 	s.handler.Send(sfuAddClient, &sfuCommandMessage{client: c})
 
 	defer s.handler.Send(sfuRemoveClient, &sfuCommandMessage{client: c})
@@ -749,6 +1159,7 @@ func (c *client) continueWebsocket(s *Sfu) {
 	incoming.OnConnectionStateChange = func(p webrtc.PeerConnectionState) {
 		switch p {
 		case webrtc.PeerConnectionStateFailed:
+			c.fail("incoming peer connection failed")
 		case webrtc.PeerConnectionStateDisconnected:
 		case webrtc.PeerConnectionStateClosed:
 			c.stop()
@@ -761,6 +1172,7 @@ func (c *client) continueWebsocket(s *Sfu) {
 	outgoing.OnConnectionStateChange = func(p webrtc.PeerConnectionState) {
 		switch p {
 		case webrtc.PeerConnectionStateFailed:
+			c.fail("outgoing peer connection failed")
 		case webrtc.PeerConnectionStateDisconnected:
 		case webrtc.PeerConnectionStateClosed:
 			c.stop()
@@ -812,6 +1224,7 @@ func (c *client) continueWebsocket(s *Sfu) {
 		var message RemoteNodeMessage
 		_, raw, err := ws.ReadMessage()
 		if c.logger.NilErrCheck(c.label, "Failed to read message", err) {
+			c.failure.set("Websocket: " + err.Error())
 			return
 		}
 
@@ -832,6 +1245,14 @@ func (c *client) RemoveOutgoingTracksForIncomingTrack(intrack *incomingTrack) {
 	c.handler.Send(clientRemoveOutgoingTracksForIncomingTrack, &clientCommandMessage{incomingTrack: intrack})
 }
 
+func (c *client) SetActiveSpeakers(speakers *ActiveSpeakers) {
+	c.handler.Send(clientSetActiveSpeakers, &clientCommandMessage{activeSpeakers: speakers})
+}
+
 func (c *client) RequestEvalState() {
 	c.handler.Send(clientEvalState, nil)
 }
+
+func (c *client) queueLength() int {
+	return int(c.handler.Size())
+}
@@ -0,0 +1,31 @@
+package sfu
+
+import (
+	"testing"
+
+	"atomirex.com/umbrella/razor"
+)
+
+// A browser connection which has done nothing yet, with a handler nothing is reading from
+func newTestClient(s *Sfu, permissions clientPermissions) *client {
+	logger := razor.NewLogger(razor.LoggingLevelOff, false)
+
+	c := &client{BaseClient: BaseClient{id: "test", label: "test", room: "kitchen", logger: logger}, permissions: permissions}
+	c.handler = razor.NewMessageHandler(logger, c.label, 16, func(what clientCommand, payload *clientCommandMessage) bool {
+		return true
+	})
+
+	return c
+}
+
+func TestStopBeforeRunning(t *testing.T) {
+	// As left when creating the peer connections failed, which the supervisor or an admin can still stop
+	c := &client{BaseClient: BaseClient{id: "test", label: "test", logger: razor.NewLogger(razor.LoggingLevelOff, false)}, trunkurl: "wss://example.com/ws"}
+
+	c.stop()
+	c.fail("gave up")
+
+	if c.failure.get() != "gave up" {
+		t.Errorf("got failure %q", c.failure.get())
+	}
+}
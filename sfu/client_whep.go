@@ -0,0 +1,409 @@
+package sfu
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"atomirex.com/umbrella/razor"
+	"github.com/google/uuid"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// A WHEP viewer, such as a TV or a generic player, which receives media on a single peer connection and sends nothing
+// The viewer's offer fixes how many audio and video sections there are, since WHEP has no way to renegotiate,
+// so room tracks are swapped in and out of those as they come and go
+
+var ErrNothingToReceive = errors.New("offer has no audio or video to receive")
+
+type whepClientCommand int
+
+const (
+	whepClientStop whepClientCommand = iota
+	whepClientAddTrack
+	whepClientRemoveTrack
+	whepClientGetStatus
+	whepClientAllocateBandwidth
+	whepClientKeyframeRequested
+)
+
+type whepClientCommandMessage struct {
+	incomingTrack *incomingTrack
+	slot          *whepSlot
+	status        chan *SFUStatusClient
+}
+
+// One of the viewer's m-sections, and the room track being sent on it if any
+type whepSlot struct {
+	kind        TrackKind
+	transceiver *webrtc.RTPTransceiver
+	downTrack   *downTrack
+}
+
+type WhepClient struct {
+	BaseClient
+
+	sessionId   string // In the resource url, and all it takes to end the session, so kept out of status
+	permissions clientPermissions
+
+	// The umbrellaIds the viewer asked for, or nil for everything in the room
+	requested map[string]bool
+
+	pc      *PeerConnection
+	handler *razor.MessageHandler[whepClientCommand, whepClientCommandMessage]
+
+	slots []*whepSlot
+
+	// The umbrellaId -> room tracks the viewer could be sent, whether or not there's a slot for them
+	available map[string]*incomingTrack
+
+	// The umbrellaId -> downTrack feeding a slot
+	downTracks map[string]*downTrack
+}
+
+func newWhepClient(s *Sfu, room string, permissions clientPermissions, remoteAddr string, requested []string) (*WhepClient, error) {
+	label := fmt.Sprintf("WHEP client from %s", remoteAddr)
+	if permissions.identity != "" {
+		label = fmt.Sprintf("WHEP client %s from %s", permissions.identity, remoteAddr)
+	}
+
+	c := &WhepClient{
+		BaseClient: BaseClient{
+			id:     uuid.NewString(),
+			label:  label,
+			room:   room,
+			logger: s.logger,
+		},
+
+		sessionId:   uuid.NewString(),
+		permissions: permissions,
+		slots:       make([]*whepSlot, 0),
+		available:   make(map[string]*incomingTrack),
+		downTracks:  make(map[string]*downTrack),
+	}
+
+	if len(requested) > 0 {
+		c.requested = make(map[string]bool)
+		for _, umbrellaId := range requested {
+			c.requested[umbrellaId] = true
+		}
+	}
+
+	pc, err := s.peerConnectionFactory.NewPeerConnection(fmt.Sprintf("outgoing for %s", c.label))
+	if err != nil {
+		return nil, err
+	}
+
+	c.pc = pc
+
+	c.handler = razor.NewMessageHandler(c.logger, c.label, 256, func(what whepClientCommand, payload *whepClientCommandMessage) bool {
+		switch what {
+		case whepClientStop:
+			c.logger.Info(c.label, "Stopping")
+
+			for umbrellaId := range c.downTracks {
+				c.removeDownTrack(umbrellaId)
+			}
+
+			c.pc.Close()
+			c.handler.Abort()
+		case whepClientAddTrack:
+			umbrellaId := payload.incomingTrack.UmbrellaID()
+			if c.requested != nil && !c.requested[umbrellaId] {
+				return true
+			}
+
+			c.available[umbrellaId] = payload.incomingTrack
+			c.fillSlots()
+		case whepClientKeyframeRequested:
+			if payload.slot.downTrack != nil {
+				payload.slot.downTrack.keyframeRequested()
+			}
+		case whepClientRemoveTrack:
+			umbrellaId := payload.incomingTrack.UmbrellaID()
+			delete(c.available, umbrellaId)
+
+			if _, exists := c.downTracks[umbrellaId]; exists {
+				c.removeDownTrack(umbrellaId)
+				c.fillSlots()
+			}
+		case whepClientGetStatus:
+			outtd := make([]*TrackDescriptor, 0)
+			senderStatus := make([]*SFUStatusSender, 0)
+
+			for _, slot := range c.slots {
+				status := &SFUStatusSender{}
+
+				if dt := slot.downTrack; dt != nil {
+					outtd = append(outtd, dt.source.descriptor)
+
+					status.HasTrack = true
+					status.TrackIdIfSet = dt.local.ID()
+					status.UmbrellaId = dt.source.UmbrellaID()
+					status.Layer, status.PreferredLayer = dt.getLayers()
+					status.MaxLayer, status.Paused = dt.getAllocation()
+				}
+
+				senderStatus = append(senderStatus, status)
+			}
+
+			payload.status <- &SFUStatusClient{
+				Label:            c.label,
+				Identity:         c.permissions.identity,
+				OutgoingPC:       c.pc.GetStatus(c.slotUmbrellaID),
+				OutgoingTracks:   outtd,
+				Senders:          senderStatus,
+				EstimatedBitrate: int64(c.pc.TargetBitrate()),
+			}
+		case whepClientAllocateBandwidth:
+			allocateBandwidth(c.pc.TargetBitrate(), c.downTracks)
+
+			c.handler.Timeout(whepClientAllocateBandwidth, nil, bandwidthAllocationInterval)
+		}
+
+		return true
+	})
+
+	pc.OnConnectionStateChange = func(pcs webrtc.PeerConnectionState) {
+		switch pcs {
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			s.endSession(c)
+		}
+	}
+
+	c.handler.Loop(func() {
+		c.logger.Info(c.label, "Post clean up finished")
+	})
+
+	c.handler.Timeout(whepClientAllocateBandwidth, nil, bandwidthAllocationInterval)
+
+	return c, nil
+}
+
+// Applies the offer, returning the answer once it has all our candidates
+// Must be done before the client joins the room, as it creates the slots tracks get put in
+func (c *WhepClient) negotiate(offer string) (string, error) {
+	parsed := sdp.SessionDescription{}
+	if err := parsed.UnmarshalString(offer); err != nil {
+		return "", err
+	}
+
+	// A sendonly transceiver for every section the viewer can receive, which the offer then takes over
+	for _, media := range parsed.MediaDescriptions {
+		if _, sendonly := media.Attribute("sendonly"); sendonly {
+			continue
+		}
+
+		if _, inactive := media.Attribute("inactive"); inactive {
+			continue
+		}
+
+		var kind TrackKind
+		var codecType webrtc.RTPCodecType
+
+		switch media.MediaName.Media {
+		case "audio":
+			kind, codecType = TrackKind_Audio, webrtc.RTPCodecTypeAudio
+		case "video":
+			kind, codecType = TrackKind_Video, webrtc.RTPCodecTypeVideo
+		default:
+			continue
+		}
+
+		transceiver, err := c.pc.AddTransceiverFromKind(codecType, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+		if err != nil {
+			return "", err
+		}
+
+		slot := &whepSlot{kind: kind, transceiver: transceiver}
+		c.slots = append(c.slots, slot)
+
+		// The sender outlives the tracks put on it, so which to ask is worked out when a request arrives
+		go readSenderRTCP(transceiver.Sender(), func() {
+			c.handler.Send(whepClientKeyframeRequested, &whepClientCommandMessage{slot: slot})
+		})
+	}
+
+	if len(c.slots) == 0 {
+		return "", ErrNothingToReceive
+	}
+
+	err := c.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer})
+	if err != nil {
+		return "", err
+	}
+
+	answer, err := c.pc.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+
+	gatheringComplete := c.pc.GatheringCompletePromise()
+
+	if err := c.pc.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+
+	<-gatheringComplete
+
+	return c.pc.LocalDescription().SDP, nil
+}
+
+// Puts available tracks into empty slots, video first so audio can follow it from the same stream
+func (c *WhepClient) fillSlots() {
+	for _, kind := range []TrackKind{TrackKind_Video, TrackKind_Audio} {
+		for _, slot := range c.slots {
+			if slot.kind != kind || slot.downTrack != nil {
+				continue
+			}
+
+			source := c.pickTrack(kind)
+			if source == nil {
+				break
+			}
+
+			c.assign(slot, source)
+		}
+	}
+}
+
+// The next track of the kind not already being sent, preferring streams whose video is being sent
+func (c *WhepClient) pickTrack(kind TrackKind) *incomingTrack {
+	streams := make(map[string]bool)
+	for _, dt := range c.downTracks {
+		streams[dt.source.descriptor.StreamId] = true
+	}
+
+	candidates := make([]*incomingTrack, 0)
+	for umbrellaId, t := range c.available {
+		if _, sending := c.downTracks[umbrellaId]; !sending && t.descriptor.Kind == kind {
+			candidates = append(candidates, t)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		sameStreamI := streams[candidates[i].descriptor.StreamId]
+		sameStreamJ := streams[candidates[j].descriptor.StreamId]
+		if sameStreamI != sameStreamJ {
+			return sameStreamI
+		}
+
+		return candidates[i].UmbrellaID() < candidates[j].UmbrellaID()
+	})
+
+	return candidates[0]
+}
+
+func (c *WhepClient) assign(slot *whepSlot, source *incomingTrack) {
+	umbrellaId := source.UmbrellaID()
+
+	dt, err := newDownTrack(source, c.logger, c.label)
+	if err != nil {
+		c.logger.Error(c.label, "Error creating down track for track with umb id "+umbrellaId+" "+err.Error())
+		return
+	}
+
+	// Fails if the viewer can't take the codec, in which case the slot waits for something else
+	if err := slot.transceiver.Sender().ReplaceTrack(dt.local); err != nil {
+		c.logger.Warn(c.label, "Can't send track with umb id "+umbrellaId+" "+err.Error())
+		return
+	}
+
+	c.logger.Info(c.label, "Sending "+source.String()+" on mid "+slot.transceiver.Mid())
+
+	dt.transport = slot.transceiver.Sender().Transport()
+	slot.downTrack = dt
+	c.downTracks[umbrellaId] = dt
+	source.addSink(dt)
+
+	// Simulcast down tracks ask for their own keyframe before starting
+	if source.descriptor.Kind == TrackKind_Video && !source.isSimulcast() {
+		source.requestKeyframe("")
+	}
+}
+
+func (c *WhepClient) removeDownTrack(umbrellaId string) {
+	dt, exists := c.downTracks[umbrellaId]
+	if !exists {
+		return
+	}
+
+	dt.detach()
+	delete(c.downTracks, umbrellaId)
+
+	for _, slot := range c.slots {
+		if slot.downTrack == dt {
+			slot.downTrack = nil
+			c.logger.NilErrCheck(c.label, "Error clearing track from mid "+slot.transceiver.Mid(), slot.transceiver.Sender().ReplaceTrack(nil))
+		}
+	}
+}
+
+func (c *WhepClient) slotUmbrellaID(t *webrtc.RTPTransceiver) string {
+	for _, slot := range c.slots {
+		if slot.transceiver == t && slot.downTrack != nil {
+			return slot.downTrack.source.UmbrellaID()
+		}
+	}
+
+	return ""
+}
+
+func (c *WhepClient) sessionID() string {
+	return c.sessionId
+}
+
+// Trickled candidates from a PATCH
+func (c *WhepClient) addICECandidates(candidates []webrtc.ICECandidateInit) error {
+	for _, candidate := range candidates {
+		if err := c.pc.AddICECandidate(candidate); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *WhepClient) stop() {
+	c.handler.CancelAll()
+	c.handler.Send(whepClientStop, nil)
+}
+
+func (c *WhepClient) getStatus() *SFUStatusClient {
+	msg := whepClientCommandMessage{status: make(chan *SFUStatusClient, 1)}
+
+	if !c.handler.Send(whepClientGetStatus, &msg) {
+		return nil
+	}
+
+	return <-msg.status
+}
+
+func (c *WhepClient) AddOutgoingTracksForIncomingTrack(intrack *incomingTrack) {
+	c.handler.Send(whepClientAddTrack, &whepClientCommandMessage{incomingTrack: intrack})
+}
+
+func (c *WhepClient) RemoveOutgoingTracksForIncomingTrack(intrack *incomingTrack) {
+	c.handler.Send(whepClientRemoveTrack, &whepClientCommandMessage{incomingTrack: intrack})
+}
+
+func (c *WhepClient) SendData(data *relayedData) {
+	// No data channels over WHEP
+}
+
+func (c *WhepClient) SetActiveSpeakers(speakers *ActiveSpeakers) {
+	// WHEP has no signalling after the offer and answer
+}
+
+func (c *WhepClient) RequestEvalState() {
+
+}
+
+func (c *WhepClient) queueLength() int {
+	return int(c.handler.Size())
+}
@@ -0,0 +1,268 @@
+package sfu
+
+import (
+	"fmt"
+
+	"atomirex.com/umbrella/razor"
+	"github.com/google/uuid"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+// A WHIP publisher, such as OBS or GStreamer, which sends media on a single peer connection and receives nothing
+// Signalling is all over HTTP so unlike the websocket clients there's no connection to watch
+
+type whipClientCommand int
+
+const (
+	whipClientStop whipClientCommand = iota
+	whipClientTrackAdded
+	whipClientRequestKeyframe
+	whipClientGetStatus
+)
+
+type whipClientCommandMessage struct {
+	newincomingTrack *rawIncomingTrack
+	incomingTrack    *incomingTrack
+	rid              string
+	status           chan *SFUStatusClient
+}
+
+type WhipClient struct {
+	BaseClient
+
+	sessionId   string // In the resource url, and all it takes to end the session, so kept out of status
+	permissions clientPermissions
+
+	pc      *PeerConnection
+	handler *razor.MessageHandler[whipClientCommand, whipClientCommandMessage]
+
+	// Simulcast layers arrive as separate pion tracks on the same receiver, so that identifies the track
+	tracks map[*webrtc.RTPReceiver]*incomingTrackWithClientState
+}
+
+func newWhipClient(s *Sfu, room string, permissions clientPermissions, remoteAddr string) (*WhipClient, error) {
+	label := fmt.Sprintf("WHIP client from %s", remoteAddr)
+	if permissions.identity != "" {
+		label = fmt.Sprintf("WHIP client %s from %s", permissions.identity, remoteAddr)
+	}
+
+	c := &WhipClient{
+		BaseClient: BaseClient{
+			id:     uuid.NewString(),
+			label:  label,
+			room:   room,
+			logger: s.logger,
+		},
+
+		sessionId:   uuid.NewString(),
+		permissions: permissions,
+		tracks:      make(map[*webrtc.RTPReceiver]*incomingTrackWithClientState),
+	}
+
+	pc, err := s.peerConnectionFactory.NewPeerConnection(fmt.Sprintf("incoming for %s", c.label))
+	if err != nil {
+		return nil, err
+	}
+
+	c.pc = pc
+
+	c.handler = razor.NewMessageHandler(c.logger, c.label, 256, func(what whipClientCommand, payload *whipClientCommandMessage) bool {
+		switch what {
+		case whipClientStop:
+			c.logger.Info(c.label, "Stopping")
+
+			// Tracks leave the SFU when their fanout stops reading, which closing the peer connection causes
+			c.pc.Close()
+			c.handler.Abort()
+		case whipClientTrackAdded:
+			c.addTrack(payload.newincomingTrack, s)
+		case whipClientRequestKeyframe:
+			for _, intrack := range c.tracks {
+				if intrack.track != payload.incomingTrack {
+					continue
+				}
+
+				if remote, exists := intrack.remotes[payload.rid]; exists {
+					s.metrics.keyframeRequests.Add(1)
+					_ = c.pc.WriteRTCP([]rtcp.Packet{
+						&rtcp.PictureLossIndication{
+							MediaSSRC: uint32(remote.SSRC()),
+						},
+					})
+				}
+			}
+		case whipClientGetStatus:
+			intd := make([]*TrackDescriptor, 0)
+			for _, t := range c.tracks {
+				intd = append(intd, t.track.descriptor)
+			}
+
+			payload.status <- &SFUStatusClient{
+				Label:          c.label,
+				Identity:       c.permissions.identity,
+				IncomingPC:     c.pc.GetStatus(c.receiverUmbrellaID),
+				IncomingTracks: intd,
+			}
+		}
+
+		return true
+	})
+
+	pc.OnTrack = func(t *webrtc.TrackRemote, r *webrtc.RTPReceiver) {
+		c.handler.Send(whipClientTrackAdded, &whipClientCommandMessage{newincomingTrack: &rawIncomingTrack{track: t, receiver: r}})
+	}
+
+	pc.OnConnectionStateChange = func(pcs webrtc.PeerConnectionState) {
+		switch pcs {
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			s.endSession(c)
+		}
+	}
+
+	c.handler.Loop(func() {
+		c.logger.Info(c.label, "Post clean up finished")
+	})
+
+	return c, nil
+}
+
+// Applies the offer, returning the answer once it has all our candidates, since WHIP clients can't be sent any later
+func (c *WhipClient) negotiate(offer string) (string, error) {
+	err := c.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer})
+	if err != nil {
+		return "", err
+	}
+
+	answer, err := c.pc.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+
+	gatheringComplete := c.pc.GatheringCompletePromise()
+
+	if err := c.pc.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+
+	<-gatheringComplete
+
+	return c.pc.LocalDescription().SDP, nil
+}
+
+func (c *WhipClient) addTrack(raw *rawIncomingTrack, s *Sfu) {
+	if !c.permissions.canPublish {
+		return
+	}
+
+	t := raw.track
+	rid := t.RID()
+
+	intrack, exists := c.tracks[raw.receiver]
+	isFirstLayer := !exists
+
+	if isFirstLayer {
+		kind := TrackKind_Audio
+		if t.Kind() == webrtc.RTPCodecTypeVideo {
+			kind = TrackKind_Video
+		}
+
+		intrack = &incomingTrackWithClientState{
+			track: newIncomingTrack(&TrackDescriptor{
+				Id:           t.ID(),
+				Kind:         kind,
+				StreamId:     t.StreamID(),
+				UmbrellaId:   "UMB_ID" + uuid.NewString(),
+				OriginNodeId: s.nodeId,
+				HopPath:      []string{s.nodeId},
+			}, c.room),
+			remotes:        make(map[string]*webrtc.TrackRemote),
+			transceiverMid: raw.receiver.RTPTransceiver().Mid(),
+		}
+
+		intrack.track.codec = t.Codec().RTPCodecCapability
+		intrack.track.receiver = raw.receiver
+
+		track := intrack.track
+		track.keyframeRequester = func(rid string) {
+			c.handler.Send(whipClientRequestKeyframe, &whipClientCommandMessage{incomingTrack: track, rid: rid})
+		}
+
+		c.tracks[raw.receiver] = intrack
+
+		c.logger.Info(c.label, "Ready to fan out track: "+track.UmbrellaID())
+	} else {
+		c.logger.Info(c.label, "Adding simulcast layer "+rid+" to track: "+intrack.UmbrellaID())
+	}
+
+	intrack.remotes[rid] = t
+	intrack.track.addLayer(rid)
+
+	go fanoutIncoming(c.logger, c.label, intrack.track, t, s)
+
+	if isFirstLayer {
+		s.addTrack(intrack.track)
+	}
+}
+
+func (c *WhipClient) receiverUmbrellaID(t *webrtc.RTPTransceiver) string {
+	if intrack, exists := c.tracks[t.Receiver()]; exists {
+		return intrack.UmbrellaID()
+	}
+
+	return ""
+}
+
+func (c *WhipClient) sessionID() string {
+	return c.sessionId
+}
+
+// Trickled candidates from a PATCH
+func (c *WhipClient) addICECandidates(candidates []webrtc.ICECandidateInit) error {
+	for _, candidate := range candidates {
+		if err := c.pc.AddICECandidate(candidate); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *WhipClient) stop() {
+	c.handler.CancelAll()
+	c.handler.Send(whipClientStop, nil)
+}
+
+func (c *WhipClient) getStatus() *SFUStatusClient {
+	msg := whipClientCommandMessage{status: make(chan *SFUStatusClient, 1)}
+
+	if !c.handler.Send(whipClientGetStatus, &msg) {
+		return nil
+	}
+
+	return <-msg.status
+}
+
+func (c *WhipClient) AddOutgoingTracksForIncomingTrack(intrack *incomingTrack) {
+	// Publish only
+}
+
+func (c *WhipClient) RemoveOutgoingTracksForIncomingTrack(intrack *incomingTrack) {
+	// Publish only
+}
+
+func (c *WhipClient) SendData(data *relayedData) {
+	// No data channels over WHIP
+}
+
+func (c *WhipClient) SetActiveSpeakers(speakers *ActiveSpeakers) {
+	// Publish only
+}
+
+func (c *WhipClient) RequestEvalState() {
+
+}
+
+func (c *WhipClient) queueLength() int {
+	return int(c.handler.Size())
+}
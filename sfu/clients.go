@@ -5,32 +5,50 @@ import (
 	"strings"
 
 	"atomirex.com/umbrella/razor"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
 type RemoteClient interface {
+	ID() string
 	Label() string
+	Room() string
 	getStatus() *SFUStatusClient
 	stop()
 	AddOutgoingTracksForIncomingTrack(*incomingTrack)
 	RemoveOutgoingTracksForIncomingTrack(*incomingTrack)
+	SendData(*relayedData) // Called on the data relay's goroutine, so mustn't block
+	SetActiveSpeakers(*ActiveSpeakers)
 	RequestEvalState()
+	queueLength() int
 }
 
 type BaseClient struct {
+	id     string // Unique for the life of the client, unlike the label
 	label  string
+	room   string
 	logger *razor.Logger
 }
 
+func (bc *BaseClient) ID() string {
+	return bc.id
+}
+
 func (bc *BaseClient) Label() string {
 	return bc.label
 }
 
+func (bc *BaseClient) Room() string {
+	return bc.room
+}
+
 type RemoteClientParameters struct {
-	logger   *razor.Logger
-	trunkurl string
-	s        *Sfu
-	ws       *websocket.Conn
+	logger      *razor.Logger
+	trunkurl    string
+	room        string
+	permissions clientPermissions
+	s           *Sfu
+	ws          *websocket.Conn
 }
 
 type RemoteClientFactory interface {
@@ -43,13 +61,23 @@ type DefaultRemoteClientFactory struct{}
 // not great
 func (rcf *DefaultRemoteClientFactory) NewClient(params *RemoteClientParameters) RemoteClient {
 	if params.trunkurl == "" {
+		label := fmt.Sprintf("Incoming client from %s", params.ws.UnderlyingConn().RemoteAddr())
+		if params.permissions.fromTrunk {
+			label = fmt.Sprintf("Incoming trunk from %s", params.ws.UnderlyingConn().RemoteAddr())
+		} else if params.permissions.identity != "" {
+			label = fmt.Sprintf("Incoming client %s from %s", params.permissions.identity, params.ws.UnderlyingConn().RemoteAddr())
+		}
+
 		c := &client{
 			BaseClient: BaseClient{
-				label:  fmt.Sprintf("Incoming client from %s", params.ws.UnderlyingConn().RemoteAddr()),
+				id:     uuid.NewString(),
+				label:  label,
+				room:   params.room,
 				logger: params.logger,
 			},
 
-			websocket: params.ws,
+			websocket:   params.ws,
+			permissions: params.permissions,
 		}
 
 		c.run(params.ws, params.s)
@@ -61,7 +89,9 @@ func (rcf *DefaultRemoteClientFactory) NewClient(params *RemoteClientParameters)
 		if strings.HasPrefix(params.trunkurl, "rtsp") {
 			c := &RtspClient{
 				BaseClient: BaseClient{
+					id:     uuid.NewString(),
 					label:  fmt.Sprintf("RTSP client of %s", params.trunkurl),
+					room:   defaultRoomID, // The url goes to the camera, so there's nowhere to put a room
 					logger: params.logger,
 				},
 
@@ -74,11 +104,14 @@ func (rcf *DefaultRemoteClientFactory) NewClient(params *RemoteClientParameters)
 		} else {
 			c := &client{
 				BaseClient: BaseClient{
+					id:     uuid.NewString(),
 					label:  fmt.Sprintf("Trunking client to %s", params.trunkurl),
+					room:   params.room,
 					logger: params.logger,
 				},
 
-				trunkurl: params.trunkurl,
+				trunkurl:    params.trunkurl,
+				permissions: params.permissions,
 			}
 
 			c.run(nil, params.s)
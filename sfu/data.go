@@ -0,0 +1,318 @@
+package sfu
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+	"google.golang.org/protobuf/proto"
+)
+
+// Data channel messages are relayed to everyone else in the room, trunks included, much as tracks are. Each pair
+// of peer connections has a reliable and an unreliable channel, negotiated up front with fixed ids so neither end
+// waits to be told about them, and like media they go one way: a client sends to us on its outgoing pc and we send
+// to it on ours. Clients send bare payloads, which we wrap in a DataMessage saying who they came from.
+//
+// Data never goes through the client or SFU handlers. Trunks are allowed thousands of messages at once, which would
+// fill their queues and crowd out the signalling and client changes they carry, so data has its own bounded queue
+// and goroutine, dropping messages when that's full, and goes straight out on the recipients' data channels
+
+const dataChannelUnreliableID uint16 = 1
+const dataChannelReliableID uint16 = 2
+
+// How many message ids each node remembers, to drop those which come round again over another trunk
+const recentDataMessages = 4096
+
+// Beyond this much waiting to go out to a client its messages are dropped, rather than piling up in memory
+const maxDataBufferedAmount = 1 << 20
+
+// Beyond this many messages waiting to be relayed new ones are dropped
+const dataRelayQueueLength = 1024
+
+type DataLimits struct {
+	MaxMessageSize    int     // Bytes of payload, larger messages are dropped
+	MessagesPerSecond float64 // Per client, with bursts of up to twice this
+	BytesPerSecond    float64 // Per client, with bursts of up to twice this
+}
+
+// A trunk carries a whole room's messages, so gets this many times what a browser does
+const trunkDataLimitFactor = 20
+
+// Room for the DataMessage a trunk wraps each payload in
+const trunkDataMessageOverhead = 1024
+
+// Enough for chat and cursors, small enough that a client can't flood the room
+func DefaultDataLimits() DataLimits {
+	return DataLimits{
+		MaxMessageSize:    16 * 1024,
+		MessagesPerSecond: 50,
+		BytesPerSecond:    64 * 1024,
+	}
+}
+
+// Applies to messages from now on, other nodes are left to apply their own rate limits
+func (s *Sfu) SetDataLimits(limits DataLimits) {
+	s.dataLimitsMutex.Lock()
+	defer s.dataLimitsMutex.Unlock()
+
+	s.dataLimits = limits
+}
+
+func (l DataLimits) forTrunk() DataLimits {
+	return DataLimits{
+		MaxMessageSize:    l.MaxMessageSize + trunkDataMessageOverhead,
+		MessagesPerSecond: l.MessagesPerSecond * trunkDataLimitFactor,
+		BytesPerSecond:    l.BytesPerSecond * trunkDataLimitFactor,
+	}
+}
+
+func (s *Sfu) getDataLimits() DataLimits {
+	s.dataLimitsMutex.Lock()
+	defer s.dataLimitsMutex.Unlock()
+
+	return s.dataLimits
+}
+
+func dataChannelInit(reliable bool) *webrtc.DataChannelInit {
+	negotiated := true
+	id := dataChannelUnreliableID
+	ordered := false
+	var maxRetransmits *uint16
+
+	if reliable {
+		id = dataChannelReliableID
+		ordered = true
+	} else {
+		zero := uint16(0)
+		maxRetransmits = &zero
+	}
+
+	return &webrtc.DataChannelInit{
+		Negotiated:     &negotiated,
+		ID:             &id,
+		Ordered:        &ordered,
+		MaxRetransmits: maxRetransmits,
+	}
+}
+
+func dataChannelLabel(reliable bool) string {
+	if reliable {
+		return "data-reliable"
+	}
+
+	return "data"
+}
+
+// Token buckets for messages and bytes, refilled by how long it's been since the last message
+type dataRateLimiter struct {
+	messages float64
+	bytes    float64
+	last     time.Time
+}
+
+func (l *dataRateLimiter) allow(size int, limits DataLimits, now time.Time) bool {
+	if l.last.IsZero() {
+		l.messages = 2 * limits.MessagesPerSecond
+		l.bytes = 2 * limits.BytesPerSecond
+	} else {
+		elapsed := now.Sub(l.last).Seconds()
+		l.messages = min(l.messages+elapsed*limits.MessagesPerSecond, 2*limits.MessagesPerSecond)
+		l.bytes = min(l.bytes+elapsed*limits.BytesPerSecond, 2*limits.BytesPerSecond)
+	}
+
+	l.last = now
+
+	if l.messages < 1 || l.bytes < float64(size) {
+		return false
+	}
+
+	l.messages--
+	l.bytes -= float64(size)
+
+	return true
+}
+
+// The ids of the last messages relayed, oldest overwritten first
+type recentDataIDs struct {
+	seen  map[string]bool
+	order []string
+	next  int
+}
+
+func newRecentDataIDs() *recentDataIDs {
+	return &recentDataIDs{
+		seen:  make(map[string]bool),
+		order: make([]string, recentDataMessages),
+	}
+}
+
+// Remembers the id, returning whether it was already there
+func (r *recentDataIDs) check(id string) bool {
+	if r.seen[id] {
+		return true
+	}
+
+	delete(r.seen, r.order[r.next])
+	r.order[r.next] = id
+	r.next = (r.next + 1) % len(r.order)
+	r.seen[id] = true
+
+	return false
+}
+
+// What the SFU hands each client, encoded once for all of them
+type relayedData struct {
+	message *DataMessage
+	encoded []byte
+}
+
+type queuedDataMessage struct {
+	from    RemoteClient
+	message *DataMessage
+}
+
+type dataRelay struct {
+	queue chan queuedDataMessage
+
+	// Only touched by the relay goroutine
+	recent *recentDataIDs
+
+	// Room -> who its messages go to, copied from the rooms by the SFU goroutine whenever they change
+	recipientsMutex sync.Mutex
+	recipients      map[string][]RemoteClient
+}
+
+func newDataRelay() *dataRelay {
+	return &dataRelay{
+		queue:      make(chan queuedDataMessage, dataRelayQueueLength),
+		recent:     newRecentDataIDs(),
+		recipients: make(map[string][]RemoteClient),
+	}
+}
+
+func (d *dataRelay) roomRecipients(roomId string) []RemoteClient {
+	d.recipientsMutex.Lock()
+	defer d.recipientsMutex.Unlock()
+
+	return d.recipients[roomId]
+}
+
+// Must be called on the SFU goroutine whenever a room's clients or their blocks change, or it goes away
+func (s *Sfu) updateDataRecipients(r *room) {
+	recipients := make([]RemoteClient, 0, len(r.clients))
+	for _, c := range r.clients {
+		// Admins blocking everything to a client covers data too
+		if !s.forwardingBlocks[c.ID()][""] {
+			recipients = append(recipients, c)
+		}
+	}
+
+	_, exists := s.rooms[r.id]
+
+	s.data.recipientsMutex.Lock()
+	defer s.data.recipientsMutex.Unlock()
+
+	if exists {
+		s.data.recipients[r.id] = recipients
+	} else {
+		delete(s.data.recipients, r.id)
+	}
+}
+
+// Must be called on the SFU goroutine
+func (s *Sfu) updateAllDataRecipients() {
+	s.data.recipientsMutex.Lock()
+	clear(s.data.recipients)
+	s.data.recipientsMutex.Unlock()
+
+	for _, r := range s.rooms {
+		s.updateDataRecipients(r)
+	}
+}
+
+func (s *Sfu) runDataRelay() {
+	for queued := range s.data.queue {
+		s.onRelayData(queued.from, queued.message)
+	}
+}
+
+// A message from a browser is wrapped up, one from another node has already been
+// Only trunks are trusted to say who a message is from, anything else could pretend to be someone else
+func (s *Sfu) receivedDataMessage(from *client, data []byte, reliable bool) *DataMessage {
+	// Set on hello, which comes in on another goroutine
+	remoteNodeId := from.dataRemoteNodeId.Load()
+
+	if !from.isTrunk() && !from.permissions.canPublish {
+		return nil
+	}
+
+	if !from.isTrunk() && remoteNodeId == nil {
+		return &DataMessage{
+			Id:           uuid.NewString(),
+			FromClientId: from.id,
+			FromIdentity: from.permissions.identity,
+			Payload:      data,
+			Reliable:     reliable,
+			HopPath:      []string{s.nodeId},
+		}
+	}
+
+	message := &DataMessage{}
+	if err := proto.Unmarshal(data, message); err != nil {
+		from.logger.Error(from.label, "Failed to unmarshal data message: "+err.Error())
+		return nil
+	}
+
+	if slices.Contains(message.HopPath, s.nodeId) || len(message.Payload) > s.getDataLimits().MaxMessageSize {
+		return nil
+	}
+
+	// A node without a trunk secret has its hop path believed to stop loops, but not who the message came from
+	if !from.isTrunk() {
+		message.FromClientId = from.id
+		message.FromIdentity = from.permissions.identity
+	}
+
+	message.HopPath = append(message.HopPath, s.nodeId)
+
+	return message
+}
+
+// Relays a message to everyone else in the sender's room, unless too much is already waiting
+func (s *Sfu) relayData(from RemoteClient, message *DataMessage) {
+	select {
+	case s.data.queue <- queuedDataMessage{from: from, message: message}:
+	default:
+		s.metrics.dataMessagesDropped.Add(1)
+		s.logger.Verbose("sfu", "Dropping data message from "+from.Label()+" as the relay queue is full")
+	}
+}
+
+// Called on the relay goroutine
+func (s *Sfu) onRelayData(from RemoteClient, message *DataMessage) {
+	if s.data.recent.check(message.Id) {
+		return
+	}
+
+	recipients := s.data.roomRecipients(from.Room())
+	if len(recipients) == 0 {
+		return
+	}
+
+	encoded, err := proto.Marshal(message)
+	if s.logger.NilErrCheck("sfu", "Failed to marshal data message", err) {
+		return
+	}
+
+	data := &relayedData{message: message, encoded: encoded}
+
+	s.metrics.dataMessagesRelayed.Add(1)
+
+	for _, c := range recipients {
+		if c != from {
+			c.SendData(data)
+		}
+	}
+}
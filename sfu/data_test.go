@@ -0,0 +1,266 @@
+package sfu
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"atomirex.com/umbrella/razor"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestDataRateLimiter(t *testing.T) {
+	limits := DataLimits{MaxMessageSize: 1000, MessagesPerSecond: 10, BytesPerSecond: 1000}
+	start := time.Unix(1000, 0)
+
+	tests := []struct {
+		name  string
+		sends []struct {
+			at   time.Duration // Since start
+			size int
+		}
+		wantAllowed int
+	}{
+		{
+			name:        "bursts up to twice the message rate",
+			sends:       repeatSends(30, 0, 1),
+			wantAllowed: 20,
+		},
+		{
+			name:        "bursts up to twice the byte rate",
+			sends:       repeatSends(10, 0, 300),
+			wantAllowed: 6,
+		},
+		{
+			name:        "refills with time",
+			sends:       append(repeatSends(20, 0, 1), repeatSends(10, time.Second, 1)...),
+			wantAllowed: 30,
+		},
+		{
+			name:        "refills no more than the burst",
+			sends:       append(repeatSends(20, 0, 1), repeatSends(30, time.Minute, 1)...),
+			wantAllowed: 40,
+		},
+		{
+			name:        "steady rate under the limit",
+			sends:       spacedSends(50, 100*time.Millisecond, 100),
+			wantAllowed: 50,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var limiter dataRateLimiter
+
+			allowed := 0
+			for _, send := range test.sends {
+				if limiter.allow(send.size, limits, start.Add(send.at)) {
+					allowed++
+				}
+			}
+
+			if allowed != test.wantAllowed {
+				t.Errorf("allowed %d, want %d", allowed, test.wantAllowed)
+			}
+		})
+	}
+}
+
+func repeatSends(count int, at time.Duration, size int) []struct {
+	at   time.Duration
+	size int
+} {
+	sends := make([]struct {
+		at   time.Duration
+		size int
+	}, count)
+	for i := range sends {
+		sends[i].at = at
+		sends[i].size = size
+	}
+
+	return sends
+}
+
+func spacedSends(count int, every time.Duration, size int) []struct {
+	at   time.Duration
+	size int
+} {
+	sends := repeatSends(count, 0, size)
+	for i := range sends {
+		sends[i].at = time.Duration(i) * every
+	}
+
+	return sends
+}
+
+func TestTrunkDataLimits(t *testing.T) {
+	limits := DefaultDataLimits().forTrunk()
+
+	if limits.MessagesPerSecond != DefaultDataLimits().MessagesPerSecond*trunkDataLimitFactor {
+		t.Errorf("got %v messages a second for trunks", limits.MessagesPerSecond)
+	}
+
+	if limits.MaxMessageSize <= DefaultDataLimits().MaxMessageSize {
+		t.Errorf("trunks need room to wrap the largest message, got %d", limits.MaxMessageSize)
+	}
+}
+
+func TestReceivedDataMessage(t *testing.T) {
+	s := &Sfu{nodeId: "here", dataLimits: DefaultDataLimits()}
+	logger := razor.NewLogger(razor.LoggingLevelOff, false)
+
+	browser := &client{BaseClient: BaseClient{id: "browser", logger: logger}, permissions: clientPermissions{identity: "alice", canPublish: true}}
+	viewer := &client{BaseClient: BaseClient{id: "viewer", logger: logger}, permissions: clientPermissions{identity: "bob", canSubscribe: true}}
+	trunk := &client{BaseClient: BaseClient{id: "trunk", logger: logger}, permissions: trunkPermissions}
+
+	wrapped := func(message *DataMessage) []byte {
+		data, err := proto.Marshal(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	tests := []struct {
+		name         string
+		from         *client
+		data         []byte
+		wantNil      bool
+		wantIdentity string
+		wantHops     []string
+	}{
+		{name: "browser payload is wrapped", from: browser, data: []byte("hi"), wantIdentity: "alice", wantHops: []string{"here"}},
+		{
+			name:         "browser can't say who it is",
+			from:         browser,
+			data:         wrapped(&DataMessage{Id: "1", FromIdentity: "mallory", Payload: []byte("hi")}),
+			wantIdentity: "alice",
+			wantHops:     []string{"here"},
+		},
+		{name: "needs publish permission", from: viewer, data: []byte("hi"), wantNil: true},
+		{
+			name:         "trunk passes on who it came from",
+			from:         trunk,
+			data:         wrapped(&DataMessage{Id: "1", FromIdentity: "carol", Payload: []byte("hi"), HopPath: []string{"there"}}),
+			wantIdentity: "carol",
+			wantHops:     []string{"there", "here"},
+		},
+		{name: "trunk loop", from: trunk, data: wrapped(&DataMessage{Id: "1", Payload: []byte("hi"), HopPath: []string{"here", "there"}}), wantNil: true},
+		{name: "trunk oversized payload", from: trunk, data: wrapped(&DataMessage{Id: "1", Payload: make([]byte, DefaultDataLimits().MaxMessageSize+1)}), wantNil: true},
+		{name: "trunk garbage", from: trunk, data: []byte{0xFF, 0xFF, 0xFF}, wantNil: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message := s.receivedDataMessage(test.from, test.data, true)
+			if test.wantNil {
+				if message != nil {
+					t.Fatalf("got %v, want it dropped", message)
+				}
+				return
+			}
+
+			if message == nil {
+				t.Fatal("got nothing")
+			}
+
+			if message.FromIdentity != test.wantIdentity {
+				t.Errorf("got from %s, want %s", message.FromIdentity, test.wantIdentity)
+			}
+
+			if !slices.Equal(message.HopPath, test.wantHops) {
+				t.Errorf("got hop path %v, want %v", message.HopPath, test.wantHops)
+			}
+		})
+	}
+}
+
+// Keeps what the relay hands it
+type dataRecipient struct {
+	BaseClient
+	received []*relayedData
+}
+
+func (d *dataRecipient) getStatus() *SFUStatusClient                         { return nil }
+func (d *dataRecipient) stop()                                               {}
+func (d *dataRecipient) AddOutgoingTracksForIncomingTrack(*incomingTrack)    {}
+func (d *dataRecipient) RemoveOutgoingTracksForIncomingTrack(*incomingTrack) {}
+func (d *dataRecipient) SendData(data *relayedData)                          { d.received = append(d.received, data) }
+func (d *dataRecipient) SetActiveSpeakers(*ActiveSpeakers)                   {}
+func (d *dataRecipient) RequestEvalState()                                   {}
+func (d *dataRecipient) queueLength() int                                    { return 0 }
+
+func newTestDataSfu() *Sfu {
+	return &Sfu{
+		rooms:            make(map[string]*room),
+		forwardingBlocks: make(map[string]map[string]bool),
+		data:             newDataRelay(),
+		metrics:          newSfuMetrics(),
+		logger:           razor.NewLogger(razor.LoggingLevelOff, false),
+	}
+}
+
+func TestRelayData(t *testing.T) {
+	s := newTestDataSfu()
+
+	clients := make(map[string]*dataRecipient)
+	for _, id := range []string{"alice", "bob", "blocked", "elsewhere"} {
+		room := "kitchen"
+		if id == "elsewhere" {
+			room = "garden"
+		}
+
+		c := &dataRecipient{BaseClient: BaseClient{id: id, room: room}}
+		clients[id] = c
+
+		r := s.getOrCreateRoom(room)
+		r.clients = append(r.clients, c)
+	}
+
+	s.forwardingBlocks["blocked"] = map[string]bool{"": true}
+	s.updateAllDataRecipients()
+
+	message := &DataMessage{Id: "1", Payload: []byte("hi")}
+	s.onRelayData(clients["alice"], message)
+
+	// The same message coming round again over another trunk
+	s.onRelayData(clients["alice"], message)
+
+	want := map[string]int{"alice": 0, "bob": 1, "blocked": 0, "elsewhere": 0}
+	for id, count := range want {
+		if got := len(clients[id].received); got != count {
+			t.Errorf("%s got %d messages, want %d", id, got, count)
+		}
+	}
+
+	// Once bob's gone from the room he's gone from the relay too
+	r := s.rooms["kitchen"]
+	r.removeClient(clients["bob"])
+	s.updateDataRecipients(r)
+
+	s.onRelayData(clients["alice"], &DataMessage{Id: "2", Payload: []byte("hi again")})
+	if got := len(clients["bob"].received); got != 1 {
+		t.Errorf("bob got %d messages after leaving, want still 1", got)
+	}
+}
+
+func TestRelayDataDropsWhenQueueFull(t *testing.T) {
+	// No handler at all, so anything going through the SFU's queue would panic
+	s := newTestDataSfu()
+	from := &dataRecipient{BaseClient: BaseClient{id: "trunk", room: "kitchen"}}
+
+	flood := dataRelayQueueLength + 500
+	for i := 0; i < flood; i++ {
+		s.relayData(from, &DataMessage{Id: fmt.Sprint(i)})
+	}
+
+	if got := len(s.data.queue); got != dataRelayQueueLength {
+		t.Errorf("got %d queued, want %d", got, dataRelayQueueLength)
+	}
+
+	if got := s.metrics.dataMessagesDropped.Load(); got != 500 {
+		t.Errorf("got %d dropped, want 500", got)
+	}
+}
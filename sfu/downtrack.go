@@ -0,0 +1,386 @@
+package sfu
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"atomirex.com/umbrella/razor"
+	"github.com/google/uuid"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// Don't ask the publisher for keyframes more often than this while waiting to switch layer
+const downTrackKeyframeRequestInterval = time.Second
+
+// A single subscriber's copy of an incoming track
+// Each subscriber gets its own local track so it can be sent a different simulcast layer from everyone else,
+// with sequence numbers and timestamps rewritten so they stay continuous across layer switches
+type downTrack struct {
+	source *incomingTrack
+	local  *relayTrackLocal
+
+	label  string
+	logger *razor.Logger
+
+	// Nothing gets through to the subscriber until this is connected, nil to not wait for it
+	transport *webrtc.DTLSTransport
+
+	mutex sync.Mutex
+
+	preferredLayer string // Asked for by the subscriber, "" means pick automatically
+	currentLayer   string // The layer being forwarded, only meaningful once started
+	started        bool
+
+	// Set from the subscriber's bandwidth estimate
+	maxLayer string // The best layer that fits, "" means no limit
+	paused   bool   // Nothing fits so nothing is forwarded
+	resuming bool   // Unpaused, so must restart cleanly on a keyframe
+
+	hidden bool // Not one of the last n speakers, so nothing is forwarded
+
+	lastKeyframeRequest time.Time
+
+	// Added to the source values to get what is sent
+	seqOffset uint16
+	tsOffset  uint32
+
+	lastSeq     uint16
+	lastTs      uint32
+	lastWriteAt time.Time
+}
+
+func newDownTrack(source *incomingTrack, logger *razor.Logger, label string) (*downTrack, error) {
+	local, err := webrtc.NewTrackLocalStaticRTP(source.codec, "UMB_RELAY"+uuid.New().String(), source.descriptor.StreamId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &downTrack{
+		source: source,
+		local:  &relayTrackLocal{TrackLocalStaticRTP: local},
+		label:  label,
+		logger: logger,
+	}, nil
+}
+
+func (d *downTrack) setPreferredLayer(rid string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.preferredLayer = rid
+}
+
+func (d *downTrack) getLayers() (current string, preferred string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.currentLayer, d.preferredLayer
+}
+
+func (d *downTrack) getAllocation() (maxLayer string, paused bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.maxLayer, d.paused
+}
+
+func (d *downTrack) setAllocation(maxLayer string, paused bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.paused && !paused {
+		d.resuming = true
+	}
+
+	if d.maxLayer != maxLayer || d.paused != paused {
+		d.logger.Verbose(d.label, "Allocation for "+d.source.String()+" now max layer "+maxLayer+" paused "+strconv.FormatBool(paused))
+	}
+
+	d.maxLayer = maxLayer
+	d.paused = paused
+}
+
+func (d *downTrack) isHidden() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.hidden
+}
+
+func (d *downTrack) setHidden(hidden bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.hidden == hidden {
+		return
+	}
+
+	d.logger.Verbose(d.label, "Last n now has "+d.source.String()+" hidden "+strconv.FormatBool(hidden))
+	d.hidden = hidden
+
+	if hidden {
+		return
+	}
+
+	d.resuming = true
+
+	// Ask straight away rather than waiting for the next packet, so they appear as soon as they're speaking
+	if !d.paused && canDetectKeyframes(d.source.codec.MimeType) {
+		d.lastKeyframeRequest = time.Now()
+		d.source.requestKeyframe(d.targetLayer())
+	}
+}
+
+// The subscriber lost something and can't carry on decoding without a keyframe
+func (d *downTrack) keyframeRequested() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.paused || d.hidden {
+		return
+	}
+
+	// Still waiting to start or switch, which asks for its own
+	if !d.started || d.resuming || d.currentLayer != d.targetLayer() {
+		return
+	}
+
+	d.source.requestKeyframe(d.currentLayer)
+}
+
+// The layers the subscriber would take, best first, which skips any better than the one it asked for
+func (d *downTrack) wantedLayers() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	layers := d.source.getRankedLayers()
+
+	if index := layerIndex(layers, d.preferredLayer); d.preferredLayer != "" && index >= 0 {
+		return layers[index:]
+	}
+
+	return layers
+}
+
+// The layer this subscriber should be getting right now, must be called with the lock held
+func (d *downTrack) targetLayer() string {
+	layers := d.source.getRankedLayers()
+	if len(layers) == 0 {
+		return ""
+	}
+
+	target := 0
+
+	if index := layerIndex(layers, d.preferredLayer); d.preferredLayer != "" && index >= 0 {
+		target = index
+	}
+
+	// Never better than the bandwidth allows
+	if index := layerIndex(layers, d.maxLayer); d.maxLayer != "" && index > target {
+		target = index
+	}
+
+	return layers[target]
+}
+
+func layerIndex(layers []string, rid string) int {
+	for i, layer := range layers {
+		if layer == rid {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Switching between simulcast layers, or starting again after a pause, mid frame would corrupt the video, so wait for a keyframe
+func (d *downTrack) needsKeyframeToSwitch() bool {
+	return (d.source.isSimulcast() || d.resuming) && canDetectKeyframes(d.source.codec.MimeType)
+}
+
+func (d *downTrack) writeRTP(rid string, pkt *rtp.Packet) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.paused || d.hidden {
+		return
+	}
+
+	// Whatever is sent before then is lost, and with it the chance to start from the cached keyframe
+	if !d.started && !d.canSend() {
+		return
+	}
+
+	if !d.started || d.resuming || rid != d.currentLayer {
+		// Keep forwarding the current layer until the target one can take over
+		if rid != d.targetLayer() {
+			return
+		}
+
+		if !d.started && d.replayCachedGop(rid, pkt) {
+			// Carries straight on from the replay
+		} else {
+			if d.needsKeyframeToSwitch() && !isKeyframe(d.source.codec.MimeType, pkt.Payload) {
+				if time.Since(d.lastKeyframeRequest) >= downTrackKeyframeRequestInterval {
+					d.lastKeyframeRequest = time.Now()
+					d.source.requestKeyframe(rid)
+				}
+				return
+			}
+
+			d.switchLayer(rid, pkt)
+		}
+	}
+
+	d.forward(pkt, pkt.Timestamp+d.tsOffset)
+}
+
+// Must be called with the lock held
+func (d *downTrack) forward(pkt *rtp.Packet, timestamp uint32) {
+	out := rtp.Packet{Header: pkt.Header, Payload: pkt.Payload}
+	out.SequenceNumber = pkt.SequenceNumber + d.seqOffset
+	out.Timestamp = timestamp
+
+	// The level goes out with whichever id was agreed with this subscriber
+	if id := d.local.audioLevelID.Load(); id != 0 {
+		if level, exists := d.source.levels.extension(); exists {
+			if extension, err := level.Marshal(); err == nil {
+				_ = out.SetExtension(uint8(id), extension)
+			}
+		}
+	}
+
+	d.lastSeq = out.SequenceNumber
+	d.lastTs = out.Timestamp
+	d.lastWriteAt = time.Now()
+
+	if err := d.local.WriteRTP(&out); err != nil {
+		d.source.writeErrors.Add(1)
+		d.logger.Verbose(d.label, "Error writing rtp from "+d.source.String()+" to down track "+err.Error())
+		return
+	}
+
+	d.source.packetsOut.Add(1)
+	d.source.bytesOut.Add(uint64(out.MarshalSize()))
+}
+
+// Must be called with the lock held
+func (d *downTrack) canSend() bool {
+	if !d.local.bound.Load() {
+		return false
+	}
+
+	return d.transport == nil || d.transport.State() == webrtc.DTLSTransportStateConnected
+}
+
+// Starts a new subscriber with everything since the layer's last keyframe, so the picture appears now rather than
+// whenever the next keyframe turns up. The frames are squeezed into the ticks just before the live packet so the
+// subscriber catches up at once instead of playing them back behind real time. Must be called with the lock held
+func (d *downTrack) replayCachedGop(rid string, live *rtp.Packet) bool {
+	cached := d.source.cachedGop(rid)
+	if len(cached) == 0 || cached[len(cached)-1].SequenceNumber+1 != live.SequenceNumber {
+		return false
+	}
+
+	// Nothing to catch up on if it's starting with a new keyframe anyway, but the rest of the one cached has to be sent
+	if startsGop(d.source.codec.MimeType, live, cached) {
+		return false
+	}
+
+	// Counting back a tick for each frame from the live one
+	timestamps := make([]uint32, len(cached))
+	frameTimestamp, back := live.Timestamp, uint32(0)
+	for i := len(cached) - 1; i >= 0; i-- {
+		if cached[i].Timestamp != frameTimestamp {
+			frameTimestamp = cached[i].Timestamp
+			back++
+		}
+
+		timestamps[i] = live.Timestamp + d.tsOffset - back
+	}
+
+	d.logger.Verbose(d.label, "Replaying "+strconv.Itoa(len(cached))+" cached packets of "+d.source.String()+" layer "+rid)
+
+	for i, pkt := range cached {
+		d.forward(pkt, timestamps[i])
+	}
+
+	d.started = true
+	d.resuming = false
+	d.currentLayer = rid
+
+	return true
+}
+
+// Must be called with the lock held
+func (d *downTrack) switchLayer(rid string, pkt *rtp.Packet) {
+	if d.started {
+		d.logger.Info(d.label, "Switching "+d.source.String()+" from layer "+d.currentLayer+" to "+rid)
+
+		// Carry on from where the previous layer, or this one before a pause, got to, advancing the timestamp by the real time since
+		ticks := uint32(time.Since(d.lastWriteAt).Seconds() * float64(d.source.codec.ClockRate))
+		if ticks == 0 {
+			ticks = 1
+		}
+
+		d.seqOffset = d.lastSeq + 1 - pkt.SequenceNumber
+		d.tsOffset = d.lastTs + ticks - pkt.Timestamp
+	}
+
+	d.started = true
+	d.resuming = false
+	d.currentLayer = rid
+}
+
+// Finds out which header extension ids the subscriber agreed to when the sender is bound
+type relayTrackLocal struct {
+	*webrtc.TrackLocalStaticRTP
+
+	audioLevelID atomic.Uint32
+
+	// Each is only ever put on one sender
+	bound atomic.Bool
+}
+
+func (t *relayTrackLocal) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	t.audioLevelID.Store(uint32(headerExtensionID(ctx.HeaderExtensions(), sdp.AudioLevelURI)))
+
+	codec, err := t.TrackLocalStaticRTP.Bind(ctx)
+	if err == nil {
+		t.bound.Store(true)
+	}
+
+	return codec, err
+}
+
+func (t *relayTrackLocal) Unbind(ctx webrtc.TrackLocalContext) error {
+	t.bound.Store(false)
+
+	return t.TrackLocalStaticRTP.Unbind(ctx)
+}
+
+// Reads what the subscriber sends back about a sender until it stops, which the interceptors need to see anyway
+func readSenderRTCP(sender *webrtc.RTPSender, onKeyframeRequest func()) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+
+		for _, packet := range packets {
+			switch packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				onKeyframeRequest()
+			}
+		}
+	}
+}
+
+func (d *downTrack) detach() {
+	d.source.removeSink(d)
+}
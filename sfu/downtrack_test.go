@@ -0,0 +1,382 @@
+package sfu
+
+import (
+	"bytes"
+	"slices"
+	"sync"
+	"testing"
+
+	"atomirex.com/umbrella/razor"
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Stands in for the peer connection a down track is bound to, keeping what would have been sent
+type capturedTrack struct {
+	codec webrtc.RTPCodecCapability
+
+	mutex   sync.Mutex
+	packets []*rtp.Packet
+}
+
+func (c *capturedTrack) CodecParameters() []webrtc.RTPCodecParameters {
+	return []webrtc.RTPCodecParameters{{RTPCodecCapability: c.codec, PayloadType: 96}}
+}
+
+func (c *capturedTrack) HeaderExtensions() []webrtc.RTPHeaderExtensionParameter { return nil }
+func (c *capturedTrack) SSRC() webrtc.SSRC                                      { return 1234 }
+func (c *capturedTrack) SSRCRetransmission() webrtc.SSRC                        { return 0 }
+func (c *capturedTrack) SSRCForwardErrorCorrection() webrtc.SSRC                { return 0 }
+func (c *capturedTrack) WriteStream() webrtc.TrackLocalWriter                   { return c }
+func (c *capturedTrack) ID() string                                             { return "captured" }
+func (c *capturedTrack) RTCPReader() interceptor.RTCPReader                     { return nil }
+
+func (c *capturedTrack) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.packets = append(c.packets, &rtp.Packet{Header: header.Clone(), Payload: bytes.Clone(payload)})
+	return len(payload), nil
+}
+
+func (c *capturedTrack) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (c *capturedTrack) sent() []*rtp.Packet {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.packets
+}
+
+// A down track of the source which is bound and sending, as it is once the subscriber has connected
+func newTestDownTrack(t *testing.T, source *incomingTrack) (*downTrack, *capturedTrack) {
+	d, err := newDownTrack(source, razor.NewLogger(razor.LogLevelError, false), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	captured := &capturedTrack{codec: source.codec}
+	if _, err := d.local.Bind(captured); err != nil {
+		t.Fatal(err)
+	}
+
+	source.addSink(d)
+
+	return d, captured
+}
+
+func TestDownTrackReplaysCachedGop(t *testing.T) {
+	tests := []struct {
+		name      string
+		before    [][]byte // Sent before the subscriber joins, a new timestamp every time the payload is nil
+		live      []byte   // The first packet the subscriber sees itself
+		liveNewTs bool
+		wantFirst []byte
+		wantSent  int
+	}{
+		{
+			name:      "from the sps when joining mid gop",
+			before:    [][]byte{h264STAPA, h264IDRStart, h264IDRMiddle, h264IDREnd, nil, h264Slice},
+			live:      h264Slice,
+			liveNewTs: true,
+			wantFirst: h264STAPA,
+			wantSent:  6,
+		},
+		{
+			name:      "from the sps when joining on a later slice of the keyframe",
+			before:    [][]byte{h264STAPA, h264IDRStart, h264IDREnd},
+			live:      h264IDRStart,
+			wantFirst: h264STAPA,
+			wantSent:  4,
+		},
+		{
+			name:      "nothing replayed when joining on a new keyframe",
+			before:    [][]byte{h264STAPA, h264IDRStart, h264IDREnd, nil, h264Slice},
+			live:      h264STAPA,
+			liveNewTs: true,
+			wantFirst: h264STAPA,
+			wantSent:  1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			it := newTestVideoTrack(webrtc.MimeTypeH264)
+
+			seq, timestamp := uint16(65530), uint32(9000)
+			for _, payload := range test.before {
+				if payload == nil {
+					timestamp += 3000
+					continue
+				}
+
+				it.writeRTP("", h264Packet(seq, timestamp, payload))
+				seq++
+			}
+
+			_, captured := newTestDownTrack(t, it)
+
+			if test.liveNewTs {
+				timestamp += 3000
+			}
+
+			it.writeRTP("", h264Packet(seq, timestamp, test.live))
+
+			sent := captured.sent()
+			if len(sent) != test.wantSent {
+				t.Fatalf("got %d packets sent, want %d", len(sent), test.wantSent)
+			}
+
+			if !bytes.Equal(sent[0].Payload, test.wantFirst) {
+				t.Errorf("first packet sent is %x, want %x", sent[0].Payload, test.wantFirst)
+			}
+
+			for i := 1; i < len(sent); i++ {
+				if sent[i].SequenceNumber != sent[i-1].SequenceNumber+1 {
+					t.Errorf("sequence numbers jump from %d to %d", sent[i-1].SequenceNumber, sent[i].SequenceNumber)
+				}
+
+				if int32(sent[i].Timestamp-sent[i-1].Timestamp) < 0 {
+					t.Errorf("timestamps go back from %d to %d", sent[i-1].Timestamp, sent[i].Timestamp)
+				}
+			}
+
+			// Squeezed up to the live packet, which goes out as it came in
+			last := sent[len(sent)-1]
+			if last.SequenceNumber != seq || last.Timestamp != timestamp {
+				t.Errorf("live packet went out as %d/%d, want %d/%d", last.SequenceNumber, last.Timestamp, seq, timestamp)
+			}
+		})
+	}
+}
+
+func TestDownTrackWaitsUntilBound(t *testing.T) {
+	it := newTestVideoTrack(webrtc.MimeTypeH264)
+
+	d, err := newDownTrack(it, razor.NewLogger(razor.LogLevelError, false), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	it.addSink(d)
+
+	// Sent while the subscriber is still negotiating, so would be lost
+	it.writeRTP("", h264Packet(1, 100, h264STAPA))
+	it.writeRTP("", h264Packet(2, 100, h264IDRStart))
+
+	captured := &capturedTrack{codec: it.codec}
+	if _, err := d.local.Bind(captured); err != nil {
+		t.Fatal(err)
+	}
+
+	it.writeRTP("", h264Packet(3, 3100, h264Slice))
+
+	sent := captured.sent()
+	if len(sent) != 3 || !bytes.Equal(sent[0].Payload, h264STAPA) {
+		t.Fatalf("got %d packets starting %x, want the cached keyframe then the slice", len(sent), sent[0].Payload)
+	}
+}
+
+var (
+	vp8Keyframe   = []byte{0x10, 0x00, 0x9D}
+	vp8Interframe = []byte{0x10, 0x01, 0x00}
+)
+
+func vp8Packet(seq uint16, timestamp uint32, payload []byte) *rtp.Packet {
+	return &rtp.Packet{
+		Header:  rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: timestamp},
+		Payload: payload,
+	}
+}
+
+// A VP8 track with the layers given, keeping which layers the publisher was asked for keyframes on
+func newTestSimulcastTrack(rids ...string) (*incomingTrack, *[]string) {
+	it := newIncomingTrack(&TrackDescriptor{UmbrellaId: "video", StreamId: "stream", Kind: TrackKind_Video}, "room")
+	it.codec = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+
+	for _, rid := range rids {
+		it.addLayer(rid)
+	}
+
+	requested := make([]string, 0)
+	it.keyframeRequester = func(rid string) {
+		requested = append(requested, rid)
+	}
+
+	return it, &requested
+}
+
+func TestDownTrackSwitchesLayers(t *testing.T) {
+	it, requested := newTestSimulcastTrack("h", "l")
+	d, captured := newTestDownTrack(t, it)
+
+	// Each layer numbers its packets and frames from somewhere different
+	steps := []struct {
+		rid         string
+		seq         uint16
+		timestamp   uint32
+		payload     []byte
+		preferLayer string
+		wantSent    bool
+	}{
+		{rid: "l", seq: 5000, timestamp: 100000, payload: vp8Interframe, wantSent: false}, // Not the best layer
+		{rid: "h", seq: 100, timestamp: 9000, payload: vp8Interframe, wantSent: false},    // Can't start mid frame
+		{rid: "h", seq: 101, timestamp: 12000, payload: vp8Keyframe, wantSent: true},      // Starts here
+		{rid: "h", seq: 102, timestamp: 15000, payload: vp8Interframe, wantSent: true},
+		{rid: "h", seq: 103, timestamp: 18000, payload: vp8Interframe, preferLayer: "l", wantSent: true}, // Carries on until l can take over
+		{rid: "l", seq: 5001, timestamp: 103000, payload: vp8Interframe, wantSent: false},                // Waits for a keyframe to switch
+		{rid: "l", seq: 5002, timestamp: 106000, payload: vp8Keyframe, wantSent: true},                   // Switches here
+		{rid: "h", seq: 104, timestamp: 21000, payload: vp8Interframe, wantSent: false},                  // No longer wanted
+		{rid: "l", seq: 5003, timestamp: 109000, payload: vp8Interframe, wantSent: true},
+	}
+
+	wantPayloads := make([][]byte, 0)
+	for _, step := range steps {
+		if step.preferLayer != "" {
+			d.setPreferredLayer(step.preferLayer)
+		}
+
+		it.writeRTP(step.rid, vp8Packet(step.seq, step.timestamp, step.payload))
+
+		if step.wantSent {
+			wantPayloads = append(wantPayloads, step.payload)
+		}
+	}
+
+	sent := captured.sent()
+	if len(sent) != len(wantPayloads) {
+		t.Fatalf("got %d packets sent, want %d", len(sent), len(wantPayloads))
+	}
+
+	for i := range sent {
+		if !bytes.Equal(sent[i].Payload, wantPayloads[i]) {
+			t.Errorf("packet %d is %x, want %x", i, sent[i].Payload, wantPayloads[i])
+		}
+
+		if i == 0 {
+			continue
+		}
+
+		if sent[i].SequenceNumber != sent[i-1].SequenceNumber+1 {
+			t.Errorf("sequence numbers jump from %d to %d", sent[i-1].SequenceNumber, sent[i].SequenceNumber)
+		}
+
+		if diff := int32(sent[i].Timestamp - sent[i-1].Timestamp); diff <= 0 || diff > 90000 {
+			t.Errorf("timestamps go from %d to %d", sent[i-1].Timestamp, sent[i].Timestamp)
+		}
+	}
+
+	// Frames on the same layer keep their spacing
+	if last := sent[len(sent)-1].Timestamp - sent[len(sent)-2].Timestamp; last != 3000 {
+		t.Errorf("got %d ticks between frames after switching, want 3000", last)
+	}
+
+	if current, _ := d.getLayers(); current != "l" {
+		t.Errorf("forwarding layer %q, want l", current)
+	}
+
+	if len(*requested) == 0 || (*requested)[0] != "h" {
+		t.Errorf("got keyframe requests %v, want one for h first", *requested)
+	}
+}
+
+func TestDownTrackAllocation(t *testing.T) {
+	tests := []struct {
+		name      string
+		preferred string
+		maxLayer  string
+		want      string
+	}{
+		{name: "best by default", want: "f"},
+		{name: "preferred", preferred: "h", want: "h"},
+		{name: "capped by bandwidth", maxLayer: "h", want: "h"},
+		{name: "bandwidth below preferred", preferred: "h", maxLayer: "q", want: "q"},
+		{name: "preferred below bandwidth", preferred: "q", maxLayer: "h", want: "q"},
+		{name: "unknown preferred", preferred: "x", want: "f"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			it, _ := newTestSimulcastTrack("q", "h", "f")
+			d, _ := newTestDownTrack(t, it)
+
+			d.setPreferredLayer(test.preferred)
+			d.setAllocation(test.maxLayer, false)
+
+			d.mutex.Lock()
+			got := d.targetLayer()
+			d.mutex.Unlock()
+
+			if got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDownTrackResumesOnKeyframe(t *testing.T) {
+	it, _ := newTestSimulcastTrack("")
+	d, captured := newTestDownTrack(t, it)
+
+	it.writeRTP("", vp8Packet(1, 3000, vp8Keyframe))
+	it.writeRTP("", vp8Packet(2, 6000, vp8Interframe))
+
+	d.setAllocation("", true)
+	it.writeRTP("", vp8Packet(3, 9000, vp8Interframe))
+
+	// Without simulcast it would carry straight on, but after a gap it has to be from a keyframe
+	d.setAllocation("", false)
+	it.writeRTP("", vp8Packet(4, 12000, vp8Interframe))
+	it.writeRTP("", vp8Packet(5, 15000, vp8Keyframe))
+
+	sent := captured.sent()
+	if len(sent) != 3 {
+		t.Fatalf("got %d packets sent, want 3", len(sent))
+	}
+
+	if !bytes.Equal(sent[2].Payload, vp8Keyframe) || sent[2].SequenceNumber != sent[1].SequenceNumber+1 {
+		t.Errorf("resumed with %x as %d after %d", sent[2].Payload, sent[2].SequenceNumber, sent[1].SequenceNumber)
+	}
+}
+
+func TestDownTrackKeyframeRequested(t *testing.T) {
+	it, requested := newTestSimulcastTrack("h", "l")
+	d, _ := newTestDownTrack(t, it)
+
+	// Each step is well apart from the last as far as the publisher's throttling goes
+	steps := []struct {
+		name          string
+		change        func()
+		wantRequested []string
+	}{
+		{name: "not started", wantRequested: []string{}},
+		{name: "sending", change: func() { it.writeRTP("h", vp8Packet(1, 3000, vp8Keyframe)) }, wantRequested: []string{"h"}},
+		{name: "hidden", change: func() { d.setHidden(true) }, wantRequested: []string{}},
+		{name: "shown again", change: func() {
+			d.setHidden(false)
+			it.writeRTP("h", vp8Packet(2, 6000, vp8Keyframe))
+		}, wantRequested: []string{"h"}},
+		{name: "switching down", change: func() { d.setAllocation("l", false) }, wantRequested: []string{}},
+		{name: "switched", change: func() { it.writeRTP("l", vp8Packet(900, 90000, vp8Keyframe)) }, wantRequested: []string{"l"}},
+		{name: "paused", change: func() { d.setAllocation("l", true) }, wantRequested: []string{}},
+	}
+
+	for _, step := range steps {
+		if step.change != nil {
+			step.change()
+		}
+
+		*requested = (*requested)[:0]
+		it.keyframeMutex.Lock()
+		clear(it.lastKeyframeRequests)
+		it.keyframeMutex.Unlock()
+
+		d.keyframeRequested()
+
+		if !slices.Equal(*requested, step.wantRequested) {
+			t.Errorf("%s asked for %v, want %v", step.name, *requested, step.wantRequested)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package sfu
+
+import (
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Whether isKeyframe understands the codec, for anything else we can't wait for keyframes
+func canDetectKeyframes(mimeType string) bool {
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8), strings.ToLower(webrtc.MimeTypeVP9), strings.ToLower(webrtc.MimeTypeH264):
+		return true
+	}
+
+	return false
+}
+
+// Reports if the RTP payload is the first packet of a keyframe, so forwarding can start from it cleanly
+func isKeyframe(mimeType string, payload []byte) bool {
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		return isVP8Keyframe(payload)
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		return isVP9Keyframe(payload)
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return isH264Keyframe(payload)
+	}
+
+	return false
+}
+
+// RFC 7741 payload descriptor followed by the VP8 frame header
+func isVP8Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+
+	extended := payload[0]&0x80 != 0
+	startOfPartition := payload[0]&0x10 != 0
+	partitionIndex := payload[0] & 0x07
+
+	if !startOfPartition || partitionIndex != 0 {
+		return false
+	}
+
+	offset := 1
+	if extended {
+		if len(payload) < 2 {
+			return false
+		}
+
+		hasPictureID := payload[1]&0x80 != 0
+		hasTL0PicIdx := payload[1]&0x40 != 0
+		hasTID := payload[1]&0x20 != 0
+		hasKeyIdx := payload[1]&0x10 != 0
+		offset++
+
+		if hasPictureID {
+			if len(payload) <= offset {
+				return false
+			}
+
+			// 15 bit picture ids have the top bit set
+			if payload[offset]&0x80 != 0 {
+				offset += 2
+			} else {
+				offset++
+			}
+		}
+
+		if hasTL0PicIdx {
+			offset++
+		}
+
+		if hasTID || hasKeyIdx {
+			offset++
+		}
+	}
+
+	if len(payload) <= offset {
+		return false
+	}
+
+	// The P bit of the frame tag is 0 for keyframes
+	return payload[offset]&0x01 == 0
+}
+
+// draft-ietf-payload-vp9 descriptor, a keyframe is the start of a frame which isn't predicted from another
+func isVP9Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+
+	interPicturePredicted := payload[0]&0x40 != 0
+	startOfFrame := payload[0]&0x08 != 0
+
+	return !interPicturePredicted && startOfFrame
+}
+
+const (
+	h264NaluIDR   = 5
+	h264NaluSPS   = 7
+	h264NaluSTAPA = 24
+	h264NaluFUA   = 28
+)
+
+// RFC 6184, looking for an IDR slice or the SPS which comes before one
+func isH264Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+
+	naluType := payload[0] & 0x1F
+
+	switch naluType {
+	case h264NaluIDR, h264NaluSPS:
+		return true
+	case h264NaluSTAPA:
+		offset := 1
+		for offset+2 < len(payload) {
+			size := int(payload[offset])<<8 | int(payload[offset+1])
+			offset += 2
+
+			if offset >= len(payload) {
+				return false
+			}
+
+			innerType := payload[offset] & 0x1F
+			if innerType == h264NaluIDR || innerType == h264NaluSPS {
+				return true
+			}
+
+			offset += size
+		}
+	case h264NaluFUA:
+		if len(payload) < 2 {
+			return false
+		}
+
+		isStart := payload[1]&0x80 != 0
+		innerType := payload[1] & 0x1F
+
+		return isStart && (innerType == h264NaluIDR || innerType == h264NaluSPS)
+	}
+
+	return false
+}
@@ -0,0 +1,59 @@
+package sfu
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestIsKeyframe(t *testing.T) {
+	tests := []struct {
+		name     string
+		mimeType string
+		payload  []byte
+		want     bool
+	}{
+		// VP8, the descriptor's S bit and partition 0, then the frame tag's P bit
+		{name: "vp8 keyframe", mimeType: webrtc.MimeTypeVP8, payload: []byte{0x10, 0x00}, want: true},
+		{name: "vp8 interframe", mimeType: webrtc.MimeTypeVP8, payload: []byte{0x10, 0x01}, want: false},
+		{name: "vp8 not start of partition", mimeType: webrtc.MimeTypeVP8, payload: []byte{0x00, 0x00}, want: false},
+		{name: "vp8 later partition", mimeType: webrtc.MimeTypeVP8, payload: []byte{0x11, 0x00}, want: false},
+		{name: "vp8 7 bit picture id", mimeType: webrtc.MimeTypeVP8, payload: []byte{0x90, 0x80, 0x12, 0x00}, want: true},
+		{name: "vp8 15 bit picture id", mimeType: webrtc.MimeTypeVP8, payload: []byte{0x90, 0x80, 0x81, 0x23, 0x00}, want: true},
+		{name: "vp8 15 bit picture id interframe", mimeType: webrtc.MimeTypeVP8, payload: []byte{0x90, 0x80, 0x81, 0x23, 0x01}, want: false},
+		{name: "vp8 all extensions", mimeType: webrtc.MimeTypeVP8, payload: []byte{0x90, 0xF0, 0x81, 0x23, 0x05, 0x40, 0x00}, want: true},
+		{name: "vp8 truncated descriptor", mimeType: webrtc.MimeTypeVP8, payload: []byte{0x90, 0x80, 0x81}, want: false},
+		{name: "vp8 empty", mimeType: webrtc.MimeTypeVP8, payload: []byte{}, want: false},
+
+		// VP9, not inter picture predicted and the start of a frame
+		{name: "vp9 keyframe", mimeType: webrtc.MimeTypeVP9, payload: []byte{0x08}, want: true},
+		{name: "vp9 predicted", mimeType: webrtc.MimeTypeVP9, payload: []byte{0x48}, want: false},
+		{name: "vp9 not start of frame", mimeType: webrtc.MimeTypeVP9, payload: []byte{0x00}, want: false},
+		{name: "vp9 empty", mimeType: webrtc.MimeTypeVP9, payload: nil, want: false},
+
+		// H264
+		{name: "h264 idr", mimeType: webrtc.MimeTypeH264, payload: []byte{0x65}, want: true},
+		{name: "h264 sps", mimeType: webrtc.MimeTypeH264, payload: []byte{0x67}, want: true},
+		{name: "h264 non idr slice", mimeType: webrtc.MimeTypeH264, payload: []byte{0x41}, want: false},
+		{name: "h264 stap-a with sps", mimeType: webrtc.MimeTypeH264, payload: []byte{0x78, 0x00, 0x02, 0x67, 0x42, 0x00, 0x01, 0x68}, want: true},
+		{name: "h264 stap-a without", mimeType: webrtc.MimeTypeH264, payload: []byte{0x78, 0x00, 0x02, 0x41, 0x00, 0x00, 0x01, 0x41}, want: false},
+		{name: "h264 stap-a truncated", mimeType: webrtc.MimeTypeH264, payload: []byte{0x78, 0x00, 0x09}, want: false},
+		{name: "h264 fu-a idr start", mimeType: webrtc.MimeTypeH264, payload: []byte{0x7C, 0x85}, want: true},
+		{name: "h264 fu-a idr middle", mimeType: webrtc.MimeTypeH264, payload: []byte{0x7C, 0x05}, want: false},
+		{name: "h264 fu-a non idr start", mimeType: webrtc.MimeTypeH264, payload: []byte{0x7C, 0x81}, want: false},
+		{name: "h264 fu-a truncated", mimeType: webrtc.MimeTypeH264, payload: []byte{0x7C}, want: false},
+
+		// Anything else can't be told apart
+		{name: "mime type case", mimeType: "video/vp8", payload: []byte{0x10, 0x00}, want: true},
+		{name: "opus", mimeType: webrtc.MimeTypeOpus, payload: []byte{0x10, 0x00}, want: false},
+		{name: "unknown", mimeType: "video/AV1", payload: []byte{0x65}, want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isKeyframe(test.mimeType, test.payload); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
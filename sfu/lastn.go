@@ -0,0 +1,98 @@
+package sfu
+
+import (
+	"maps"
+	"slices"
+)
+
+// In big rooms only the video of the last n people to speak is forwarded to each subscriber, going by the order
+// from the speaker detection, while audio always is. Video from a stream with no audio, like a camera or a shared
+// screen, doesn't take part and is always forwarded. The rest keep their senders but are paused, like video that
+// doesn't fit the bandwidth, so nothing has to be renegotiated when the speakers change
+
+// Where n for a room comes from, 0 forwarding everything
+type LastNPolicy struct {
+	Default int
+	Rooms   map[string]int // Room -> n, overriding the default
+}
+
+// Applies to every client on its next bandwidth allocation, within a second
+func (s *Sfu) SetLastNPolicy(policy LastNPolicy) {
+	s.lastNMutex.Lock()
+	defer s.lastNMutex.Unlock()
+
+	policy.Rooms = maps.Clone(policy.Rooms)
+	s.lastN = policy
+}
+
+func (s *Sfu) getLastN(room string) int {
+	s.lastNMutex.Lock()
+	defer s.lastNMutex.Unlock()
+
+	if n, exists := s.lastN.Rooms[room]; exists {
+		return n
+	}
+
+	return s.lastN.Default
+}
+
+// The umbrellaIds of the video tracks this client shouldn't be getting right now
+func (c *client) hiddenVideo(s *Sfu) map[string]bool {
+	hidden := make(map[string]bool)
+
+	n := c.lastN
+	if n < 0 {
+		n = s.getLastN(c.room)
+	}
+
+	// Other nodes pick for their own subscribers, so need everything
+	if n == 0 || c.isKnownNode() {
+		return hidden
+	}
+
+	ranked := make([]string, 0)
+	if c.activeSpeakers != nil {
+		for _, umbrellaId := range c.activeSpeakers.Recent {
+			if ot, exists := c.outgoingTracks[umbrellaId]; exists && ot.source.descriptor.Kind == TrackKind_Audio {
+				ranked = append(ranked, umbrellaId)
+			}
+		}
+	}
+
+	// Audio too new for the ranking goes last until the next one
+	newcomers := make([]string, 0)
+	for umbrellaId, ot := range c.outgoingTracks {
+		if ot.source.descriptor.Kind == TrackKind_Audio && !slices.Contains(ranked, umbrellaId) {
+			newcomers = append(newcomers, umbrellaId)
+		}
+	}
+	slices.Sort(newcomers)
+	ranked = append(ranked, newcomers...)
+
+	// Stream ID -> whether any of its audio is in the last n
+	visibleStreams := make(map[string]bool)
+	for i, umbrellaId := range ranked {
+		streamId := c.outgoingTracks[umbrellaId].source.descriptor.StreamId
+		visibleStreams[streamId] = visibleStreams[streamId] || i < n
+	}
+
+	for umbrellaId, ot := range c.outgoingTracks {
+		if ot.source.descriptor.Kind != TrackKind_Video {
+			continue
+		}
+
+		if visible, hasAudio := visibleStreams[ot.source.descriptor.StreamId]; hasAudio && !visible {
+			hidden[umbrellaId] = true
+		}
+	}
+
+	return hidden
+}
+
+func (c *client) applyLastN(s *Sfu) {
+	hidden := c.hiddenVideo(s)
+
+	for umbrellaId, dt := range c.downTracks {
+		dt.setHidden(hidden[umbrellaId])
+	}
+}
@@ -0,0 +1,67 @@
+package sfu
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestHiddenVideo(t *testing.T) {
+	// Three people with a camera each, and a shared screen with no audio
+	tracks := []*TrackDescriptor{
+		{UmbrellaId: "mic1", StreamId: "s1", Kind: TrackKind_Audio},
+		{UmbrellaId: "cam1", StreamId: "s1", Kind: TrackKind_Video},
+		{UmbrellaId: "mic2", StreamId: "s2", Kind: TrackKind_Audio},
+		{UmbrellaId: "cam2", StreamId: "s2", Kind: TrackKind_Video},
+		{UmbrellaId: "mic3", StreamId: "s3", Kind: TrackKind_Audio},
+		{UmbrellaId: "cam3", StreamId: "s3", Kind: TrackKind_Video},
+		{UmbrellaId: "screen", StreamId: "s4", Kind: TrackKind_Video},
+	}
+
+	speaking := &ActiveSpeakers{Dominant: "mic2", Recent: []string{"mic2", "mic1", "mic3"}}
+
+	tests := []struct {
+		name        string
+		policy      LastNPolicy
+		clientN     int
+		speakers    *ActiveSpeakers
+		permissions clientPermissions
+		helloFrom   string
+		wantHidden  []string
+	}{
+		{name: "everything", clientN: -1, speakers: speaking, wantHidden: []string{}},
+		{name: "default", policy: LastNPolicy{Default: 1}, clientN: -1, speakers: speaking, wantHidden: []string{"cam1", "cam3"}},
+		{name: "room", policy: LastNPolicy{Default: 1, Rooms: map[string]int{"kitchen": 2}}, clientN: -1, speakers: speaking, wantHidden: []string{"cam3"}},
+		{name: "other room", policy: LastNPolicy{Rooms: map[string]int{"garden": 1}}, clientN: -1, speakers: speaking, wantHidden: []string{}},
+		{name: "asked for by the client", policy: LastNPolicy{Default: 3}, clientN: 1, speakers: speaking, wantHidden: []string{"cam1", "cam3"}},
+		{name: "nobody ranked yet", clientN: 1, wantHidden: []string{"cam2", "cam3"}},
+		{name: "trusted node", clientN: 1, speakers: speaking, permissions: trunkPermissions, helloFrom: "node", wantHidden: []string{}},
+		{name: "node without a secret", clientN: 1, speakers: speaking, permissions: allPermissions, helloFrom: "node", wantHidden: []string{"cam1", "cam3"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &Sfu{}
+			s.SetLastNPolicy(test.policy)
+
+			c := newTestClient(s, test.permissions)
+			c.lastN = test.clientN
+			c.activeSpeakers = test.speakers
+			c.remoteNodeId = test.helloFrom
+			c.outgoingTracks = make(map[string]*outgoingTrackWithClientState)
+
+			for _, descriptor := range tracks {
+				c.outgoingTracks[descriptor.UmbrellaId] = &outgoingTrackWithClientState{source: newIncomingTrack(descriptor, "kitchen")}
+			}
+
+			hidden := make([]string, 0)
+			for umbrellaId := range c.hiddenVideo(s) {
+				hidden = append(hidden, umbrellaId)
+			}
+			slices.Sort(hidden)
+
+			if !slices.Equal(hidden, test.wantHidden) {
+				t.Errorf("got hidden %v, want %v", hidden, test.wantHidden)
+			}
+		})
+	}
+}
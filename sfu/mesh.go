@@ -0,0 +1,74 @@
+package sfu
+
+import (
+	"slices"
+	"time"
+)
+
+// Trunks can be wired in any topology, including loops and redundant links, so each track carries where it
+// has been. A track is never offered to a node already on its hop path, a node refuses one which has been
+// through it before, and a room only takes a track from one place at a time. Refused tracks are offered
+// again now and then, so when the link a room was getting a track over goes the track comes back another way
+
+// How long before a track the remote refused is offered to it again
+const rejectedTrackRetryInterval = 10 * time.Second
+
+type trackClaimKey struct {
+	room       string
+	umbrellaId string
+}
+
+// Must be called before serving, by default the node id is random for every run
+func (s *Sfu) SetNodeID(nodeId string) {
+	s.nodeId = nodeId
+}
+
+func (s *Sfu) NodeID() string {
+	return s.nodeId
+}
+
+// Whether the track has already passed through this node, so accepting it would be a loop
+func (s *Sfu) hasVisited(td *TrackDescriptor) bool {
+	return slices.Contains(td.HopPath, s.nodeId)
+}
+
+// Adds this node to the hop path of a track arriving here, from another node if fromNode
+// Anything that isn't a node is publishing its own tracks, so whatever it said about their origin is dropped
+func (s *Sfu) stampArrival(td *TrackDescriptor, fromNode bool) {
+	if !fromNode || td.OriginNodeId == "" {
+		td.OriginNodeId = s.nodeId
+		td.HopPath = nil
+	}
+
+	td.HopPath = append(td.HopPath, s.nodeId)
+}
+
+// Whether a track should be offered to the node at the other end of a trunk, empty if not a node
+func canForwardTo(td *TrackDescriptor, remoteNodeId string) bool {
+	return remoteNodeId == "" || !slices.Contains(td.HopPath, remoteNodeId)
+}
+
+// Reserves the track's umbrellaId in its room, failing if something else already provides it
+// The claim lasts until the SFU removes the track
+func (s *Sfu) claimTrack(intrack *incomingTrack) bool {
+	s.trackClaimMutex.Lock()
+	defer s.trackClaimMutex.Unlock()
+
+	key := trackClaimKey{room: intrack.room, umbrellaId: intrack.UmbrellaID()}
+	if owner, claimed := s.trackClaims[key]; claimed && owner != intrack {
+		return false
+	}
+
+	s.trackClaims[key] = intrack
+	return true
+}
+
+func (s *Sfu) releaseTrack(intrack *incomingTrack) {
+	s.trackClaimMutex.Lock()
+	defer s.trackClaimMutex.Unlock()
+
+	key := trackClaimKey{room: intrack.room, umbrellaId: intrack.UmbrellaID()}
+	if s.trackClaims[key] == intrack {
+		delete(s.trackClaims, key)
+	}
+}
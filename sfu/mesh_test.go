@@ -0,0 +1,172 @@
+package sfu
+
+import (
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// One end of a trunk between two nodes
+type testTrunkEnd struct {
+	node   *Sfu
+	client *client
+	far    *testTrunkEnd
+}
+
+// Three nodes each dialling the next, a to b to c and back to a, without trunk secrets so the
+// end of each trunk which was dialled only has the hello to go on
+func newTestLoop(t *testing.T) map[string][]*testTrunkEnd {
+	nodes := make(map[string]*Sfu)
+	for _, nodeId := range []string{"a", "b", "c"} {
+		nodes[nodeId] = &Sfu{nodeId: nodeId, dataLimits: DefaultDataLimits(), data: newDataRelay()}
+	}
+
+	ends := make(map[string][]*testTrunkEnd)
+	link := func(from string, to string) {
+		dialling := &testTrunkEnd{node: nodes[from], client: newTestClient(nodes[from], allPermissions)}
+		dialling.client.id = from + " to " + to
+		dialling.client.trunkurl = "wss://" + to + "/ws"
+
+		dialled := &testTrunkEnd{node: nodes[to], client: newTestClient(nodes[to], allPermissions)}
+		dialled.client.id = to + " from " + from
+
+		dialling.far, dialled.far = dialled, dialling
+
+		for _, end := range []*testTrunkEnd{dialling, dialled} {
+			end.client.handleWsMessage(&RemoteNodeMessage{Hello: &NodeHello{NodeId: end.far.node.nodeId}}, end.node)
+			if failure := end.client.failure.get(); failure != "" {
+				t.Fatalf("%s failed on hello: %s", end.client.id, failure)
+			}
+
+			ends[end.node.nodeId] = append(ends[end.node.nodeId], end)
+		}
+	}
+
+	link("a", "b")
+	link("b", "c")
+	link("c", "a")
+
+	return ends
+}
+
+func TestTrackAroundThreeNodeLoop(t *testing.T) {
+	ends := newTestLoop(t)
+
+	// Published by a browser on a
+	td := &TrackDescriptor{UmbrellaId: "video", Kind: TrackKind_Video}
+	ends["a"][0].node.stampArrival(td, false)
+
+	type holding struct {
+		nodeId string
+		td     *TrackDescriptor
+	}
+
+	has := map[string]*TrackDescriptor{"a": td}
+	pending := []holding{{nodeId: "a", td: td}}
+
+	for steps := 0; len(pending) > 0; steps++ {
+		if steps > 10 {
+			t.Fatal("track keeps going round the loop")
+		}
+
+		h := pending[0]
+		pending = pending[1:]
+
+		for _, end := range ends[h.nodeId] {
+			if !canForwardTo(h.td, end.client.remoteNodeId) {
+				continue
+			}
+
+			far := end.far
+			if far.node.hasVisited(h.td) {
+				t.Errorf("%s offered %s back to a node it has been through, hop path %v", end.client.id, h.td.UmbrellaId, h.td.HopPath)
+				continue
+			}
+
+			// Already has it another way
+			if has[far.node.nodeId] != nil {
+				continue
+			}
+
+			arrived := proto.Clone(h.td).(*TrackDescriptor)
+			far.node.stampArrival(arrived, far.client.remoteNodeId != "")
+
+			has[far.node.nodeId] = arrived
+			pending = append(pending, holding{nodeId: far.node.nodeId, td: arrived})
+		}
+	}
+
+	for _, nodeId := range []string{"b", "c"} {
+		arrived := has[nodeId]
+		if arrived == nil {
+			t.Fatalf("%s never got the track", nodeId)
+		}
+
+		if arrived.OriginNodeId != "a" || arrived.HopPath[0] != "a" {
+			t.Errorf("%s thinks the track came from %s via %v", nodeId, arrived.OriginNodeId, arrived.HopPath)
+		}
+	}
+}
+
+func TestDataAroundThreeNodeLoop(t *testing.T) {
+	ends := newTestLoop(t)
+
+	a := ends["a"][0].node
+	browser := newTestClient(a, clientPermissions{identity: "alice", canPublish: true, canSubscribe: true})
+
+	message := a.receivedDataMessage(browser, []byte("hi"), true)
+	a.data.recent.check(message.Id)
+
+	type holding struct {
+		nodeId  string
+		message *DataMessage
+	}
+
+	delivered := make(map[string]int)
+	pending := []holding{{nodeId: "a", message: message}}
+
+	for steps := 0; len(pending) > 0; steps++ {
+		if steps > 10 {
+			t.Fatal("message keeps going round the loop")
+		}
+
+		h := pending[0]
+		pending = pending[1:]
+
+		for _, end := range ends[h.nodeId] {
+			if end.client.remoteHasData(h.message) {
+				continue
+			}
+
+			data, err := proto.Marshal(h.message)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			far := end.far
+			received := far.node.receivedDataMessage(far.client, data, true)
+			if received == nil || far.node.data.recent.check(received.Id) {
+				continue
+			}
+
+			if string(received.Payload) != "hi" {
+				t.Errorf("%s got payload %x, wrapped up again rather than passed on", far.client.id, received.Payload)
+			}
+
+			// Nothing at the other end proved it was a node, so can't say who the message is from
+			if received.FromIdentity == "alice" && !far.client.isTrunk() {
+				t.Errorf("%s believed who the message came from", far.client.id)
+			}
+
+			delivered[far.node.nodeId]++
+			pending = append(pending, holding{nodeId: far.node.nodeId, message: received})
+		}
+	}
+
+	want := map[string]int{"a": 0, "b": 1, "c": 1}
+	for nodeId, count := range want {
+		if delivered[nodeId] != count {
+			t.Errorf("%s got the message %d times, want %d", nodeId, delivered[nodeId], count)
+		}
+	}
+}
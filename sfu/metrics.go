@@ -0,0 +1,240 @@
+package sfu
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Prometheus metrics, written out in the text format by hand to avoid pulling in the client library on APs
+// Counters which outlive what they count are kept here, everything else is read from the rooms when scraped
+
+type sfuMetrics struct {
+	keyframeRequests atomic.Uint64 // PLIs sent to publishers, for any reason
+
+	dataMessagesRelayed atomic.Uint64
+	dataMessagesDropped atomic.Uint64 // Over the size or rate limits, or with the relay queue full
+
+	mutex              sync.Mutex
+	pcStateTransitions map[string]uint64 // Peer connection state -> times one has entered it
+}
+
+func newSfuMetrics() *sfuMetrics {
+	return &sfuMetrics{pcStateTransitions: make(map[string]uint64)}
+}
+
+func (m *sfuMetrics) peerConnectionStateChanged(pcs string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.pcStateTransitions[pcs]++
+}
+
+type trackMetrics struct {
+	umbrellaId string
+	room       string
+	kind       string
+
+	packetsIn   uint64
+	bytesIn     uint64
+	packetsOut  uint64
+	bytesOut    uint64
+	writeErrors uint64
+}
+
+type clientMetrics struct {
+	label       string
+	kind        string
+	queueLength int
+}
+
+// Gathered in the SFU goroutine, since that owns the rooms
+type metricsSnapshot struct {
+	clients []clientMetrics
+	tracks  []trackMetrics
+}
+
+func (s *Sfu) gatherMetrics() *metricsSnapshot {
+	snapshot := &metricsSnapshot{
+		clients: make([]clientMetrics, 0),
+		tracks:  make([]trackMetrics, 0),
+	}
+
+	for _, r := range s.rooms {
+		for _, c := range r.clients {
+			snapshot.clients = append(snapshot.clients, clientMetrics{
+				label:       c.Label(),
+				kind:        clientKind(c),
+				queueLength: c.queueLength(),
+			})
+		}
+
+		for _, t := range r.localTracks {
+			snapshot.tracks = append(snapshot.tracks, trackMetrics{
+				umbrellaId:  t.UmbrellaID(),
+				room:        t.room,
+				kind:        strings.ToLower(t.descriptor.Kind.String()),
+				packetsIn:   t.packetsIn.Load(),
+				bytesIn:     t.bytesIn.Load(),
+				packetsOut:  t.packetsOut.Load(),
+				bytesOut:    t.bytesOut.Load(),
+				writeErrors: t.writeErrors.Load(),
+			})
+		}
+	}
+
+	return snapshot
+}
+
+func clientKind(c RemoteClient) string {
+	switch c := c.(type) {
+	case *client:
+		if c.trunkurl != "" || c.permissions.fromTrunk {
+			return "trunk"
+		}
+		return "browser"
+	case *RtspClient:
+		return "rtsp"
+	case *WhipClient:
+		return "whip"
+	case *WhepClient:
+		return "whep"
+	}
+
+	return "unknown"
+}
+
+func (s *Sfu) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Names rooms and tracks, so with tokens on it takes an admin token like the API
+	if _, authorized := s.AuthorizeAdmin(w, r); !authorized {
+		return
+	}
+
+	sfuQueueLength := s.handler.Size()
+
+	msg := sfuCommandMessage{result: &sfuCommandResult{metrics: make(chan *metricsSnapshot, 1)}}
+	if !s.handler.Send(sfuGetMetrics, &msg) {
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	snapshot := <-msg.result.metrics
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	mw := &metricsWriter{w: w}
+
+	clientCounts := map[string]uint64{"browser": 0, "trunk": 0, "rtsp": 0, "whip": 0, "whep": 0}
+	for _, c := range snapshot.clients {
+		clientCounts[c.kind]++
+	}
+
+	mw.family("umbrella_clients", "gauge", "Connected clients by type")
+	for _, kind := range sortedKeys(clientCounts) {
+		mw.sample("umbrella_clients", clientCounts[kind], "type", kind)
+	}
+
+	trackCounts := map[string]uint64{"audio": 0, "video": 0}
+	for _, t := range snapshot.tracks {
+		trackCounts[t.kind]++
+	}
+
+	mw.family("umbrella_tracks", "gauge", "Relayed tracks by kind")
+	for _, kind := range sortedKeys(trackCounts) {
+		mw.sample("umbrella_tracks", trackCounts[kind], "kind", kind)
+	}
+
+	sort.Slice(snapshot.tracks, func(i, j int) bool {
+		return snapshot.tracks[i].umbrellaId < snapshot.tracks[j].umbrellaId
+	})
+
+	trackFamilies := []struct {
+		name  string
+		help  string
+		value func(t *trackMetrics) uint64
+	}{
+		{"umbrella_track_packets_in_total", "RTP packets received for a track", func(t *trackMetrics) uint64 { return t.packetsIn }},
+		{"umbrella_track_bytes_in_total", "RTP bytes received for a track", func(t *trackMetrics) uint64 { return t.bytesIn }},
+		{"umbrella_track_packets_out_total", "RTP packets sent for a track, over every subscriber", func(t *trackMetrics) uint64 { return t.packetsOut }},
+		{"umbrella_track_bytes_out_total", "RTP bytes sent for a track, over every subscriber", func(t *trackMetrics) uint64 { return t.bytesOut }},
+		{"umbrella_track_rtp_write_errors_total", "Failures writing a track's RTP to subscribers", func(t *trackMetrics) uint64 { return t.writeErrors }},
+	}
+
+	for _, family := range trackFamilies {
+		mw.family(family.name, "counter", family.help)
+		for i := range snapshot.tracks {
+			t := &snapshot.tracks[i]
+			mw.sample(family.name, family.value(t), "umbrella_id", t.umbrellaId, "room", t.room, "kind", t.kind)
+		}
+	}
+
+	mw.family("umbrella_keyframe_requests_total", "counter", "Keyframe requests (PLIs) sent to publishers")
+	mw.sample("umbrella_keyframe_requests_total", s.metrics.keyframeRequests.Load())
+
+	mw.family("umbrella_data_messages_relayed_total", "counter", "Data channel messages relayed to a room")
+	mw.sample("umbrella_data_messages_relayed_total", s.metrics.dataMessagesRelayed.Load())
+
+	mw.family("umbrella_data_messages_dropped_total", "counter", "Data channel messages from clients dropped for being over the size or rate limits")
+	mw.sample("umbrella_data_messages_dropped_total", s.metrics.dataMessagesDropped.Load())
+
+	s.metrics.mutex.Lock()
+	transitions := make(map[string]uint64, len(s.metrics.pcStateTransitions))
+	for state, count := range s.metrics.pcStateTransitions {
+		transitions[state] = count
+	}
+	s.metrics.mutex.Unlock()
+
+	mw.family("umbrella_peer_connection_state_transitions_total", "counter", "Peer connection state changes by the state entered")
+	for _, state := range sortedKeys(transitions) {
+		mw.sample("umbrella_peer_connection_state_transitions_total", transitions[state], "state", state)
+	}
+
+	mw.family("umbrella_queue_length", "gauge", "Messages waiting in a handler's queue, including scheduled ones")
+	mw.sample("umbrella_queue_length", uint64(sfuQueueLength), "handler", "sfu", "type", "sfu")
+	for _, c := range snapshot.clients {
+		mw.sample("umbrella_queue_length", uint64(c.queueLength), "handler", c.label, "type", c.kind)
+	}
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type metricsWriter struct {
+	w io.Writer
+}
+
+func (mw *metricsWriter) family(name string, metricType string, help string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// Labels are name, value pairs
+func (mw *metricsWriter) sample(name string, value uint64, labels ...string) {
+	if len(labels) == 0 {
+		fmt.Fprintf(mw.w, "%s %d\n", name, value)
+		return
+	}
+
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+"=\""+metricsLabelEscaper.Replace(labels[i+1])+"\"")
+	}
+
+	fmt.Fprintf(mw.w, "%s{%s} %d\n", name, strings.Join(pairs, ","), value)
+}
+
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
@@ -0,0 +1,57 @@
+package sfu
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"atomirex.com/umbrella/razor"
+)
+
+// An SFU with auth keys, and tokens for an admin and for someone who isn't
+func newTestAdminAuth(t *testing.T) (*Sfu, string, string) {
+	auth := NewAuthenticator(map[string][]byte{"main": []byte("mainsecret")}, nil)
+
+	admin, err := auth.Sign("main", &AccessClaims{Identity: "root", Admin: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := auth.Sign("main", &AccessClaims{Identity: "alice", CanPublish: true, CanSubscribe: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Sfu{auth: auth, logger: razor.NewLogger(razor.LoggingLevelOff, false)}, admin, user
+}
+
+func TestMetricsNeedsAdmin(t *testing.T) {
+	s, _, user := newTestAdminAuth(t)
+
+	tests := []struct {
+		name       string
+		token      string
+		wantStatus int
+	}{
+		{name: "no token", wantStatus: http.StatusUnauthorized},
+		{name: "bad token", token: "guess", wantStatus: http.StatusUnauthorized},
+		{name: "not an admin", token: user, wantStatus: http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if test.token != "" {
+				r.Header.Set("Authorization", "Bearer "+test.token)
+			}
+
+			// Refused before the SFU is asked for anything, since it has no handler here
+			w := httptest.NewRecorder()
+			s.MetricsHandler(w, r)
+
+			if w.Code != test.wantStatus {
+				t.Errorf("got status %d, want %d", w.Code, test.wantStatus)
+			}
+		})
+	}
+}
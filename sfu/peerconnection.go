@@ -1,7 +1,11 @@
 package sfu
 
 import (
+	"sync"
+
 	"atomirex.com/umbrella/razor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/stats"
 	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v4"
 )
@@ -11,6 +15,13 @@ type PeerConnection struct {
 	wrapped *webrtc.PeerConnection
 	logger  *razor.Logger
 
+	// Estimates what we can send the remote, from the TWCC feedback it gives us
+	estimator cc.BandwidthEstimator
+
+	statsGetter    stats.Getter
+	statsMutex     sync.Mutex
+	lastByteCounts map[string]byteCount // What the bitrates in the previous status were worked out from
+
 	OnICECandidate             func(w *webrtc.ICECandidate)
 	OnICEConnectionStateChange func(is webrtc.ICEConnectionState)
 	OnSignalingStateChange     func(ss webrtc.SignalingState)
@@ -27,19 +38,49 @@ type PionPeerConnectionFactory struct {
 	webrtcApi *webrtc.API
 	pcConfig  *webrtc.Configuration
 	logger    *razor.Logger
+
+	metrics *sfuMetrics
+
+	// Asked every time as TURN credentials expire, overriding the ICE servers in pcConfig when set
+	iceServers func() []webrtc.ICEServer
+
+	// The congestion controller and stats interceptor hand over their parts while the pion peer connection
+	// is being created so creation is serialized to know which peer connection they belong to
+	creationMutex      sync.Mutex
+	pendingEstimator   cc.BandwidthEstimator
+	pendingStatsGetter stats.Getter
+}
+
+func (p *PionPeerConnectionFactory) onNewEstimator(id string, estimator cc.BandwidthEstimator) {
+	p.pendingEstimator = estimator
 }
 
 func (p *PionPeerConnectionFactory) NewPeerConnection(label string) (*PeerConnection, error) {
-	pc, err := p.webrtcApi.NewPeerConnection(*p.pcConfig)
+	config := *p.pcConfig
+	if p.iceServers != nil {
+		config.ICEServers = p.iceServers()
+	}
+
+	p.creationMutex.Lock()
+	p.pendingEstimator = nil
+	p.pendingStatsGetter = nil
+	pc, err := p.webrtcApi.NewPeerConnection(config)
+	estimator, statsGetter := p.pendingEstimator, p.pendingStatsGetter
+	p.pendingEstimator = nil
+	p.pendingStatsGetter = nil
+	p.creationMutex.Unlock()
 
 	if err != nil {
 		return nil, err
 	}
 
 	newPc := &PeerConnection{
-		label:   label,
-		wrapped: pc,
-		logger:  p.logger,
+		label:          label,
+		wrapped:        pc,
+		logger:         p.logger,
+		estimator:      estimator,
+		statsGetter:    statsGetter,
+		lastByteCounts: make(map[string]byteCount),
 	}
 
 	pc.OnICECandidate(func(i *webrtc.ICECandidate) {
@@ -65,6 +106,9 @@ func (p *PionPeerConnectionFactory) NewPeerConnection(label string) (*PeerConnec
 
 	pc.OnConnectionStateChange(func(pcs webrtc.PeerConnectionState) {
 		p.logger.Info(label, "OnConnectionStateChange"+pcs.String())
+		if p.metrics != nil {
+			p.metrics.peerConnectionStateChanged(pcs.String())
+		}
 		if newPc.OnConnectionStateChange != nil {
 			newPc.OnConnectionStateChange(pcs)
 		}
@@ -87,8 +131,9 @@ func (p *PionPeerConnectionFactory) NewPeerConnection(label string) (*PeerConnec
 	return newPc, nil
 }
 
-func (pc *PeerConnection) GetStatus() *SFUStatusPeerConnection {
-	return &SFUStatusPeerConnection{
+// umbrellaIDFor labels the track stats, and can be nil
+func (pc *PeerConnection) GetStatus(umbrellaIDFor func(t *webrtc.RTPTransceiver) string) *SFUStatusPeerConnection {
+	status := &SFUStatusPeerConnection{
 		ConnectionState:    pc.wrapped.ConnectionState().String(),
 		SignalingState:     pc.wrapped.SignalingState().String(),
 		IceConnectionState: pc.wrapped.ICEConnectionState().String(),
@@ -98,6 +143,19 @@ func (pc *PeerConnection) GetStatus() *SFUStatusPeerConnection {
 		SenderCount:      int32(len(pc.wrapped.GetSenders())),
 		ReceiverCount:    int32(len(pc.wrapped.GetReceivers())),
 	}
+
+	pc.addStats(status, umbrellaIDFor)
+
+	return status
+}
+
+// Bits per second, or 0 if there is no estimate
+func (pc *PeerConnection) TargetBitrate() int {
+	if pc.estimator == nil {
+		return 0
+	}
+
+	return pc.estimator.GetTargetBitrate()
 }
 
 func (pc *PeerConnection) Close() error {
@@ -165,6 +223,14 @@ func (pc *PeerConnection) SetLocalDescription(description webrtc.SessionDescript
 	return pc.wrapped.SetLocalDescription(description)
 }
 
+func (pc *PeerConnection) LocalDescription() *webrtc.SessionDescription {
+	return pc.wrapped.LocalDescription()
+}
+
+func (pc *PeerConnection) GatheringCompletePromise() <-chan struct{} {
+	return webrtc.GatheringCompletePromise(pc.wrapped)
+}
+
 func (pc *PeerConnection) AddTrack(track webrtc.TrackLocal) (*webrtc.RTPSender, error) {
 	return pc.wrapped.AddTrack(track)
 }
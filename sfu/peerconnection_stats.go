@@ -0,0 +1,174 @@
+package sfu
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/webrtc/v4"
+)
+
+// Stats for the status page, from pion's GetStats for the ICE side and the stats interceptor for RTP,
+// with bitrates worked out from how far the byte counts moved since the previous status
+
+type byteCount struct {
+	bytes uint64
+	at    time.Time
+}
+
+func (p *PionPeerConnectionFactory) onNewStatsGetter(id string, getter stats.Getter) {
+	p.pendingStatsGetter = getter
+}
+
+// Bits per second since the count for key was last seen, 0 the first time or if it went backwards
+// Must hold statsMutex
+func (pc *PeerConnection) bitrate(key string, bytes uint64, now time.Time) int64 {
+	last, exists := pc.lastByteCounts[key]
+	pc.lastByteCounts[key] = byteCount{bytes: bytes, at: now}
+
+	elapsed := now.Sub(last.at).Seconds()
+	if !exists || bytes < last.bytes || elapsed <= 0 {
+		return 0
+	}
+
+	return int64(float64(bytes-last.bytes) * 8 / elapsed)
+}
+
+func (pc *PeerConnection) addStats(status *SFUStatusPeerConnection, umbrellaIDFor func(t *webrtc.RTPTransceiver) string) {
+	report := pc.wrapped.GetStats()
+	now := time.Now()
+
+	pc.statsMutex.Lock()
+	defer pc.statsMutex.Unlock()
+
+	if transport, ok := report["iceTransport"].(webrtc.TransportStats); ok {
+		status.BytesSent = transport.BytesSent
+		status.BytesReceived = transport.BytesReceived
+		status.SendBitrate = pc.bitrate("sent", transport.BytesSent, now)
+		status.ReceiveBitrate = pc.bitrate("received", transport.BytesReceived, now)
+	}
+
+	status.SelectedCandidatePair = selectedCandidatePair(report)
+
+	status.Tracks = make([]*SFUStatusTrackStats, 0)
+
+	if pc.statsGetter == nil {
+		return
+	}
+
+	for _, t := range pc.wrapped.GetTransceivers() {
+		umbrellaId := ""
+		if umbrellaIDFor != nil {
+			umbrellaId = umbrellaIDFor(t)
+		}
+
+		kind := TrackKind_Audio
+		if t.Kind() == webrtc.RTPCodecTypeVideo {
+			kind = TrackKind_Video
+		}
+
+		if r := t.Receiver(); r != nil {
+			for _, remote := range r.Tracks() {
+				ssrc := uint32(remote.SSRC())
+				if ssrc == 0 {
+					continue
+				}
+
+				s := pc.statsGetter.Get(ssrc)
+				if s == nil {
+					continue
+				}
+
+				trackStats := &SFUStatusTrackStats{
+					UmbrellaId:      umbrellaId,
+					Mid:             t.Mid(),
+					Rid:             remote.RID(),
+					Ssrc:            ssrc,
+					Kind:            kind,
+					Packets:         s.InboundRTPStreamStats.PacketsReceived,
+					Bytes:           s.InboundRTPStreamStats.BytesReceived,
+					Bitrate:         pc.bitrate(fmt.Sprintf("in%d", ssrc), s.InboundRTPStreamStats.BytesReceived, now),
+					PacketsLost:     s.InboundRTPStreamStats.PacketsLost,
+					RoundTripTimeMs: durationMs(s.RemoteOutboundRTPStreamStats.RoundTripTime),
+					NackCount:       s.InboundRTPStreamStats.NACKCount,
+					PliCount:        s.InboundRTPStreamStats.PLICount,
+					FirCount:        s.InboundRTPStreamStats.FIRCount,
+				}
+
+				// Inbound jitter is kept in RTP timestamp units
+				if clockRate := remote.Codec().ClockRate; clockRate > 0 {
+					trackStats.JitterMs = s.InboundRTPStreamStats.Jitter * 1000 / float64(clockRate)
+				}
+
+				status.Tracks = append(status.Tracks, trackStats)
+			}
+		}
+
+		if sender := t.Sender(); sender != nil && sender.Track() != nil {
+			for _, encoding := range sender.GetParameters().Encodings {
+				ssrc := uint32(encoding.SSRC)
+
+				s := pc.statsGetter.Get(ssrc)
+				if s == nil {
+					continue
+				}
+
+				status.Tracks = append(status.Tracks, &SFUStatusTrackStats{
+					UmbrellaId:      umbrellaId,
+					Mid:             t.Mid(),
+					Rid:             encoding.RID,
+					Ssrc:            ssrc,
+					Kind:            kind,
+					Outbound:        true,
+					Packets:         s.OutboundRTPStreamStats.PacketsSent,
+					Bytes:           s.OutboundRTPStreamStats.BytesSent,
+					Bitrate:         pc.bitrate(fmt.Sprintf("out%d", ssrc), s.OutboundRTPStreamStats.BytesSent, now),
+					PacketsLost:     s.RemoteInboundRTPStreamStats.PacketsLost,
+					JitterMs:        s.RemoteInboundRTPStreamStats.Jitter * 1000,
+					FractionLost:    s.RemoteInboundRTPStreamStats.FractionLost,
+					RoundTripTimeMs: durationMs(s.RemoteInboundRTPStreamStats.RoundTripTime),
+					NackCount:       s.OutboundRTPStreamStats.NACKCount,
+					PliCount:        s.OutboundRTPStreamStats.PLICount,
+					FirCount:        s.OutboundRTPStreamStats.FIRCount,
+				})
+			}
+		}
+	}
+}
+
+// The pair ICE nominated, or nil before there is one
+func selectedCandidatePair(report webrtc.StatsReport) *SFUStatusCandidatePair {
+	for _, s := range report {
+		pair, ok := s.(webrtc.ICECandidatePairStats)
+		if !ok || !pair.Nominated || pair.State != webrtc.StatsICECandidatePairStateSucceeded {
+			continue
+		}
+
+		return &SFUStatusCandidatePair{
+			Local:           candidateStatus(report, pair.LocalCandidateID),
+			Remote:          candidateStatus(report, pair.RemoteCandidateID),
+			RoundTripTimeMs: pair.CurrentRoundTripTime * 1000,
+		}
+	}
+
+	return nil
+}
+
+func candidateStatus(report webrtc.StatsReport, id string) *SFUStatusCandidate {
+	candidate, ok := report[id].(webrtc.ICECandidateStats)
+	if !ok {
+		return nil
+	}
+
+	return &SFUStatusCandidate{
+		Type:          candidate.CandidateType.String(),
+		Address:       candidate.IP,
+		Port:          candidate.Port,
+		Protocol:      candidate.Protocol,
+		RelayProtocol: candidate.RelayProtocol,
+	}
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,309 @@
+package sfu
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"atomirex.com/umbrella/razor"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/h264writer"
+	"github.com/pion/webrtc/v4/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+)
+
+var ErrRecordingDisabled = errors.New("recording is not enabled")
+var ErrTrackNotFound = errors.New("track not found")
+var ErrUnsupportedCodec = errors.New("codec can't be recorded")
+
+// Packets waiting to be written, beyond this they are dropped rather than holding up the fanout
+const recorderQueueLength = 512
+
+// Don't ask the publisher for keyframes more often than this while waiting to start
+const recorderKeyframeRequestInterval = time.Second
+
+type mediaWriter interface {
+	WriteRTP(pkt *rtp.Packet) error
+	Close() error
+}
+
+// Writes one incoming track to a file, as another sink alongside the subscribers
+// Simulcast tracks record the best layer available when the recording starts, and stay on it
+type recorder struct {
+	source    *incomingTrack
+	path      string
+	startedAt time.Time
+
+	label  string
+	logger *razor.Logger
+
+	writer  mediaWriter
+	packets chan *rtp.Packet
+	done    chan struct{} // Closed once the file is finished
+
+	mutex               sync.Mutex
+	layer               string
+	started             bool
+	lastKeyframeRequest time.Time
+
+	packetsWritten atomic.Int64
+	packetsDropped atomic.Int64
+}
+
+func newRecorder(dir string, source *incomingTrack, logger *razor.Logger) (*recorder, error) {
+	writerFactory, extension, err := mediaWriterFor(source.codec)
+	if err != nil {
+		return nil, err
+	}
+
+	roomDir := filepath.Join(dir, safeFileName(source.room))
+	if err := os.MkdirAll(roomDir, 0755); err != nil {
+		return nil, err
+	}
+
+	startedAt := time.Now()
+	path := filepath.Join(roomDir, startedAt.Format("20060102-150405")+"-"+safeFileName(source.UmbrellaID())+"."+extension)
+
+	writer, err := writerFactory(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &recorder{
+		source:    source,
+		path:      path,
+		startedAt: startedAt,
+		label:     "recorder " + source.UmbrellaID(),
+		logger:    logger,
+		writer:    writer,
+		packets:   make(chan *rtp.Packet, recorderQueueLength),
+		done:      make(chan struct{}),
+	}
+
+	go r.run()
+
+	source.addSink(r)
+
+	logger.Info(r.label, "Recording "+source.String()+" to "+path)
+
+	return r, nil
+}
+
+// Picks the file format for the codec, returning a way to make the writer and the file extension
+func mediaWriterFor(codec webrtc.RTPCodecCapability) (func(path string) (mediaWriter, error), string, error) {
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		channels := codec.Channels
+		if channels == 0 {
+			channels = 2
+		}
+
+		return func(path string) (mediaWriter, error) {
+			return oggwriter.New(path, codec.ClockRate, channels)
+		}, "ogg", nil
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		return func(path string) (mediaWriter, error) {
+			return ivfwriter.New(path, ivfwriter.WithCodec(webrtc.MimeTypeVP8))
+		}, "ivf", nil
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		return func(path string) (mediaWriter, error) {
+			return newVP9IVFWriter(path)
+		}, "ivf", nil
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return func(path string) (mediaWriter, error) {
+			return h264writer.New(path)
+		}, "h264", nil
+	}
+
+	return nil, "", fmt.Errorf("%w: %s", ErrUnsupportedCodec, codec.MimeType)
+}
+
+func (r *recorder) writeRTP(rid string, pkt *rtp.Packet) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.started {
+		layers := r.source.getRankedLayers()
+		if len(layers) == 0 || rid != layers[0] {
+			return
+		}
+
+		// Starting mid frame gives a file which won't play until the next keyframe, if at all
+		if canDetectKeyframes(r.source.codec.MimeType) && !isKeyframe(r.source.codec.MimeType, pkt.Payload) {
+			if time.Since(r.lastKeyframeRequest) >= recorderKeyframeRequestInterval {
+				r.lastKeyframeRequest = time.Now()
+				r.source.requestKeyframe(rid)
+			}
+			return
+		}
+
+		r.started = true
+		r.layer = rid
+	}
+
+	if rid != r.layer {
+		return
+	}
+
+	// The packet buffer is reused once this returns
+	clone := &rtp.Packet{Header: pkt.Header.Clone(), Payload: append([]byte(nil), pkt.Payload...)}
+
+	select {
+	case r.packets <- clone:
+	default:
+		r.packetsDropped.Add(1)
+	}
+}
+
+func (r *recorder) run() {
+	for pkt := range r.packets {
+		if err := r.writer.WriteRTP(pkt); err != nil {
+			r.logger.Verbose(r.label, "Error writing packet "+err.Error())
+			continue
+		}
+
+		r.packetsWritten.Add(1)
+	}
+
+	r.logger.NilErrCheck(r.label, "Error closing "+r.path, r.writer.Close())
+	r.logger.Info(r.label, "Finished recording to "+r.path)
+
+	close(r.done)
+}
+
+func (r *recorder) stop() {
+	// Once removed the sink is never called again, so closing the queue is safe
+	r.source.removeSink(r)
+	close(r.packets)
+}
+
+func (r *recorder) getStatus() *SFUStatusRecording {
+	r.mutex.Lock()
+	layer := r.layer
+	r.mutex.Unlock()
+
+	return &SFUStatusRecording{
+		UmbrellaId:     r.source.UmbrellaID(),
+		Room:           r.source.room,
+		Path:           r.path,
+		MimeType:       r.source.codec.MimeType,
+		Layer:          layer,
+		StartedAt:      r.startedAt.UnixMilli(),
+		PacketsWritten: r.packetsWritten.Load(),
+		PacketsDropped: r.packetsDropped.Load(),
+	}
+}
+
+// Keeps names to the same boring characters as room ids, and never just dots
+func safeFileName(name string) string {
+	safe := strings.Map(func(ch rune) rune {
+		isAlphaNumeric := (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9')
+		if isAlphaNumeric || ch == '-' || ch == '_' || ch == '.' {
+			return ch
+		}
+		return '_'
+	}, name)
+
+	if strings.Trim(safe, ".") == "" {
+		safe = "_" + safe
+	}
+
+	return safe
+}
+
+// pion's ivfwriter only does VP8 and AV1, so VP9 frames are assembled and written here
+type vp9IVFWriter struct {
+	file *os.File
+
+	frame          []byte
+	frameCount     uint32
+	firstTimestamp uint32
+	seenFirst      bool
+}
+
+func newVP9IVFWriter(path string) (*vp9IVFWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 32)
+	copy(header[0:], "DKIF")
+	binary.LittleEndian.PutUint16(header[4:], 0)      // Version
+	binary.LittleEndian.PutUint16(header[6:], 32)     // Header size
+	copy(header[8:], "VP90")                          // FOURCC
+	binary.LittleEndian.PutUint16(header[12:], 640)   // Width, the decoder gets the real one from the stream
+	binary.LittleEndian.PutUint16(header[14:], 480)   // Height
+	binary.LittleEndian.PutUint32(header[16:], 90000) // Timebase denominator, the RTP clock
+	binary.LittleEndian.PutUint32(header[20:], 1)     // Timebase numerator
+	binary.LittleEndian.PutUint32(header[24:], 0)     // Frame count, filled in on close
+
+	if _, err := file.Write(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &vp9IVFWriter{file: file}, nil
+}
+
+func (w *vp9IVFWriter) WriteRTP(pkt *rtp.Packet) error {
+	vp9Packet := codecs.VP9Packet{}
+	if _, err := vp9Packet.Unmarshal(pkt.Payload); err != nil {
+		return err
+	}
+
+	if vp9Packet.B {
+		w.frame = w.frame[:0]
+	} else if len(w.frame) == 0 {
+		// Missed the start of this frame
+		return nil
+	}
+
+	w.frame = append(w.frame, vp9Packet.Payload...)
+
+	if !pkt.Marker {
+		return nil
+	}
+
+	if !w.seenFirst {
+		w.seenFirst = true
+		w.firstTimestamp = pkt.Timestamp
+	}
+
+	frameHeader := make([]byte, 12)
+	binary.LittleEndian.PutUint32(frameHeader[0:], uint32(len(w.frame)))
+	binary.LittleEndian.PutUint64(frameHeader[4:], uint64(pkt.Timestamp-w.firstTimestamp))
+
+	if _, err := w.file.Write(frameHeader); err != nil {
+		return err
+	}
+
+	if _, err := w.file.Write(w.frame); err != nil {
+		return err
+	}
+
+	w.frameCount++
+	w.frame = w.frame[:0]
+
+	return nil
+}
+
+func (w *vp9IVFWriter) Close() error {
+	count := make([]byte, 4)
+	binary.LittleEndian.PutUint32(count, w.frameCount)
+
+	if _, err := w.file.WriteAt(count, 24); err != nil {
+		w.file.Close()
+		return err
+	}
+
+	return w.file.Close()
+}
@@ -0,0 +1,164 @@
+package sfu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"atomirex.com/umbrella/razor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Stops the recorder and waits for the file to be finished, returning what is in it
+func finishRecording(t *testing.T, r *recorder) []byte {
+	r.stop()
+	<-r.done
+
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestRecorderStartsOnKeyframe(t *testing.T) {
+	it, requested := newTestSimulcastTrack("q", "f")
+	dir := t.TempDir()
+
+	r, err := newRecorder(dir, it, razor.NewLogger(razor.LoggingLevelOff, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if filepath.Dir(r.path) != filepath.Join(dir, "room") || filepath.Ext(r.path) != ".ivf" {
+		t.Errorf("recording to %s", r.path)
+	}
+
+	frame := func(rid string, seq uint16, payload []byte) {
+		pkt := vp8Packet(seq, uint32(seq)*3000, payload)
+		pkt.Marker = true
+		it.writeRTP(rid, pkt)
+	}
+
+	frame("q", 1, vp8Keyframe)   // Not the best layer
+	frame("f", 1, vp8Interframe) // Would start mid stream
+	frame("f", 2, vp8Keyframe)
+	frame("f", 3, vp8Interframe)
+	frame("q", 2, vp8Interframe)
+
+	data := finishRecording(t, r)
+
+	status := r.getStatus()
+	if status.PacketsWritten != 2 || status.Layer != "f" {
+		t.Errorf("wrote %d packets of layer %q, want 2 of f", status.PacketsWritten, status.Layer)
+	}
+
+	if len(*requested) == 0 || (*requested)[0] != "f" {
+		t.Errorf("got keyframe requests %v, want one for f", *requested)
+	}
+
+	if !bytes.HasPrefix(data, []byte("DKIF")) {
+		t.Fatalf("file starts %q, want an IVF header", data[:min(len(data), 4)])
+	}
+
+	if frames := binary.LittleEndian.Uint32(data[24:]); frames != 2 {
+		t.Errorf("file has %d frames, want 2", frames)
+	}
+}
+
+func TestVP9IVFWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.ivf")
+
+	w, err := newVP9IVFWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packets := []*rtp.Packet{
+		{Header: rtp.Header{Timestamp: 1000}, Payload: []byte{0x04, 0x01}},               // End of a frame it missed the start of
+		{Header: rtp.Header{Timestamp: 4000}, Payload: []byte{0x08, 0xAA, 0xBB}},         // Start of a frame
+		{Header: rtp.Header{Timestamp: 4000, Marker: true}, Payload: []byte{0x04, 0xCC}}, // and the end
+		{Header: rtp.Header{Timestamp: 7000, Marker: true}, Payload: []byte{0x0C, 0xDD}}, // A frame in one packet
+	}
+
+	for _, pkt := range packets {
+		if err := w.WriteRTP(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data[8:12]) != "VP90" || binary.LittleEndian.Uint32(data[24:]) != 2 {
+		t.Fatalf("got header %x", data[:32])
+	}
+
+	// Each frame is its size, its timestamp from the first, then the frame
+	want := []byte{3, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xAA, 0xBB, 0xCC}
+	want = append(want, 1, 0, 0, 0, 0xB8, 0x0B, 0, 0, 0, 0, 0, 0, 0xDD)
+	if !bytes.Equal(data[32:], want) {
+		t.Errorf("got frames %x, want %x", data[32:], want)
+	}
+}
+
+func TestMediaWriterFor(t *testing.T) {
+	tests := []struct {
+		mimeType      string
+		wantExtension string
+	}{
+		{mimeType: webrtc.MimeTypeOpus, wantExtension: "ogg"},
+		{mimeType: webrtc.MimeTypeVP8, wantExtension: "ivf"},
+		{mimeType: webrtc.MimeTypeVP9, wantExtension: "ivf"},
+		{mimeType: webrtc.MimeTypeH264, wantExtension: "h264"},
+		{mimeType: "video/vp8", wantExtension: "ivf"},
+		{mimeType: webrtc.MimeTypeAV1},
+		{mimeType: webrtc.MimeTypeG722},
+	}
+
+	for _, test := range tests {
+		t.Run(test.mimeType, func(t *testing.T) {
+			_, extension, err := mediaWriterFor(webrtc.RTPCodecCapability{MimeType: test.mimeType, ClockRate: 90000})
+			if test.wantExtension == "" {
+				if !errors.Is(err, ErrUnsupportedCodec) {
+					t.Errorf("got error %v, want unsupported", err)
+				}
+				return
+			}
+
+			if err != nil || extension != test.wantExtension {
+				t.Errorf("got %s and %v, want %s", extension, err, test.wantExtension)
+			}
+		})
+	}
+}
+
+func TestSafeFileName(t *testing.T) {
+	tests := map[string]string{
+		"kitchen":     "kitchen",
+		"video_1-a.b": "video_1-a.b",
+		"../../etc":   ".._.._etc",
+		"a b/c\\d":    "a_b_c_d",
+		"..":          "_..",
+		"":            "_",
+		"{abc-123}":   "_abc-123_",
+		"café":        "caf_",
+	}
+
+	for name, want := range tests {
+		if got := safeFileName(name); got != want {
+			t.Errorf("%q got %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package sfu
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// Clients that don't ask for a room all end up together in this one
+const defaultRoomID = "default"
+
+const maxRoomIDLength = 64
+
+// A room is the unit of fan out, tracks published in a room are only relayed to clients in the same room
+type room struct {
+	id      string
+	clients []RemoteClient
+
+	// UmbrellaID -> track
+	localTracks map[string]*incomingTrack // Set of all incoming tracks which are being relayed in this room
+
+	speakers *speakerDetector
+}
+
+func newRoom(id string) *room {
+	return &room{
+		id:          id,
+		clients:     make([]RemoteClient, 0),
+		localTracks: make(map[string]*incomingTrack),
+		speakers:    newSpeakerDetector(),
+	}
+}
+
+func (r *room) isEmpty() bool {
+	return len(r.clients) == 0 && len(r.localTracks) == 0
+}
+
+func (r *room) removeClient(c RemoteClient) {
+	index := -1
+	for i, rc := range r.clients {
+		if rc == c {
+			index = i
+		}
+	}
+
+	if index >= 0 {
+		r.clients = append(r.clients[:index], r.clients[index+1:]...)
+	}
+}
+
+// Room IDs end up in urls and logs, so keep them to a boring set of characters
+func validateRoomID(id string) (string, error) {
+	if id == "" {
+		return defaultRoomID, nil
+	}
+
+	if len(id) > maxRoomIDLength {
+		return "", fmt.Errorf("room id longer than %d characters", maxRoomIDLength)
+	}
+
+	for _, ch := range id {
+		isAlphaNumeric := (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9')
+		if !isAlphaNumeric && ch != '-' && ch != '_' && ch != '.' {
+			return "", fmt.Errorf("room id contains invalid character %q", ch)
+		}
+	}
+
+	return id, nil
+}
+
+// The room is passed as the "room" query parameter on the websocket url, for both browsers and trunks
+func roomIDFromQuery(query url.Values) (string, error) {
+	return validateRoomID(query.Get("room"))
+}
+
+// Trunks join the room named in their url, so both ends of the trunk agree on it
+func roomIDFromTrunkURL(trunkurl string) string {
+	u, err := url.Parse(trunkurl)
+	if err != nil {
+		return defaultRoomID
+	}
+
+	id, err := roomIDFromQuery(u.Query())
+	if err != nil {
+		return defaultRoomID
+	}
+
+	return id
+}
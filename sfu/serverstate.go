@@ -0,0 +1,171 @@
+package sfu
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var ErrServerExists = errors.New("server already added")
+var ErrServerNotFound = errors.New("server not found")
+var ErrServerFromConfig = errors.New("server is from the config file")
+
+// The intended servers are kept in a small JSON file so an edge node which reboots comes back trunked and
+// with its cameras. It is replaced whole on every change, by writing a temporary file and renaming it over.
+// Only servers added from the page or API go in it, the config file is read again on every start anyway
+// and a server taken out of it while the node was down must not come back
+
+type persistedServers struct {
+	Servers []persistedServer `json:"servers"`
+}
+
+type persistedServer struct {
+	URL     string    `json:"url"`
+	Name    string    `json:"name,omitempty"`
+	Enabled bool      `json:"enabled"`
+	AddedAt time.Time `json:"addedAt"`
+}
+
+// No file yet is the same as no servers
+func loadServerState(path string) (map[string]*ServerEntry, error) {
+	entries := make(map[string]*ServerEntry)
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var persisted persistedServers
+	if err := json.Unmarshal(data, &persisted); err != nil {
+		return nil, err
+	}
+
+	for _, server := range persisted.Servers {
+		if server.URL == "" {
+			continue
+		}
+
+		entries[server.URL] = &ServerEntry{
+			Url:     server.URL,
+			Name:    server.Name,
+			Enabled: server.Enabled,
+			AddedAt: server.AddedAt.UnixMilli(),
+		}
+	}
+
+	return entries, nil
+}
+
+func saveServerState(path string, entries []*ServerEntry) error {
+	persisted := persistedServers{Servers: make([]persistedServer, 0, len(entries))}
+	for _, entry := range entries {
+		persisted.Servers = append(persisted.Servers, persistedServer{
+			URL:     entry.Url,
+			Name:    entry.Name,
+			Enabled: entry.Enabled,
+			AddedAt: time.UnixMilli(entry.AddedAt).UTC(),
+		})
+	}
+
+	data, err := json.MarshalIndent(&persisted, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// In the same directory, since rename is only atomic within a filesystem
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	// Otherwise a power cut can leave the renamed file empty
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Enabled entries are the servers which should be connected to
+func (s *Sfu) isIntended(url string) bool {
+	entry, exists := s.intendedServers[url]
+	return exists && entry.Enabled
+}
+
+func (s *Sfu) serverEntries() []*ServerEntry {
+	entries := make([]*ServerEntry, 0, len(s.intendedServers))
+	for _, entry := range s.intendedServers {
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// Keeps when an existing server was added, since that's what was asked for and not when it was last set,
+// and whether it came from the config file
+func (s *Sfu) newServerEntry(url string, name string, enabled bool) *ServerEntry {
+	entry := &ServerEntry{Url: url, Name: name, Enabled: enabled, AddedAt: time.Now().UnixMilli()}
+
+	if existing, exists := s.intendedServers[url]; exists {
+		entry.AddedAt = existing.AddedAt
+		entry.FromConfig = existing.FromConfig
+	}
+
+	return entry
+}
+
+func (s *Sfu) saveIntendedServers() {
+	if s.stateFile == "" {
+		return
+	}
+
+	added := make([]*ServerEntry, 0, len(s.intendedServers))
+	for _, entry := range s.intendedServers {
+		if !entry.FromConfig {
+			added = append(added, entry)
+		}
+	}
+
+	if err := saveServerState(s.stateFile, added); err != nil {
+		s.logger.Error("sfu", "Failed to save servers to "+s.stateFile+": "+err.Error())
+	}
+}
+
+// Trunks are websockets and cameras RTSP, anything else would only fail later
+func ValidateServerURL(serverUrl string) error {
+	u, err := url.Parse(serverUrl)
+	if err != nil {
+		return err
+	}
+
+	switch u.Scheme {
+	case "ws", "wss", "rtsp", "rtsps":
+	default:
+		return fmt.Errorf("server url scheme must be ws, wss, rtsp or rtsps, not %q", u.Scheme)
+	}
+
+	if u.Host == "" {
+		return fmt.Errorf("server url %q has no host", serverUrl)
+	}
+
+	return nil
+}
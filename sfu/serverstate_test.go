@@ -0,0 +1,145 @@
+package sfu
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"atomirex.com/umbrella/razor"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestServerStateRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "servers.json")
+
+	entries, err := loadServerState(path)
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("got %v, %v with no file", entries, err)
+	}
+
+	saved := []*ServerEntry{
+		{Url: "wss://a.example/ws", Name: "Upstairs", Enabled: true, AddedAt: 1700000000123},
+		{Url: "rtsp://camera.local/stream", Enabled: false, AddedAt: 1700000000456},
+	}
+
+	if err := saveServerState(path, saved); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err = loadServerState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range saved {
+		if got := entries[want.Url]; !proto.Equal(got, want) {
+			t.Errorf("loaded %v, want %v", got, want)
+		}
+	}
+
+	// Nothing left behind from writing it
+	if files, _ := os.ReadDir(filepath.Dir(path)); len(files) != 1 {
+		t.Errorf("got %d files, want only the state", len(files))
+	}
+}
+
+func TestServerStateUnreadable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "servers.json")
+
+	if err := os.WriteFile(path, []byte(`{"servers": [{"url": ""}, {"url": "wss://a.example/ws"}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := loadServerState(path)
+	if err != nil || len(entries) != 1 || entries["wss://a.example/ws"] == nil {
+		t.Errorf("got %v, %v, want servers without a url skipped", entries, err)
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadServerState(path); err == nil {
+		t.Error("loaded a broken file")
+	}
+}
+
+// Connects to nothing, so servers can be added without anything being dialed
+func newTestStateSfu(t *testing.T, path string) *Sfu {
+	s := NewSfu(razor.NewLogger(razor.LoggingLevelOff, false), 40000, 60000, nil, ICEMuxPorts{}, path)
+	s.remoteClientFactory = &testServerClients{}
+	return s
+}
+
+func entryFor(servers *CurrentServers, url string) *ServerEntry {
+	i := slices.IndexFunc(servers.Entries, func(e *ServerEntry) bool { return e.Url == url })
+	if i < 0 {
+		return nil
+	}
+
+	return servers.Entries[i]
+}
+
+func TestServerStatePersistence(t *testing.T) {
+	const configured = "wss://config.example/ws"
+	const added = "wss://added.example/ws"
+	const takenOver = "rtsp://camera.local/stream"
+
+	path := filepath.Join(t.TempDir(), "servers.json")
+
+	s := newTestStateSfu(t, path)
+	s.UpdateServers([]string{configured}, nil)
+
+	if _, err := s.AddServer(&ServerEntry{Url: added, Name: "Kitchen"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.AddServer(&ServerEntry{Url: takenOver, Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.AddServer(&ServerEntry{Url: configured}); !errors.Is(err, ErrServerExists) {
+		t.Errorf("adding the configured server again got %v", err)
+	}
+
+	if _, err := s.RemoveServer(configured); !errors.Is(err, ErrServerFromConfig) {
+		t.Errorf("removing the configured server got %v", err)
+	}
+
+	if _, err := s.RemoveServer("wss://nowhere.example/ws"); !errors.Is(err, ErrServerNotFound) {
+		t.Errorf("removing a server never added got %v", err)
+	}
+
+	// Listed in the config file from now on, so no longer saved
+	s.UpdateServers([]string{takenOver}, nil)
+
+	saved, err := loadServerState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(saved) != 1 || saved[added] == nil || saved[added].Name != "Kitchen" || saved[added].Enabled {
+		t.Fatalf("saved %v, want only the added server", saved)
+	}
+
+	// As if restarted, with the config file no longer listing anything
+	restarted := newTestStateSfu(t, path).GetCurrentServers()
+
+	if entry := entryFor(restarted, added); entry == nil || !proto.Equal(entry, saved[added]) {
+		t.Errorf("restored %v, want %v", entry, saved[added])
+	}
+
+	if entryFor(restarted, configured) != nil || entryFor(restarted, takenOver) != nil {
+		t.Errorf("restored servers from the config file: %v", restarted.Entries)
+	}
+
+	if _, err := s.RemoveServer(added); err != nil {
+		t.Fatal(err)
+	}
+
+	if saved, err := loadServerState(path); err != nil || len(saved) != 0 {
+		t.Errorf("saved %v, %v after removing the added server", saved, err)
+	}
+}
@@ -0,0 +1,154 @@
+package sfu
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Offers with lots of simulcast layers and codecs get big, but nothing like this
+const maxSessionBodySize = 1 << 20
+
+// A WHIP or WHEP client, which does its signalling with HTTP requests to a session resource
+type httpSession interface {
+	RemoteClient
+	sessionID() string
+	addICECandidates(candidates []webrtc.ICECandidateInit) error
+}
+
+// Tokens for WHIP and WHEP only come as bearer tokens, and with auth on one is required
+func (s *Sfu) authorizeSessionRequest(w http.ResponseWriter, r *http.Request, kind string) (string, clientPermissions, bool) {
+	if r.Header.Get("Content-Type") != "application/sdp" {
+		http.Error(w, "Expected application/sdp", http.StatusUnsupportedMediaType)
+		return "", clientPermissions{}, false
+	}
+
+	token := bearerToken(r)
+	if s.auth.TokensRequired() && token == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return "", clientPermissions{}, false
+	}
+
+	roomId, permissions, status, err := s.authorizeRequest(r, token)
+	if err != nil {
+		s.logger.Warn("sfu", "Rejecting "+kind+" from "+r.RemoteAddr+": "+err.Error())
+		refuseRequest(w, status, err)
+		return "", clientPermissions{}, false
+	}
+
+	return roomId, permissions, true
+}
+
+// PATCH and DELETE on a session resource
+func (s *Sfu) handleSessionResource(w http.ResponseWriter, r *http.Request, id string) {
+	// The session id is random and only given to the client, so holding the url is what authorizes changing it
+	s.sessionMutex.Lock()
+	c, exists := s.httpSessions[id]
+	s.sessionMutex.Unlock()
+
+	if !exists {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPatch:
+		if r.Header.Get("Content-Type") != "application/trickle-ice-sdpfrag" {
+			http.Error(w, "Expected application/trickle-ice-sdpfrag", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxSessionBodySize))
+		if err != nil {
+			http.Error(w, "Failed to read payload", http.StatusBadRequest)
+			return
+		}
+
+		if err := c.addICECandidates(parseTrickleSDPFrag(string(body))); err != nil {
+			http.Error(w, "Failed to add candidates: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		s.endSession(c)
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Sfu) startSession(c httpSession) {
+	s.sessionMutex.Lock()
+	s.httpSessions[c.sessionID()] = c
+	s.sessionMutex.Unlock()
+
+	s.handler.Send(sfuAddClient, &sfuCommandMessage{client: c})
+}
+
+// Safe to call more than once, as both DELETE and the peer connection going away end sessions
+func (s *Sfu) endSession(c httpSession) {
+	s.sessionMutex.Lock()
+	_, exists := s.httpSessions[c.sessionID()]
+	delete(s.httpSessions, c.sessionID())
+	s.sessionMutex.Unlock()
+
+	if !exists {
+		return
+	}
+
+	c.stop()
+	s.handler.Send(sfuRemoveClient, &sfuCommandMessage{client: c})
+}
+
+// Answers the POST which created a session, pointing at the resource for it
+func writeSessionCreated(w http.ResponseWriter, r *http.Request, id string, answer string) {
+	// r.URL has lost any http prefix by now, the original request still has it
+	resource := r.URL.Path + "/" + id
+	if requestURL, err := url.ParseRequestURI(r.RequestURI); err == nil {
+		resource = strings.TrimSuffix(requestURL.Path, "/") + "/" + id
+	}
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", resource)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(answer))
+}
+
+// Pulls the candidates out of a trickle-ice-sdpfrag (RFC 8840), which groups them by media section
+func parseTrickleSDPFrag(frag string) []webrtc.ICECandidateInit {
+	candidates := make([]webrtc.ICECandidateInit, 0)
+
+	mid := ""
+	mLineIndex := -1
+
+	for _, line := range strings.Split(frag, "\n") {
+		line = strings.TrimSpace(line)
+
+		switch {
+		case strings.HasPrefix(line, "m="):
+			mLineIndex++
+			mid = ""
+		case strings.HasPrefix(line, "a=mid:"):
+			mid = strings.TrimPrefix(line, "a=mid:")
+		case strings.HasPrefix(line, "a=candidate:"):
+			candidate := webrtc.ICECandidateInit{Candidate: strings.TrimPrefix(line, "a=")}
+
+			// Everything is bundled so this hardly matters, and the index is only into the fragment
+			if mid != "" {
+				candidateMid := mid
+				candidate.SDPMid = &candidateMid
+			} else if mLineIndex >= 0 {
+				index := uint16(mLineIndex)
+				candidate.SDPMLineIndex = &index
+			}
+
+			candidates = append(candidates, candidate)
+		}
+	}
+
+	return candidates
+}
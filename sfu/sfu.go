@@ -3,15 +3,24 @@ package sfu
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
+	"slices"
+	"sync"
 	"time"
 
 	"atomirex.com/umbrella/razor"
 	"github.com/atomirex/mdns"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/interceptor/pkg/stats"
 	"github.com/pion/logging"
+	"github.com/pion/sdp/v3"
 	"github.com/pion/webrtc/v4"
+	"google.golang.org/protobuf/proto"
 )
 
 var (
@@ -20,6 +29,9 @@ var (
 	}
 )
 
+// How long a client without a token in the url has to send the auth message
+const authMessageTimeout = 10 * time.Second
+
 type sfuCommand int
 
 const (
@@ -31,43 +43,137 @@ const (
 
 	sfuGetCurrentServers
 	sfuSetCurrentServers
+	sfuUpdateServers
+	sfuAddServer
+	sfuRemoveServer
+	sfuServerConnected
+	sfuServerStopped
+	sfuRedialServers
 
 	sfuGetStatus
+
+	sfuStartRecording
+	sfuStopRecording
+	sfuGetRecordings
+	sfuStopAllRecordings
+
+	sfuGetMetrics
+
+	sfuKickClient
+	sfuSetTrackMuted
+	sfuSetForwardingBlocked
+	sfuGetAdminState
+
+	sfuDetectSpeakers
 )
 
 type sfuCommandMessage struct {
 	intrack           *incomingTrack
-	client            *client
+	client            RemoteClient
 	SetCurrentServers *CurrentServers
+	addServers        []string
+	removeServers     []string
+	serverEntry       *ServerEntry
+	recording         *RecordingRequest
+	reason            string
+	clientId          string
+	umbrellaId        string
+	enabled           bool // Muted or blocked for the admin commands
 
 	result *sfuCommandResult
 }
 
 type sfuCommandResult struct {
-	servers chan *CurrentServers
-	status  chan *SFUStatus
+	servers      chan *CurrentServers
+	serverChange chan serversResult
+	status       chan *SFUStatus
+	recordings   chan recordingsResult
+	metrics      chan *metricsSnapshot
+	admin        chan adminResult
+}
+
+type serversResult struct {
+	servers *CurrentServers
+	err     error
+}
+
+type recordingsResult struct {
+	recordings *Recordings
+	err        error
 }
 
 type Sfu struct {
-	clients     []RemoteClient
 	sfuCommands chan sfuCommandMessage
 
 	peerConnectionFactory PeerConnectionFactory
 	remoteClientFactory   RemoteClientFactory
 
-	// UmbrellaID -> track
-	localTracks map[string]*incomingTrack // Set of all incoming tracks which are being relayed
+	// Room ID -> room, rooms are created on demand and removed when empty
+	rooms map[string]*room
 
 	handler *razor.MessageHandler[sfuCommand, sfuCommandMessage]
 
-	intendedServers map[string]bool // This works because strings completely define the spec of the server right now
-	servers         map[string]RemoteClient
+	intendedServers map[string]*ServerEntry // This works because strings completely define the spec of the server right now
+	servers         map[string]*supervisedServer
+
+	// Where the intended servers are kept across restarts, empty to forget them
+	stateFile string
 
 	logger *razor.Logger
 
 	loggerPion logging.LeveledLogger
 
 	mdnsConn *mdns.Conn
+
+	auth *Authenticator
+
+	trunkSecurity *TrunkSecurity
+
+	metrics *sfuMetrics
+
+	// Handed out ahead of any from the TURN server, and can be changed while running
+	iceServersMutex sync.Mutex
+	iceServers      []webrtc.ICEServer
+
+	// Optional, only set when running the built in TURN server
+	turnServer *TurnServer
+
+	// Empty means recording is off
+	recordingDir string
+
+	// UmbrellaID -> recorder
+	recordings map[string]*recorder
+
+	// Rooms where every track is recorded
+	recordedRooms map[string]bool
+
+	// Session id -> WHIP or WHEP client, looked up straight from the HTTP handlers
+	sessionMutex sync.Mutex
+	httpSessions map[string]httpSession
+
+	statusHub *statusHub
+
+	// Identifies this SFU in the hop paths of trunked tracks
+	nodeId string
+
+	// Room and umbrellaId -> the track providing it, so a room never takes the same track from two places
+	trackClaimMutex sync.Mutex
+	trackClaims     map[trackClaimKey]*incomingTrack
+
+	// UmbrellaID -> muted by an admin, so not forwarded to anyone
+	mutedTracks map[string]bool
+
+	// Client ID -> umbrellaIDs an admin has stopped forwarding to it, with "" meaning everything
+	forwardingBlocks map[string]map[string]bool
+
+	dataLimitsMutex sync.Mutex
+	dataLimits      DataLimits
+
+	lastNMutex sync.Mutex
+	lastN      LastNPolicy
+
+	// Data messages already relayed, which is only touched in the SFU goroutine
+	data *dataRelay
 }
 
 func (s *Sfu) GetStatus() *SFUStatus {
@@ -90,6 +196,45 @@ func (s *Sfu) GetCurrentServers() *CurrentServers {
 	return <-msg.result.servers
 }
 
+// Adds and removes servers without touching the others, such as those added through the servers page
+func (s *Sfu) UpdateServers(add []string, remove []string) *CurrentServers {
+	msg := sfuCommandMessage{
+		addServers:    add,
+		removeServers: remove,
+		result: &sfuCommandResult{
+			servers: make(chan *CurrentServers, 1),
+		},
+	}
+
+	s.handler.Send(sfuUpdateServers, &msg)
+
+	return <-msg.result.servers
+}
+
+// Fails with ErrServerExists rather than changing one already there
+func (s *Sfu) AddServer(entry *ServerEntry) (*CurrentServers, error) {
+	return s.sendServerChange(sfuAddServer, entry)
+}
+
+// Fails with ErrServerNotFound if there's no server with the url, or ErrServerFromConfig if it has to be taken out of the config file instead
+func (s *Sfu) RemoveServer(url string) (*CurrentServers, error) {
+	return s.sendServerChange(sfuRemoveServer, &ServerEntry{Url: url})
+}
+
+func (s *Sfu) sendServerChange(command sfuCommand, entry *ServerEntry) (*CurrentServers, error) {
+	msg := sfuCommandMessage{
+		serverEntry: entry,
+		result: &sfuCommandResult{
+			serverChange: make(chan serversResult, 1),
+		},
+	}
+
+	s.handler.Send(command, &msg)
+
+	result := <-msg.result.serverChange
+	return result.servers, result.err
+}
+
 func (s *Sfu) SetCurrentServers(update *CurrentServers) *CurrentServers {
 	msg := sfuCommandMessage{
 		SetCurrentServers: update,
@@ -103,14 +248,81 @@ func (s *Sfu) SetCurrentServers(update *CurrentServers) *CurrentServers {
 	return <-msg.result.servers
 }
 
-func NewSfu(logger *razor.Logger, minPort uint16, maxPort uint16, ip *string) *Sfu {
+func (s *Sfu) StartRecording(request *RecordingRequest) (*Recordings, error) {
+	return s.sendRecordingCommand(sfuStartRecording, request)
+}
+
+func (s *Sfu) StopRecording(request *RecordingRequest) (*Recordings, error) {
+	return s.sendRecordingCommand(sfuStopRecording, request)
+}
+
+func (s *Sfu) GetRecordings() *Recordings {
+	recordings, _ := s.sendRecordingCommand(sfuGetRecordings, nil)
+	return recordings
+}
+
+// Finishes any recordings in progress so the files are complete, for before exiting
+func (s *Sfu) StopAllRecordings() {
+	s.sendRecordingCommand(sfuStopAllRecordings, nil)
+}
+
+func (s *Sfu) sendRecordingCommand(command sfuCommand, request *RecordingRequest) (*Recordings, error) {
+	msg := sfuCommandMessage{
+		recording: request,
+		result: &sfuCommandResult{
+			recordings: make(chan recordingsResult, 1),
+		},
+	}
+
+	s.handler.Send(command, &msg)
+
+	result := <-msg.result.recordings
+	return result.recordings, result.err
+}
+
+// Ports every peer connection shares for ICE instead of each getting its own, 0 means not muxed
+type ICEMuxPorts struct {
+	UDP int
+	TCP int
+}
+
+// Servers restored from stateFile are only connected to once the servers are next updated or set, so there's time to set up trunk security first
+func NewSfu(logger *razor.Logger, minPort uint16, maxPort uint16, ip *string, muxPorts ICEMuxPorts, stateFile string) *Sfu {
 	loggerPion := logging.NewDefaultLoggerFactory().NewLogger("sfu-ws")
 	loggerPion.(*logging.DefaultLeveledLogger).SetLevel(logging.LogLevelError)
 
 	settingEngine := webrtc.SettingEngine{}
 
-	settingEngine.SetEphemeralUDPPortRange(minPort, maxPort)
+	if muxPorts.UDP != 0 {
+		udpListener, err := net.ListenUDP("udp", &net.UDPAddr{Port: muxPorts.UDP})
+		if err != nil {
+			panic(fmt.Sprintf("Panic listening for ICE on UDP port %d: %v", muxPorts.UDP, err))
+		}
+
+		logger.Info("sfu", fmt.Sprintf("Muxing ICE over UDP port %d", muxPorts.UDP))
+		settingEngine.SetICEUDPMux(webrtc.NewICEUDPMux(nil, udpListener))
+	} else {
+		settingEngine.SetEphemeralUDPPortRange(minPort, maxPort)
+	}
+
+	networkTypes := []webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6}
+
+	// For clients where only TCP gets out, pion only does passive ICE-TCP so it has to be a single listener anyway
+	if muxPorts.TCP != 0 {
+		tcpListener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: muxPorts.TCP})
+		if err != nil {
+			panic(fmt.Sprintf("Panic listening for ICE on TCP port %d: %v", muxPorts.TCP, err))
+		}
+
+		logger.Info("sfu", fmt.Sprintf("Muxing ICE over TCP port %d", muxPorts.TCP))
+		settingEngine.SetICETCPMux(webrtc.NewICETCPMux(nil, tcpListener, 32))
+
+		networkTypes = append(networkTypes, webrtc.NetworkTypeTCP4, webrtc.NetworkTypeTCP6)
+	}
+
+	settingEngine.SetNetworkTypes(networkTypes)
 
+	// Applies to the muxed ports too, so a container only needs them forwarded and the public IP set
 	if ip != nil {
 		settingEngine.SetNAT1To1IPs([]string{*ip}, webrtc.ICECandidateTypeHost)
 	}
@@ -120,153 +332,375 @@ func NewSfu(logger *razor.Logger, minPort uint16, maxPort uint16, ip *string) *S
 		panic("Error setting default codecs")
 	}
 
+	// How loud each audio packet is, for working out who's speaking
+	if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.AudioLevelURI}, webrtc.RTPCodecTypeAudio); err != nil {
+		panic("Error registering audio level header extension")
+	}
+
 	// Now we know what this is and why . . . . facepalm
 	// This is the "default" nack, sr, rr etc. handling for rtcp
 	// We can come back to it when it's a problem
+	// This also registers the header extensions simulcast layers are told apart by
 	interceptorRegistry := &interceptor.Registry{}
+
+	// RTP stream stats for the status page, since pion's GetStats doesn't have them yet
+	// Added first so it's nearest the wire and counts what actually goes over it
+	statsInterceptor, err := stats.NewInterceptor()
+	if err != nil {
+		panic("Panic creating stats interceptor")
+	}
+
+	interceptorRegistry.Add(statsInterceptor)
+
 	if err := webrtc.RegisterDefaultInterceptors(m, interceptorRegistry); err != nil {
 		panic("Panic setting interceptors")
 	}
 
-	webrtcApi := webrtc.NewAPI(webrtc.WithSettingEngine(settingEngine), webrtc.WithMediaEngine(m))
+	// No pacing, the client drops layers or pauses video itself when the estimate is too low
+	congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return gcc.NewSendSideBWE(
+			gcc.SendSideBWEInitialBitrate(initialBitrateEstimate),
+			gcc.SendSideBWEPacer(gcc.NewNoOpPacer()),
+		)
+	})
+	if err != nil {
+		panic("Panic creating congestion controller")
+	}
+
+	interceptorRegistry.Add(congestionController)
+
+	// Sending the TWCC header extension gets us the feedback GCC needs to estimate each remote's downlink
+	// Interceptors added later see packets first, so this has to come after GCC or it never sees the extension
+	if err := webrtc.ConfigureTWCCHeaderExtensionSender(m, interceptorRegistry); err != nil {
+		panic("Panic setting twcc header extension")
+	}
+
+	webrtcApi := webrtc.NewAPI(webrtc.WithSettingEngine(settingEngine), webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(interceptorRegistry))
+
+	metrics := newSfuMetrics()
+
+	peerConnectionFactory := &PionPeerConnectionFactory{
+		pcConfig:  &webrtc.Configuration{},
+		webrtcApi: webrtcApi,
+		logger:    logger,
+		metrics:   metrics,
+	}
+
+	congestionController.OnNewPeerConnection(peerConnectionFactory.onNewEstimator)
+	statsInterceptor.OnNewPeerConnection(peerConnectionFactory.onNewStatsGetter)
 
 	s := &Sfu{
-		sfuCommands:         make(chan sfuCommandMessage, 256),
-		remoteClientFactory: &DefaultRemoteClientFactory{},
-		peerConnectionFactory: &PionPeerConnectionFactory{
-			pcConfig: &webrtc.Configuration{
-				ICEServers: []webrtc.ICEServer{
-					{
-						URLs: []string{"stun:stun.l.google.com:19302"},
-					},
-				},
-			},
-			webrtcApi: webrtcApi,
-			logger:    logger,
-		},
-		localTracks:     make(map[string]*incomingTrack),
-		intendedServers: make(map[string]bool),
-		servers:         make(map[string]RemoteClient),
-		logger:          logger,
-		loggerPion:      loggerPion,
+		sfuCommands:           make(chan sfuCommandMessage, 256),
+		remoteClientFactory:   &DefaultRemoteClientFactory{},
+		peerConnectionFactory: peerConnectionFactory,
+		rooms:                 make(map[string]*room),
+		intendedServers:       make(map[string]*ServerEntry),
+		servers:               make(map[string]*supervisedServer),
+		recordings:            make(map[string]*recorder),
+		recordedRooms:         make(map[string]bool),
+		httpSessions:          make(map[string]httpSession),
+		nodeId:                uuid.NewString(),
+		trackClaims:           make(map[trackClaimKey]*incomingTrack),
+		mutedTracks:           make(map[string]bool),
+		forwardingBlocks:      make(map[string]map[string]bool),
+		dataLimits:            DefaultDataLimits(),
+		data:                  newDataRelay(),
+		iceServers:            DefaultICEServers(),
+		stateFile:             stateFile,
+		logger:                logger,
+		loggerPion:            loggerPion,
+		metrics:               metrics,
 	}
 
+	peerConnectionFactory.iceServers = func() []webrtc.ICEServer {
+		return s.ICEServers("sfu")
+	}
+
+	if stateFile != "" {
+		restored, err := loadServerState(stateFile)
+		if err != nil {
+			logger.Error("sfu", "Failed to restore servers from "+stateFile+": "+err.Error())
+		} else {
+			s.intendedServers = restored
+			logger.Info("sfu", fmt.Sprintf("Restored %d servers from %s", len(restored), stateFile))
+		}
+	}
+
+	s.statusHub = newStatusHub(s, logger)
+
 	s.handler = razor.NewMessageHandler(logger, "sfu", 1024, func(what sfuCommand, payload *sfuCommandMessage) bool {
 		shouldSignalClients := false
 
+		// nil means signal the clients of every room
+		var roomToSignal *room
+
 		switch what {
 		case sfuAddClient:
-			s.clients = append(s.clients, payload.client)
-
-			// Add all existing tracks
-			for _, t := range s.localTracks {
-				payload.client.handler.Send(clientAddOutgoingTrackForIncomingTrack, &clientCommandMessage{incomingTrack: t})
-			}
+			r := s.getOrCreateRoom(payload.client.Room())
+			r.clients = append(r.clients, payload.client)
 
-			shouldSignalClients = true
-		case sfuRemoveClient:
-			index := -1
-			for i, c := range s.clients {
-				if c == payload.client {
-					index = i
+			// Add all existing tracks in the room
+			for _, t := range r.localTracks {
+				if s.shouldForward(t, payload.client) {
+					payload.client.AddOutgoingTracksForIncomingTrack(t)
 				}
 			}
 
-			if index >= 0 {
-				s.clients = append(s.clients[:index], s.clients[index+1:]...)
+			if len(r.speakers.recent) > 0 {
+				payload.client.SetActiveSpeakers(r.speakers.message())
 			}
 
 			shouldSignalClients = true
+			roomToSignal = r
+		case sfuRemoveClient:
+			r, exists := s.rooms[payload.client.Room()]
+			if exists {
+				r.removeClient(payload.client)
+				s.removeRoomIfEmpty(r)
+
+				// No room means nothing changed for anyone else
+				shouldSignalClients = true
+				roomToSignal = r
+			}
+
+			delete(s.forwardingBlocks, payload.client.ID())
 		case sfuAddOutgoingTracksForIncomingTrack:
-			logger.Info("sfu", "adding track: "+payload.intrack.String())
+			logger.Info("sfu", "adding track: "+payload.intrack.String()+" to room "+payload.intrack.room)
 			intrack := payload.intrack
-			s.localTracks[intrack.UmbrellaID()] = intrack
+			r := s.getOrCreateRoom(intrack.room)
+			r.localTracks[intrack.UmbrellaID()] = intrack
 
-			for _, c := range s.clients {
-				c.AddOutgoingTracksForIncomingTrack(intrack)
+			for _, c := range r.clients {
+				if s.shouldForward(intrack, c) {
+					c.AddOutgoingTracksForIncomingTrack(intrack)
+				}
+			}
+
+			if s.recordedRooms[intrack.room] {
+				_, err := s.startRecordingTrack(intrack)
+				logger.NilErrCheck("sfu", "Failed to start recording "+intrack.String(), err)
 			}
 
 			shouldSignalClients = true
+			roomToSignal = r
 		case sfuRemoveAllOutgoingTracksForIncomingTrack:
-			logger.Info("sfu", "removing all outgoing tracks for track: "+payload.intrack.String())
-			delete(s.localTracks, payload.intrack.UmbrellaID())
+			logger.Info("sfu", "removing all outgoing tracks for track: "+payload.intrack.String()+" from room "+payload.intrack.room)
+			s.stopRecordingTrack(payload.intrack.UmbrellaID())
 
-			for _, c := range s.clients {
-				c.RemoveOutgoingTracksForIncomingTrack(payload.intrack)
-			}
+			s.releaseTrack(payload.intrack)
 
-			shouldSignalClients = true
+			r, exists := s.rooms[payload.intrack.room]
+			if exists && r.localTracks[payload.intrack.UmbrellaID()] == payload.intrack {
+				delete(r.localTracks, payload.intrack.UmbrellaID())
+
+				for _, c := range r.clients {
+					c.RemoveOutgoingTracksForIncomingTrack(payload.intrack)
+				}
+
+				s.removeRoomIfEmpty(r)
+
+				// Only the room the track was in, since a nil room would signal every room
+				shouldSignalClients = true
+				roomToSignal = r
+			}
 		case sfuSignalClients:
 			shouldSignalClients = true
 		case sfuGetStatus:
-			// Terrible version of this which blocks while polling everything
-			// Should really pass around a thing that gathers the info
-			// but in reality I should move to a pub/sub thing that pushes the data out on changes anyway
-			// this is to debug the mess as is :P
-			logger.Info("sfu", "SFU getting status servers")
+			// Only the skeleton is built here, since asking the clients would hold up everything else
 			servers := make([]string, 0)
 			for t := range s.servers {
 				servers = append(servers, t)
 			}
-			logger.Info("sfu", "SFU getting status relaying")
-			relaying := make([]*TrackDescriptor, 0)
-			for _, t := range s.localTracks {
-				relaying = append(relaying, t.descriptor)
-			}
-			logger.Info("sfu", "SFU getting status clients")
-			clients := make([]*SFUStatusClient, 0)
-			for _, c := range s.clients {
-				logger.Info("sfu", "SFU getting status for client "+c.Label())
-				clients = append(clients, c.getStatus())
-				logger.Info("sfu", "SFU received status for client "+c.Label())
+
+			rooms := make([]*SFUStatusRoom, 0)
+			roomClients := make([][]RemoteClient, 0)
+			for _, r := range s.rooms {
+				relaying := make([]*TrackDescriptor, 0)
+				for _, t := range r.localTracks {
+					relaying = append(relaying, t.descriptor)
+				}
+
+				rooms = append(rooms, &SFUStatusRoom{
+					Id:             r.id,
+					RelayingTracks: relaying,
+					Clients:        make([]*SFUStatusClient, 0),
+				})
+
+				roomClients = append(roomClients, append([]RemoteClient(nil), r.clients...))
 			}
 
-			logger.Info("sfu", "SFU getting status returning")
 			status := &SFUStatus{
-				RelayingTracks: relaying,
-				Servers:        servers,
-				Clients:        clients,
+				Servers:      servers,
+				Rooms:        rooms,
+				Recordings:   s.getRecordings(),
+				NodeId:       s.nodeId,
+				ServerStates: s.serverStates(),
 			}
 
-			payload.result.status <- status
-		case sfuGetCurrentServers:
-			result := &CurrentServers{Servers: make([]string, 0)}
+			go func() {
+				payload.result.status <- collectStatus(status, roomClients)
+			}()
+		case sfuStartRecording:
+			err := s.startRecording(payload.recording)
+			s.statusHub.changed()
+			payload.result.recordings <- recordingsResult{recordings: s.getRecordings(), err: err}
+		case sfuStopRecording:
+			err := s.stopRecording(payload.recording)
+			s.statusHub.changed()
+			payload.result.recordings <- recordingsResult{recordings: s.getRecordings(), err: err}
+		case sfuGetRecordings:
+			payload.result.recordings <- recordingsResult{recordings: s.getRecordings()}
+		case sfuStopAllRecordings:
+			// Only for shutting down, so blocking until the files are finished is fine
+			stopping := make([]*recorder, 0, len(s.recordings))
+			for umbrellaId, rec := range s.recordings {
+				stopping = append(stopping, rec)
+				s.stopRecordingTrack(umbrellaId)
+			}
 
-			for t := range s.servers {
-				result.Servers = append(result.Servers, t)
+			for _, rec := range stopping {
+				<-rec.done
 			}
 
-			payload.result.servers <- result
+			payload.result.recordings <- recordingsResult{recordings: s.getRecordings()}
+		case sfuGetMetrics:
+			payload.result.metrics <- s.gatherMetrics()
+		case sfuGetCurrentServers:
+			payload.result.servers <- s.currentServers()
 		case sfuSetCurrentServers:
 			// "intended" servers model, then regularly evaluate, so setup/teardown repeatedly is ok
-			mentioned := make(map[string]bool)
-			for _, t := range payload.SetCurrentServers.Servers {
-				mentioned[t] = true
+			// Servers from the config file stay whatever is sent, though can be renamed or disabled until restart
+			mentioned := make(map[string]*ServerEntry)
+			for url, entry := range s.intendedServers {
+				if entry.FromConfig {
+					mentioned[url] = entry
+				}
+			}
+
+			if len(payload.SetCurrentServers.Entries) > 0 {
+				for _, e := range payload.SetCurrentServers.Entries {
+					if e.Url != "" {
+						mentioned[e.Url] = s.newServerEntry(e.Url, e.Name, e.Enabled)
+					}
+				}
+			} else {
+				for _, t := range payload.SetCurrentServers.Servers {
+					name := ""
+					if existing, exists := s.intendedServers[t]; exists {
+						name = existing.Name
+					}
+
+					mentioned[t] = s.newServerEntry(t, name, true)
+				}
 			}
 
-			// Just overwrite it with what the client sent! (For now)
 			s.intendedServers = mentioned
+			s.saveIntendedServers()
+
+			s.evaluateServers()
+
+			shouldSignalClients = true
+
+			payload.result.servers <- s.currentServers()
+		case sfuUpdateServers:
+			// From the config file, which takes over any server it lists that was added some other way
+			for _, t := range payload.removeServers {
+				if existing, exists := s.intendedServers[t]; exists && existing.FromConfig {
+					delete(s.intendedServers, t)
+				}
+			}
+
+			for _, t := range payload.addServers {
+				if existing, exists := s.intendedServers[t]; exists {
+					existing.FromConfig = true
+					existing.Enabled = true
+				} else {
+					entry := s.newServerEntry(t, "", true)
+					entry.FromConfig = true
+					s.intendedServers[t] = entry
+				}
+			}
+
+			s.saveIntendedServers()
 
 			s.evaluateServers()
 
 			shouldSignalClients = true
 
-			result := &CurrentServers{Servers: make([]string, 0)}
+			payload.result.servers <- s.currentServers()
+		case sfuAddServer, sfuRemoveServer:
+			entry := payload.serverEntry
+			existing, exists := s.intendedServers[entry.Url]
+
+			var err error
+			switch {
+			case what == sfuAddServer && exists:
+				err = ErrServerExists
+			case what == sfuRemoveServer && !exists:
+				err = ErrServerNotFound
+			case what == sfuRemoveServer && existing.FromConfig:
+				err = ErrServerFromConfig
+			case what == sfuAddServer:
+				s.intendedServers[entry.Url] = s.newServerEntry(entry.Url, entry.Name, entry.Enabled)
+			default:
+				delete(s.intendedServers, entry.Url)
+			}
 
-			for t := range s.servers {
-				result.Servers = append(result.Servers, t)
+			if err == nil {
+				s.saveIntendedServers()
+				s.evaluateServers()
+				shouldSignalClients = true
 			}
 
-			payload.result.servers <- result
+			payload.result.serverChange <- serversResult{servers: s.currentServers(), err: err}
+		case sfuServerConnected:
+			s.onServerConnected(payload.client)
+			s.statusHub.changed()
+		case sfuServerStopped:
+			s.onServerStopped(payload.client, payload.reason)
+			s.statusHub.changed()
+		case sfuRedialServers:
+			s.redialServers()
+			s.statusHub.changed()
+		case sfuKickClient:
+			payload.result.admin <- adminResult{err: s.kickClient(payload.clientId)}
+		case sfuSetTrackMuted, sfuSetForwardingBlocked:
+			var r *room
+			var err error
+			if what == sfuSetTrackMuted {
+				r, err = s.setTrackMuted(payload.umbrellaId, payload.enabled)
+			} else {
+				r, err = s.setForwardingBlocked(payload.clientId, payload.umbrellaId, payload.enabled)
+			}
+
+			if r != nil {
+				shouldSignalClients = true
+				roomToSignal = r
+			}
+
+			payload.result.admin <- adminResult{state: s.adminState(), err: err}
+		case sfuGetAdminState:
+			payload.result.admin <- adminResult{state: s.adminState()}
+		case sfuDetectSpeakers:
+			s.detectSpeakers()
 		}
 
 		if shouldSignalClients {
 			logger.Verbose("sfu", "SFU should signaling clients")
-			s.handler.Cancel(sfuSignalClients)
 
-			for _, c := range s.clients {
-				logger.Verbose("sfu", "SFU signaling client "+c.Label())
-				c.RequestEvalState()
+			s.statusHub.changed()
+
+			if roomToSignal == nil {
+				s.handler.Cancel(sfuSignalClients)
+
+				s.updateAllDataRecipients()
+
+				for _, r := range s.rooms {
+					s.signalRoomClients(r)
+				}
+			} else {
+				s.updateDataRecipients(roomToSignal)
+				s.signalRoomClients(roomToSignal)
 			}
 
 			logger.Verbose("sfu", "SFU finished signaling clients")
@@ -279,33 +713,180 @@ func NewSfu(logger *razor.Logger, minPort uint16, maxPort uint16, ip *string) *S
 		panic("SFU unexpectedly terminated")
 	})
 
+	s.handler.Timeout(sfuDetectSpeakers, nil, speakerDetectionInterval)
+
+	go s.runDataRelay()
+
 	return s
 }
 
+func (s *Sfu) getOrCreateRoom(id string) *room {
+	r, exists := s.rooms[id]
+	if !exists {
+		s.logger.Info("sfu", "creating room "+id)
+		r = newRoom(id)
+		s.rooms[id] = r
+	}
+
+	return r
+}
+
+func (s *Sfu) removeRoomIfEmpty(r *room) {
+	if r.isEmpty() {
+		s.logger.Info("sfu", "removing empty room "+r.id)
+		delete(s.rooms, r.id)
+	}
+}
+
+func (s *Sfu) signalRoomClients(r *room) {
+	for _, c := range r.clients {
+		s.logger.Verbose("sfu", "SFU signaling client "+c.Label())
+		c.RequestEvalState()
+	}
+}
+
+func (s *Sfu) findTrack(umbrellaId string) *incomingTrack {
+	for _, r := range s.rooms {
+		if t, exists := r.localTracks[umbrellaId]; exists {
+			return t
+		}
+	}
+
+	return nil
+}
+
+func (s *Sfu) startRecording(request *RecordingRequest) error {
+	if s.recordingDir == "" {
+		return ErrRecordingDisabled
+	}
+
+	if request.UmbrellaId != "" {
+		t := s.findTrack(request.UmbrellaId)
+		if t == nil {
+			return ErrTrackNotFound
+		}
+
+		_, err := s.startRecordingTrack(t)
+		return err
+	}
+
+	roomId, err := validateRoomID(request.Room)
+	if err != nil {
+		return err
+	}
+
+	s.recordedRooms[roomId] = true
+
+	// The room may not exist yet, in which case tracks get recorded as they turn up
+	if r, exists := s.rooms[roomId]; exists {
+		for _, t := range r.localTracks {
+			_, err := s.startRecordingTrack(t)
+			s.logger.NilErrCheck("sfu", "Failed to start recording "+t.String(), err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Sfu) startRecordingTrack(t *incomingTrack) (*recorder, error) {
+	if rec, exists := s.recordings[t.UmbrellaID()]; exists {
+		return rec, nil
+	}
+
+	rec, err := newRecorder(s.recordingDir, t, s.logger)
+	if err != nil {
+		return nil, err
+	}
+
+	s.recordings[t.UmbrellaID()] = rec
+	return rec, nil
+}
+
+func (s *Sfu) stopRecording(request *RecordingRequest) error {
+	if request.UmbrellaId != "" {
+		if _, exists := s.recordings[request.UmbrellaId]; !exists {
+			return ErrTrackNotFound
+		}
+
+		s.stopRecordingTrack(request.UmbrellaId)
+		return nil
+	}
+
+	roomId, err := validateRoomID(request.Room)
+	if err != nil {
+		return err
+	}
+
+	delete(s.recordedRooms, roomId)
+
+	for umbrellaId, rec := range s.recordings {
+		if rec.source.room == roomId {
+			s.stopRecordingTrack(umbrellaId)
+		}
+	}
+
+	return nil
+}
+
+func (s *Sfu) stopRecordingTrack(umbrellaId string) {
+	if rec, exists := s.recordings[umbrellaId]; exists {
+		rec.stop()
+		delete(s.recordings, umbrellaId)
+	}
+}
+
+func (s *Sfu) getRecordings() *Recordings {
+	result := &Recordings{
+		Recordings: make([]*SFUStatusRecording, 0),
+		Rooms:      make([]string, 0),
+	}
+
+	for _, rec := range s.recordings {
+		result.Recordings = append(result.Recordings, rec.getStatus())
+	}
+
+	for roomId := range s.recordedRooms {
+		result.Rooms = append(result.Rooms, roomId)
+	}
+
+	return result
+}
+
+func (s *Sfu) currentServers() *CurrentServers {
+	result := &CurrentServers{Servers: make([]string, 0), States: s.serverStates(), Entries: s.serverEntries()}
+
+	for t := range s.servers {
+		result.Servers = append(result.Servers, t)
+	}
+
+	return result
+}
+
 func (s *Sfu) evaluateServers() {
 	// Ensure any running servers that should be stopped are stopping or stopped
-	for t := range s.servers {
-		mention := s.intendedServers[t]
+	for t, server := range s.servers {
+		mention := s.isIntended(t)
 		if !mention {
-			s.servers[t].stop()
-
-			// TODO only actually delete the server when it's really stopped (need the get servers endpoint to be pub/sub based first or it'll be useless)
-			delete(s.servers, t)
+			if server.client == nil {
+				delete(s.servers, t)
+			} else if server.state != ServerConnectionState_Stopped {
+				// Removed once the client says it has stopped
+				server.state = ServerConnectionState_Stopped
+				server.client.stop()
+			}
 		}
 	}
 
 	// Create and start any servers that should exist but do not (i.e. if they are still stopping leave them until stopped and removed)
-	for t, _ := range s.intendedServers {
-		_, exists := s.servers[t]
-		if !exists {
-			server := s.remoteClientFactory.NewClient(&RemoteClientParameters{
-				logger:   s.logger,
-				trunkurl: t,
-				s:        s,
-			})
+	for t := range s.intendedServers {
+		if _, exists := s.servers[t]; !exists && s.isIntended(t) {
+			server := &supervisedServer{url: t}
 			s.servers[t] = server
+			s.startServer(server)
 		}
 	}
+
+	s.scheduleRedial()
 }
 
 func (s *Sfu) addTrack(intrack *incomingTrack) {
@@ -316,14 +897,203 @@ func (s *Sfu) removeOutgoingTracksForIncomingTrack(t *incomingTrack) {
 	s.handler.Send(sfuRemoveAllOutgoingTracksForIncomingTrack, &sfuCommandMessage{intrack: t})
 }
 
+// Works out the room and permissions for a request from the token presented with it, if any
+// On failure returns the http status to refuse it with
+func (s *Sfu) authorizeRequest(r *http.Request, token string) (string, clientPermissions, int, error) {
+	requestedRoom := r.URL.Query().Get("room")
+	roomId, err := validateRoomID(requestedRoom)
+	if err != nil {
+		return "", clientPermissions{}, http.StatusBadRequest, fmt.Errorf("invalid room: %w", err)
+	}
+
+	if token == "" {
+		return roomId, allPermissions, http.StatusOK, nil
+	}
+
+	if s.auth.IsTrunkSecret(token) {
+		return roomId, trunkPermissions, http.StatusOK, nil
+	}
+
+	if !s.auth.TokensRequired() {
+		// Without keys browsers have nothing to present, so this can only be a node with the wrong secret
+		if s.auth.HasTrunkSecrets() {
+			return "", clientPermissions{}, http.StatusUnauthorized, fmt.Errorf("not a trunk secret")
+		}
+
+		return roomId, allPermissions, http.StatusOK, nil
+	}
+
+	claims, err := s.auth.Verify(token)
+	if err != nil {
+		return "", clientPermissions{}, http.StatusUnauthorized, err
+	}
+
+	roomId, err = roomForClaims(claims, requestedRoom)
+	if err != nil {
+		return "", clientPermissions{}, http.StatusForbidden, err
+	}
+
+	return roomId, permissionsFromClaims(claims), http.StatusOK, nil
+}
+
+// Bad requests get told what was wrong, but auth failures only get the status
+func refuseRequest(w http.ResponseWriter, status int, err error) {
+	if status == http.StatusBadRequest {
+		http.Error(w, err.Error(), status)
+	} else {
+		http.Error(w, http.StatusText(status), status)
+	}
+}
+
 func (s *Sfu) WebsocketHandler(w http.ResponseWriter, r *http.Request) {
+	// Tokens can come in the url or a bearer header, which lets us refuse before upgrading, or as the first message
+	// Trunks from other nodes present either a trunk secret or an access token minted for them as a bearer token
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token = bearerToken(r)
+	}
+
+	roomId, permissions, status, err := s.authorizeRequest(r, token)
+	if err != nil {
+		s.logger.Warn("sfu", "Rejecting websocket from "+r.RemoteAddr+": "+err.Error())
+		refuseRequest(w, status, err)
+		return
+	}
+
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		s.logger.Error("sfu", "Failed to upgrade HTTP to Websocket: "+err.Error())
 		return
 	}
 
-	s.remoteClientFactory.NewClient(&RemoteClientParameters{logger: s.logger, ws: ws, s: s})
+	if s.auth.TokensRequired() && token == "" {
+		claims, messageRoom, err := s.readAuthMessage(ws)
+		if err == nil {
+			requestedRoom := r.URL.Query().Get("room")
+			if requestedRoom == "" {
+				requestedRoom = messageRoom
+			}
+
+			roomId, err = roomForClaims(claims, requestedRoom)
+		}
+
+		if err != nil {
+			s.logger.Warn("sfu", "Rejecting websocket from "+r.RemoteAddr+": "+err.Error())
+			ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "unauthorized"), time.Now().Add(time.Second))
+			ws.Close()
+			return
+		}
+
+		permissions = permissionsFromClaims(claims)
+	}
+
+	s.remoteClientFactory.NewClient(&RemoteClientParameters{logger: s.logger, ws: ws, room: roomId, permissions: permissions, s: s})
+}
+
+// Reads and verifies the auth message, which must be the first thing a client sends if it has no token in the url
+// Also returns the room the message asks for, if any
+func (s *Sfu) readAuthMessage(ws *websocket.Conn) (*AccessClaims, string, error) {
+	ws.SetReadDeadline(time.Now().Add(authMessageTimeout))
+	defer ws.SetReadDeadline(time.Time{})
+
+	_, raw, err := ws.ReadMessage()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read auth message: %w", err)
+	}
+
+	var message RemoteNodeMessage
+	if err := proto.Unmarshal(raw, &message); err != nil {
+		return nil, "", fmt.Errorf("failed to unmarshal auth message: %w", err)
+	}
+
+	if message.Auth == nil {
+		return nil, "", fmt.Errorf("first message was not auth")
+	}
+
+	claims, err := s.auth.Verify(message.Auth.Token)
+	return claims, message.Auth.Room, err
+}
+
+// Must be called before serving, with no keys in the authenticator anyone can connect, and only trunk secrets are checked
+func (s *Sfu) SetAuthenticator(auth *Authenticator) {
+	s.auth = auth
+}
+
+// Must be called before any servers are set, without it trunks verify certificates against the system roots and send no credentials
+func (s *Sfu) SetTrunkSecurity(trunkSecurity *TrunkSecurity) {
+	s.trunkSecurity = trunkSecurity
+}
+
+// Must be called before any peer connections are made, after which they, and the web page, offer it as a relay
+func (s *Sfu) SetTurnServer(turnServer *TurnServer) {
+	s.turnServer = turnServer
+}
+
+func DefaultICEServers() []webrtc.ICEServer {
+	return []webrtc.ICEServer{
+		{
+			URLs: []string{"stun:stun.l.google.com:19302"},
+		},
+	}
+}
+
+// Replaces the default public STUN server, for peer connections made from now on and pages loaded from now on
+func (s *Sfu) SetICEServers(servers []webrtc.ICEServer) {
+	s.iceServersMutex.Lock()
+	defer s.iceServersMutex.Unlock()
+
+	s.iceServers = servers
+}
+
+// What peer connections should use, both ours and those of the web clients, where user goes in any TURN username
+func (s *Sfu) ICEServers(user string) []webrtc.ICEServer {
+	s.iceServersMutex.Lock()
+	servers := slices.Clone(s.iceServers)
+	s.iceServersMutex.Unlock()
+
+	if s.turnServer != nil {
+		servers = append(servers, s.turnServer.ICEServers(user)...)
+	}
+
+	return servers
+}
+
+// What a served page is told to use. With access tokens on the TURN credentials only go to pages opened with a
+// valid token, like /sfu?token=... , since they let whoever has them relay through this node
+func (s *Sfu) PageICEServers(r *http.Request) []webrtc.ICEServer {
+	if !s.auth.TokensRequired() {
+		return s.ICEServers("web")
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token = bearerToken(r)
+	}
+
+	var permissions clientPermissions
+	var err error
+	if token != "" {
+		_, permissions, _, err = s.authorizeRequest(r, token)
+	}
+
+	if token == "" || err != nil {
+		s.iceServersMutex.Lock()
+		defer s.iceServersMutex.Unlock()
+
+		return slices.Clone(s.iceServers)
+	}
+
+	user := permissions.identity
+	if user == "" {
+		user = "web"
+	}
+
+	return s.ICEServers(user)
+}
+
+// Recordings go in a directory per room under dir
+func (s *Sfu) SetRecordingDir(dir string) {
+	s.recordingDir = dir
 }
 
 func (s *Sfu) SetMdnsConn(mdnsConn *mdns.Conn) {
@@ -339,7 +1109,9 @@ func (s *Sfu) mdnsLookup(hostname string) (string, error) {
 		return "", fmt.Errorf("attempting to resolve local subnet host while mdns not in use")
 	}
 
-	ctx, _ := context.WithTimeout(context.Background(), 1*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
 	_, addr, err := s.mdnsConn.QueryAddr(ctx, hostname)
 	if err != nil {
 		return "", err
@@ -0,0 +1,234 @@
+package sfu
+
+import (
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Who is speaking in each room, from the audio levels publishers put in their packets (RFC 6464). Every interval each
+// audio track is scored on how loud it was for how much of the time, and the best takes over as dominant speaker once
+// it has stayed well ahead for a few intervals, so a cough or someone talking over doesn't flick it about. Levels are
+// passed on to subscribers in the packets, so nodes at the far end of trunks work out the same for their rooms
+
+const speakerDetectionInterval = 300 * time.Millisecond
+
+// Levels are -dBov, 0 the loudest and 127 silence, and anything at or louder than this counts as speech
+const speechLevel = 60
+
+// Intervals scoring less than this are silence
+const minSpeakerScore = 0.05
+
+// How much of each interval's score goes into a track's running score
+const speakerScoreSmoothing = 0.4
+
+// How far ahead of the dominant speaker a challenger has to be, and for how many intervals in a row, to take over
+const speakerSwitchRatio = 1.5
+const speakerSwitchIntervals = 3
+
+// Written by whatever reads the track, and taken each interval by the SFU
+type audioLevels struct {
+	current  atomic.Int32  // The level with the voice flag in the top bit for the packet being written to sinks, -1 if it had none
+	packets  atomic.Uint32 // Every packet, with a level or not
+	loudness atomic.Uint64 // Sum of how far above silence each speech packet was
+}
+
+func (l *audioLevels) read(extension []byte) {
+	var level rtp.AudioLevelExtension
+	if extension == nil || level.Unmarshal(extension) != nil {
+		l.current.Store(-1)
+		l.packets.Add(1)
+		return
+	}
+
+	current := int32(level.Level)
+	if level.Voice {
+		current |= 0x80
+	}
+
+	l.current.Store(current)
+	l.packets.Add(1)
+
+	if level.Level <= speechLevel {
+		l.loudness.Add(uint64(127 - level.Level))
+	}
+}
+
+// What to put in the packet for subscribers
+func (l *audioLevels) extension() (rtp.AudioLevelExtension, bool) {
+	current := l.current.Load()
+	if current < 0 {
+		return rtp.AudioLevelExtension{}, false
+	}
+
+	return rtp.AudioLevelExtension{Level: uint8(current & 0x7f), Voice: current&0x80 != 0}, true
+}
+
+// From 0 for silence up to 1 for the loudest possible the whole time, starting over each call
+func (l *audioLevels) takeScore() float64 {
+	packets := l.packets.Swap(0)
+	loudness := l.loudness.Swap(0)
+
+	if packets == 0 {
+		return 0
+	}
+
+	return float64(loudness) / (float64(packets) * 127)
+}
+
+func headerExtensionID(extensions []webrtc.RTPHeaderExtensionParameter, uri string) int {
+	for _, extension := range extensions {
+		if extension.URI == uri {
+			return extension.ID
+		}
+	}
+
+	return 0
+}
+
+type speakerScore struct {
+	score     float64
+	lastSpoke time.Time
+}
+
+// Only touched in the SFU goroutine
+type speakerDetector struct {
+	scores map[string]*speakerScore // Audio track umbrellaID -> score
+
+	dominant string
+	recent   []string
+
+	challenger          string
+	challengerIntervals int
+}
+
+func newSpeakerDetector() *speakerDetector {
+	return &speakerDetector{scores: make(map[string]*speakerScore)}
+}
+
+// Scores the room's audio for the interval just gone, returning true if the dominant speaker or order changed
+func (d *speakerDetector) update(tracks map[string]*incomingTrack, now time.Time) bool {
+	for umbrellaId := range d.scores {
+		if _, exists := tracks[umbrellaId]; !exists {
+			delete(d.scores, umbrellaId)
+		}
+	}
+
+	for umbrellaId, t := range tracks {
+		if t.descriptor.Kind != TrackKind_Audio {
+			continue
+		}
+
+		score, exists := d.scores[umbrellaId]
+		if !exists {
+			score = &speakerScore{}
+			d.scores[umbrellaId] = score
+		}
+
+		interval := t.levels.takeScore()
+		score.score = score.score*(1-speakerScoreSmoothing) + interval*speakerScoreSmoothing
+
+		if interval >= minSpeakerScore {
+			score.lastSpoke = now
+		}
+	}
+
+	best := ""
+	for umbrellaId, score := range d.scores {
+		if score.score >= minSpeakerScore && (best == "" || score.score > d.scores[best].score) {
+			best = umbrellaId
+		}
+	}
+
+	dominant := d.dominant
+	if _, exists := d.scores[dominant]; !exists {
+		dominant = ""
+	}
+
+	switch {
+	case best == "" || best == dominant:
+		d.challenger, d.challengerIntervals = "", 0
+	case dominant == "":
+		// Anyone beats nobody, and someone who has gone stops being dominant even if nobody else is speaking
+		dominant = best
+		d.challenger, d.challengerIntervals = "", 0
+	case d.scores[best].score >= d.scores[dominant].score*speakerSwitchRatio:
+		if d.challenger == best {
+			d.challengerIntervals++
+		} else {
+			d.challenger, d.challengerIntervals = best, 1
+		}
+
+		if d.challengerIntervals >= speakerSwitchIntervals {
+			dominant = best
+			d.challenger, d.challengerIntervals = "", 0
+		}
+	default:
+		d.challenger, d.challengerIntervals = "", 0
+	}
+
+	recent := d.ranking(dominant)
+	changed := dominant != d.dominant || !slices.Equal(recent, d.recent)
+
+	d.dominant = dominant
+	d.recent = recent
+
+	return changed
+}
+
+// Dominant first, then by when each last spoke, with ties keeping their last order so two people talking at
+// once don't swap places every interval
+func (d *speakerDetector) ranking(dominant string) []string {
+	ranked := make([]string, 0, len(d.scores))
+	for _, umbrellaId := range d.recent {
+		if _, exists := d.scores[umbrellaId]; exists {
+			ranked = append(ranked, umbrellaId)
+		}
+	}
+
+	newcomers := make([]string, 0)
+	for umbrellaId := range d.scores {
+		if !slices.Contains(ranked, umbrellaId) {
+			newcomers = append(newcomers, umbrellaId)
+		}
+	}
+	slices.Sort(newcomers)
+	ranked = append(ranked, newcomers...)
+
+	slices.SortStableFunc(ranked, func(a, b string) int {
+		switch {
+		case a == dominant:
+			return -1
+		case b == dominant:
+			return 1
+		}
+
+		return d.scores[b].lastSpoke.Compare(d.scores[a].lastSpoke)
+	})
+
+	return ranked
+}
+
+func (d *speakerDetector) message() *ActiveSpeakers {
+	return &ActiveSpeakers{Dominant: d.dominant, Recent: slices.Clone(d.recent)}
+}
+
+func (s *Sfu) detectSpeakers() {
+	now := time.Now()
+
+	for _, r := range s.rooms {
+		if !r.speakers.update(r.localTracks, now) {
+			continue
+		}
+
+		speakers := r.speakers.message()
+		for _, c := range r.clients {
+			c.SetActiveSpeakers(speakers)
+		}
+	}
+
+	s.handler.Timeout(sfuDetectSpeakers, nil, speakerDetectionInterval)
+}
@@ -0,0 +1,105 @@
+package sfu
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+func audioLevelExtension(t *testing.T, level uint8, voice bool) []byte {
+	extension, err := rtp.AudioLevelExtension{Level: level, Voice: voice}.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return extension
+}
+
+func TestAudioLevels(t *testing.T) {
+	var levels audioLevels
+
+	levels.read(audioLevelExtension(t, 20, true))
+	if extension, ok := levels.extension(); !ok || extension.Level != 20 || !extension.Voice {
+		t.Errorf("got extension %+v, %v", extension, ok)
+	}
+
+	// A packet without a level has none passed on, rather than the last one
+	levels.read(nil)
+	if _, ok := levels.extension(); ok {
+		t.Error("passed on a level for a packet without one")
+	}
+
+	// Of the four packets so far two were speech, one as loud as can be, and two weren't, one of those without a level
+	levels.read(audioLevelExtension(t, 0, true))
+	levels.read(audioLevelExtension(t, 100, false))
+
+	if score := levels.takeScore(); score != float64(127-20+127)/(4*127) {
+		t.Errorf("got score %v", score)
+	}
+
+	if score := levels.takeScore(); score != 0 {
+		t.Errorf("got score %v after taking it", score)
+	}
+}
+
+func TestSpeakerDetector(t *testing.T) {
+	tracks := make(map[string]*incomingTrack)
+	for _, umbrellaId := range []string{"a", "b", "c"} {
+		tracks[umbrellaId] = newIncomingTrack(&TrackDescriptor{UmbrellaId: umbrellaId, Kind: TrackKind_Audio}, "room")
+	}
+	tracks["video"] = newIncomingTrack(&TrackDescriptor{UmbrellaId: "video", Kind: TrackKind_Video}, "room")
+
+	// Each interval whoever is speaking is as loud as can be, and everyone else silent
+	steps := []struct {
+		name         string
+		speaking     []string
+		removed      string
+		wantDominant string
+		wantRecent   []string
+		wantChanged  bool
+	}{
+		{name: "silence", wantRecent: []string{"a", "b", "c"}, wantChanged: true},
+		{name: "still silence", wantRecent: []string{"a", "b", "c"}},
+		{name: "first to speak", speaking: []string{"c"}, wantDominant: "c", wantRecent: []string{"c", "a", "b"}, wantChanged: true},
+		{name: "challenged", speaking: []string{"b"}, wantDominant: "c", wantRecent: []string{"c", "b", "a"}, wantChanged: true},
+		{name: "still challenged", speaking: []string{"b"}, wantDominant: "c", wantRecent: []string{"c", "b", "a"}},
+		{name: "taken over", speaking: []string{"b"}, wantDominant: "b", wantRecent: []string{"b", "c", "a"}, wantChanged: true},
+		{name: "a cough", speaking: []string{"a", "b"}, wantDominant: "b", wantRecent: []string{"b", "a", "c"}, wantChanged: true},
+		{name: "talking over", speaking: []string{"a", "b"}, wantDominant: "b", wantRecent: []string{"b", "a", "c"}},
+		{name: "dominant gone", speaking: []string{"a"}, removed: "b", wantDominant: "a", wantRecent: []string{"a", "c"}, wantChanged: true},
+	}
+
+	d := newSpeakerDetector()
+	now := time.Now()
+
+	for _, step := range steps {
+		if step.removed != "" {
+			delete(tracks, step.removed)
+		}
+
+		for umbrellaId, track := range tracks {
+			level := uint8(127)
+			if slices.Contains(step.speaking, umbrellaId) {
+				level = 0
+			}
+
+			for range 10 {
+				track.levels.read(audioLevelExtension(t, level, level == 0))
+			}
+		}
+
+		now = now.Add(speakerDetectionInterval)
+		changed := d.update(tracks, now)
+
+		message := d.message()
+		if message.Dominant != step.wantDominant || !slices.Equal(message.Recent, step.wantRecent) {
+			t.Errorf("%s got %q then %v, want %q then %v", step.name, message.Dominant, message.Recent, step.wantDominant, step.wantRecent)
+		}
+
+		if changed != step.wantChanged {
+			t.Errorf("%s got changed %v", step.name, changed)
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package sfu
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"atomirex.com/umbrella/razor"
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
+)
+
+// How long a client gets to report its status before it is left out
+const clientStatusTimeout = 2 * time.Second
+
+// Peer connection states and bitrates change without the SFU hearing about it, so subscribers are refreshed this often anyway
+const statusRefreshInterval = 2 * time.Second
+
+// Updates a subscriber can fall behind by before it is dropped
+const statusSubscriberQueueLength = 16
+
+// Asks every client for its status at once, filling them into the rooms once they have all answered or timed out
+func collectStatus(status *SFUStatus, roomClients [][]RemoteClient) *SFUStatus {
+	var wg sync.WaitGroup
+
+	clientStatuses := make([][]*SFUStatusClient, len(roomClients))
+
+	for i, clients := range roomClients {
+		clientStatuses[i] = make([]*SFUStatusClient, len(clients))
+
+		for j, c := range clients {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				clientStatuses[i][j] = clientStatusWithTimeout(c)
+			}()
+		}
+	}
+
+	wg.Wait()
+
+	for i, r := range status.Rooms {
+		for _, clientStatus := range clientStatuses[i] {
+			if clientStatus != nil {
+				r.Clients = append(r.Clients, clientStatus)
+			}
+		}
+	}
+
+	sortStatus(status)
+
+	return status
+}
+
+func clientStatusWithTimeout(c RemoteClient) *SFUStatusClient {
+	result := make(chan *SFUStatusClient, 1)
+
+	// If the client never answers this goroutine is stuck with it, but the status isn't
+	go func() {
+		result <- c.getStatus()
+	}()
+
+	select {
+	case clientStatus := <-result:
+		if clientStatus != nil {
+			clientStatus.Id = c.ID()
+		}
+		return clientStatus
+	case <-time.After(clientStatusTimeout):
+		return &SFUStatusClient{Id: c.ID(), Label: c.Label(), StatusTimedOut: true}
+	}
+}
+
+// Most of the status comes out of maps, so this puts it in an order which only changes when the status does
+func sortStatus(status *SFUStatus) {
+	byUmbrellaId := func(a, b *TrackDescriptor) int { return strings.Compare(a.UmbrellaId, b.UmbrellaId) }
+
+	sort.Strings(status.Servers)
+	slices.SortFunc(status.ServerStates, func(a, b *ServerState) int { return strings.Compare(a.Url, b.Url) })
+
+	slices.SortFunc(status.Rooms, func(a, b *SFUStatusRoom) int { return strings.Compare(a.Id, b.Id) })
+
+	for _, r := range status.Rooms {
+		slices.SortFunc(r.RelayingTracks, byUmbrellaId)
+		slices.SortFunc(r.Clients, func(a, b *SFUStatusClient) int { return strings.Compare(a.Id, b.Id) })
+
+		for _, c := range r.Clients {
+			slices.SortFunc(c.IncomingTracks, byUmbrellaId)
+			slices.SortFunc(c.OutgoingTracks, byUmbrellaId)
+			slices.SortFunc(c.Senders, func(a, b *SFUStatusSender) int { return strings.Compare(a.UmbrellaId, b.UmbrellaId) })
+			slices.SortFunc(c.MidMapping, func(a, b *MidToUmbrellaIDMapping) int { return strings.Compare(a.Mid, b.Mid) })
+			slices.SortFunc(c.StagedIncomingTracks, func(a, b *SFUStatusStagedIncomingTrack) int {
+				return strings.Compare(a.Mid+"/"+a.Rid, b.Mid+"/"+b.Rid)
+			})
+			sort.Strings(c.Subscriptions)
+
+			for _, pc := range []*SFUStatusPeerConnection{c.IncomingPC, c.OutgoingPC} {
+				if pc != nil {
+					slices.SortFunc(pc.Tracks, func(a, b *SFUStatusTrackStats) int {
+						return strings.Compare(fmt.Sprintf("%s/%s/%d", a.Mid, a.Rid, a.Ssrc), fmt.Sprintf("%s/%s/%d", b.Mid, b.Rid, b.Ssrc))
+					})
+				}
+			}
+		}
+	}
+
+	if status.Recordings != nil {
+		sort.Strings(status.Recordings.Rooms)
+		slices.SortFunc(status.Recordings.Recordings, func(a, b *SFUStatusRecording) int { return strings.Compare(a.UmbrellaId, b.UmbrellaId) })
+	}
+}
+
+// What changed from prev to next, or nil if nothing did
+func statusDelta(prev *SFUStatus, next *SFUStatus) *SFUStatusUpdate {
+	update := &SFUStatusUpdate{
+		Rooms:        make([]*SFUStatusRoomUpdate, 0),
+		RemovedRooms: make([]string, 0),
+	}
+
+	changed := false
+
+	if !slices.Equal(prev.Servers, next.Servers) || !slices.EqualFunc(prev.ServerStates, next.ServerStates, func(a, b *ServerState) bool { return proto.Equal(a, b) }) {
+		update.ServersChanged = true
+		update.Servers = next.Servers
+		update.ServerStates = next.ServerStates
+		changed = true
+	}
+
+	if !proto.Equal(prev.Recordings, next.Recordings) {
+		update.Recordings = next.Recordings
+		changed = true
+	}
+
+	prevRooms := make(map[string]*SFUStatusRoom)
+	for _, r := range prev.Rooms {
+		prevRooms[r.Id] = r
+	}
+
+	for _, r := range next.Rooms {
+		if roomUpdate := roomStatusDelta(prevRooms[r.Id], r); roomUpdate != nil {
+			update.Rooms = append(update.Rooms, roomUpdate)
+			changed = true
+		}
+
+		delete(prevRooms, r.Id)
+	}
+
+	for id := range prevRooms {
+		update.RemovedRooms = append(update.RemovedRooms, id)
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+
+	return update
+}
+
+// A nil prev means the room is new
+func roomStatusDelta(prev *SFUStatusRoom, next *SFUStatusRoom) *SFUStatusRoomUpdate {
+	if prev == nil {
+		prev = &SFUStatusRoom{Id: next.Id}
+	}
+
+	update := &SFUStatusRoomUpdate{
+		Id:             next.Id,
+		Clients:        make([]*SFUStatusClient, 0),
+		RemovedClients: make([]string, 0),
+	}
+
+	changed := len(prev.RelayingTracks) == 0 && len(prev.Clients) == 0
+
+	if !slices.EqualFunc(prev.RelayingTracks, next.RelayingTracks, func(a, b *TrackDescriptor) bool { return proto.Equal(a, b) }) {
+		update.RelayingTracksChanged = true
+		update.RelayingTracks = next.RelayingTracks
+		changed = true
+	}
+
+	prevClients := make(map[string]*SFUStatusClient)
+	for _, c := range prev.Clients {
+		prevClients[c.Id] = c
+	}
+
+	for _, c := range next.Clients {
+		if prevClient, exists := prevClients[c.Id]; !exists || !proto.Equal(prevClient, c) {
+			update.Clients = append(update.Clients, c)
+			changed = true
+		}
+
+		delete(prevClients, c.Id)
+	}
+
+	for id := range prevClients {
+		update.RemovedClients = append(update.RemovedClients, id)
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+
+	return update
+}
+
+type statusHubCommand int
+
+const (
+	statusHubSubscribe statusHubCommand = iota
+	statusHubUnsubscribe
+	statusHubChanged
+	statusHubRefresh
+	statusHubGathered
+)
+
+type statusHubCommandMessage struct {
+	subscriber *statusSubscriber
+	status     *SFUStatus
+}
+
+type statusSubscriber struct {
+	updates chan *SFUStatusUpdate // Closed once the hub is done with the subscriber
+
+	// Only touched by the hub
+	needsSnapshot bool
+}
+
+// Keeps status subscribers up to date, gathering the status whenever the SFU says something changed
+// and sending each subscriber only what is different from last time
+type statusHub struct {
+	s       *Sfu
+	logger  *razor.Logger
+	handler *razor.MessageHandler[statusHubCommand, statusHubCommandMessage]
+
+	subscribers map[*statusSubscriber]bool
+
+	gathering   bool
+	gatherAgain bool // Something changed while gathering, so what is being gathered may be stale
+
+	last *SFUStatus
+}
+
+func newStatusHub(s *Sfu, logger *razor.Logger) *statusHub {
+	h := &statusHub{
+		s:           s,
+		logger:      logger,
+		subscribers: make(map[*statusSubscriber]bool),
+	}
+
+	h.handler = razor.NewMessageHandler(logger, "status", 256, func(what statusHubCommand, payload *statusHubCommandMessage) bool {
+		switch what {
+		case statusHubSubscribe:
+			payload.subscriber.needsSnapshot = true
+			h.subscribers[payload.subscriber] = true
+
+			if len(h.subscribers) == 1 {
+				h.handler.Cancel(statusHubRefresh)
+				h.handler.Timeout(statusHubRefresh, nil, statusRefreshInterval)
+			}
+
+			h.gather()
+		case statusHubUnsubscribe:
+			h.removeSubscriber(payload.subscriber)
+		case statusHubChanged:
+			if len(h.subscribers) > 0 {
+				h.gather()
+			}
+		case statusHubRefresh:
+			if len(h.subscribers) > 0 {
+				h.gather()
+				h.handler.Timeout(statusHubRefresh, nil, statusRefreshInterval)
+			}
+		case statusHubGathered:
+			h.gathering = false
+
+			var delta *SFUStatusUpdate
+			if h.last != nil {
+				delta = statusDelta(h.last, payload.status)
+			}
+
+			h.last = payload.status
+
+			for subscriber := range h.subscribers {
+				update := delta
+				if subscriber.needsSnapshot {
+					update = &SFUStatusUpdate{Snapshot: payload.status}
+				}
+
+				if update == nil {
+					continue
+				}
+
+				select {
+				case subscriber.updates <- update:
+					subscriber.needsSnapshot = false
+				default:
+					h.logger.Warn("status", "Dropping status subscriber which has fallen behind")
+					h.removeSubscriber(subscriber)
+				}
+			}
+
+			if h.gatherAgain {
+				h.gatherAgain = false
+				h.gather()
+			}
+		}
+
+		return true
+	})
+
+	h.handler.Loop(nil)
+
+	return h
+}
+
+// Gathering waits on clients so happens off the handler, with at most one at a time
+func (h *statusHub) gather() {
+	if h.gathering {
+		h.gatherAgain = true
+		return
+	}
+
+	h.gathering = true
+
+	go func() {
+		h.handler.Send(statusHubGathered, &statusHubCommandMessage{status: h.s.GetStatus()})
+	}()
+}
+
+func (h *statusHub) removeSubscriber(subscriber *statusSubscriber) {
+	if h.subscribers[subscriber] {
+		delete(h.subscribers, subscriber)
+		close(subscriber.updates)
+	}
+}
+
+func (h *statusHub) subscribe() *statusSubscriber {
+	subscriber := &statusSubscriber{updates: make(chan *SFUStatusUpdate, statusSubscriberQueueLength)}
+	h.handler.Send(statusHubSubscribe, &statusHubCommandMessage{subscriber: subscriber})
+	return subscriber
+}
+
+func (h *statusHub) unsubscribe(subscriber *statusSubscriber) {
+	h.handler.Send(statusHubUnsubscribe, &statusHubCommandMessage{subscriber: subscriber})
+}
+
+// Called by the SFU whenever clients, tracks, servers or recordings change
+func (h *statusHub) changed() {
+	h.handler.Send(statusHubChanged, nil)
+}
+
+// Streams SFUStatusUpdate protos over a websocket, starting with a snapshot
+func (s *Sfu) StatusStreamHandler(w http.ResponseWriter, r *http.Request) {
+	// Browsers can't set headers on websockets, so the status page passes on the token from its url
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token = bearerToken(r)
+	}
+
+	if _, authorized := s.authorizeAdminToken(w, r, token); !authorized {
+		return
+	}
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.logger.Error("status", "Failed to upgrade status stream: "+err.Error())
+		return
+	}
+	defer ws.Close()
+
+	subscriber := s.statusHub.subscribe()
+	defer s.statusHub.unsubscribe(subscriber)
+
+	// Nothing is expected from the other end, reading is only to notice it going away
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case update, ok := <-subscriber.updates:
+			if !ok {
+				return
+			}
+
+			data, err := proto.Marshal(update)
+			if s.logger.NilErrCheck("status", "Failed to marshal status update", err) {
+				return
+			}
+
+			if err := ws.WriteMessage(websocket.BinaryMessage, data); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
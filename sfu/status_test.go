@@ -0,0 +1,273 @@
+package sfu
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestStatusStreamNeedsAdmin(t *testing.T) {
+	s, _, user := newTestAdminAuth(t)
+
+	tests := []struct {
+		name       string
+		url        string
+		bearer     string
+		wantStatus int
+	}{
+		{name: "no token", url: "/status/ws", wantStatus: http.StatusUnauthorized},
+		{name: "bad token in url", url: "/status/ws?token=guess", wantStatus: http.StatusUnauthorized},
+		{name: "not an admin in url", url: "/status/ws?token=" + user, wantStatus: http.StatusForbidden},
+		{name: "not an admin as bearer", url: "/status/ws", bearer: user, wantStatus: http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, test.url, nil)
+			if test.bearer != "" {
+				r.Header.Set("Authorization", "Bearer "+test.bearer)
+			}
+
+			w := httptest.NewRecorder()
+			s.StatusStreamHandler(w, r)
+
+			if w.Code != test.wantStatus {
+				t.Errorf("got status %d, want %d", w.Code, test.wantStatus)
+			}
+		})
+	}
+}
+
+func TestStatusStreamAdmin(t *testing.T) {
+	s, admin, _ := newTestAdminAuth(t)
+
+	// Let through to the upgrade, which a plain request fails
+	w := httptest.NewRecorder()
+	s.StatusStreamHandler(w, httptest.NewRequest(http.MethodGet, "/status/ws?token="+admin, nil))
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want the upgrade to have been tried", w.Code)
+	}
+}
+
+// Does to prev what the status page does with an update, so it can be checked against what was sent
+func applyStatusUpdate(prev *SFUStatus, update *SFUStatusUpdate) *SFUStatus {
+	if update.Snapshot != nil {
+		return update.Snapshot
+	}
+
+	next := proto.Clone(prev).(*SFUStatus)
+
+	if update.ServersChanged {
+		next.Servers = update.Servers
+		next.ServerStates = update.ServerStates
+	}
+
+	if update.Recordings != nil {
+		next.Recordings = update.Recordings
+	}
+
+	next.Rooms = slices.DeleteFunc(next.Rooms, func(r *SFUStatusRoom) bool { return slices.Contains(update.RemovedRooms, r.Id) })
+
+	for _, roomUpdate := range update.Rooms {
+		i := slices.IndexFunc(next.Rooms, func(r *SFUStatusRoom) bool { return r.Id == roomUpdate.Id })
+		if i < 0 {
+			next.Rooms = append(next.Rooms, &SFUStatusRoom{Id: roomUpdate.Id})
+			i = len(next.Rooms) - 1
+		}
+
+		r := next.Rooms[i]
+
+		if roomUpdate.RelayingTracksChanged {
+			r.RelayingTracks = roomUpdate.RelayingTracks
+		}
+
+		r.Clients = slices.DeleteFunc(r.Clients, func(c *SFUStatusClient) bool {
+			return slices.Contains(roomUpdate.RemovedClients, c.Id) ||
+				slices.ContainsFunc(roomUpdate.Clients, func(changed *SFUStatusClient) bool { return changed.Id == c.Id })
+		})
+		r.Clients = append(r.Clients, roomUpdate.Clients...)
+	}
+
+	sortStatus(next)
+
+	return next
+}
+
+func testStatus(rooms map[string][]string) *SFUStatus {
+	status := &SFUStatus{Servers: []string{"wss://a.example"}}
+
+	for id, clients := range rooms {
+		r := &SFUStatusRoom{Id: id}
+		for _, clientId := range clients {
+			r.Clients = append(r.Clients, &SFUStatusClient{Id: clientId, Label: clientId})
+		}
+
+		status.Rooms = append(status.Rooms, r)
+	}
+
+	sortStatus(status)
+
+	return status
+}
+
+func TestStatusDelta(t *testing.T) {
+	prev := testStatus(map[string][]string{"kitchen": {"alice", "bob"}, "garden": {"carol"}})
+
+	tests := []struct {
+		name        string
+		change      func(next *SFUStatus)
+		wantNil     bool
+		wantRooms   []string
+		wantClients []string // Sent for the first changed room
+		wantRemoved []string // Rooms, or clients of the first changed room
+	}{
+		{name: "nothing", change: func(next *SFUStatus) {}, wantNil: true},
+		{name: "client changed", change: func(next *SFUStatus) { next.Rooms[1].Clients[1].Label = "bobby" }, wantRooms: []string{"kitchen"}, wantClients: []string{"bob"}},
+		{name: "client joined", change: func(next *SFUStatus) {
+			next.Rooms[1].Clients = append(next.Rooms[1].Clients, &SFUStatusClient{Id: "dave"})
+		}, wantRooms: []string{"kitchen"}, wantClients: []string{"dave"}},
+		{name: "client left", change: func(next *SFUStatus) { next.Rooms[1].Clients = next.Rooms[1].Clients[1:] }, wantRooms: []string{"kitchen"}, wantRemoved: []string{"alice"}},
+		{name: "room gone", change: func(next *SFUStatus) { next.Rooms = next.Rooms[1:] }, wantRemoved: []string{"garden"}},
+		{name: "room new", change: func(next *SFUStatus) {
+			next.Rooms = append(next.Rooms, &SFUStatusRoom{Id: "attic", Clients: []*SFUStatusClient{{Id: "eve"}}})
+		}, wantRooms: []string{"attic"}, wantClients: []string{"eve"}},
+		{name: "tracks relayed", change: func(next *SFUStatus) {
+			next.Rooms[0].RelayingTracks = []*TrackDescriptor{{UmbrellaId: "cam"}}
+		}, wantRooms: []string{"garden"}},
+		{name: "servers", change: func(next *SFUStatus) { next.Servers = append(next.Servers, "wss://b.example") }},
+		{name: "recordings", change: func(next *SFUStatus) { next.Recordings = &Recordings{Rooms: []string{"kitchen"}} }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := proto.Clone(prev).(*SFUStatus)
+			test.change(next)
+			sortStatus(next)
+
+			update := statusDelta(prev, next)
+			if test.wantNil {
+				if update != nil {
+					t.Fatalf("got update %v for no change", update)
+				}
+				return
+			}
+
+			if update == nil {
+				t.Fatal("got no update")
+			}
+
+			rooms := make([]string, 0)
+			for _, r := range update.Rooms {
+				rooms = append(rooms, r.Id)
+			}
+
+			if !slices.Equal(rooms, nonNil(test.wantRooms)) {
+				t.Errorf("got rooms %v, want %v", rooms, test.wantRooms)
+			}
+
+			if len(update.Rooms) > 0 {
+				clients := make([]string, 0)
+				for _, c := range update.Rooms[0].Clients {
+					clients = append(clients, c.Id)
+				}
+
+				if !slices.Equal(clients, nonNil(test.wantClients)) {
+					t.Errorf("got clients %v, want %v", clients, test.wantClients)
+				}
+
+				if !slices.Equal(update.Rooms[0].RemovedClients, nonNil(test.wantRemoved)) {
+					t.Errorf("got removed clients %v, want %v", update.Rooms[0].RemovedClients, test.wantRemoved)
+				}
+			} else if !slices.Equal(update.RemovedRooms, nonNil(test.wantRemoved)) {
+				t.Errorf("got removed rooms %v, want %v", update.RemovedRooms, test.wantRemoved)
+			}
+
+			if applied := applyStatusUpdate(prev, update); !proto.Equal(applied, next) {
+				t.Errorf("applying the update gives %v, want %v", applied, next)
+			}
+		})
+	}
+}
+
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+
+	return s
+}
+
+// Waits for an update which matches, skipping the refreshes before it
+func nextStatusUpdate(t *testing.T, subscriber *statusSubscriber, match func(update *SFUStatusUpdate) bool) *SFUStatusUpdate {
+	timeout := time.After(5 * time.Second)
+
+	for {
+		select {
+		case update, open := <-subscriber.updates:
+			if !open {
+				t.Fatal("subscriber was dropped")
+			}
+
+			if match(update) {
+				return update
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for a status update")
+		}
+	}
+}
+
+func TestStatusHub(t *testing.T) {
+	s := newTestSfu(t)
+	subscriber := s.statusHub.subscribe()
+
+	first := nextStatusUpdate(t, subscriber, func(update *SFUStatusUpdate) bool { return true })
+	if first.Snapshot == nil {
+		t.Fatalf("first update %v isn't a snapshot", first)
+	}
+
+	_, offer := newTestOffer(t, publishingOffer)
+
+	w := httptest.NewRecorder()
+	s.WhipHandler(w, sessionRequest(http.MethodPost, "/whip?room=kitchen", "application/sdp", offer, ""))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got status %d, %s", w.Code, w.Body.String())
+	}
+
+	location := w.Header().Get("Location")
+
+	// Only the change is sent, not the whole status again
+	joined := nextStatusUpdate(t, subscriber, func(update *SFUStatusUpdate) bool {
+		return len(update.Rooms) == 1 && update.Rooms[0].Id == "kitchen" && len(update.Rooms[0].Clients) == 1
+	})
+	if joined.Snapshot != nil {
+		t.Error("got a snapshot for a client joining")
+	}
+
+	w = httptest.NewRecorder()
+	s.WhipHandler(w, sessionRequest(http.MethodDelete, location, "", "", ""))
+
+	nextStatusUpdate(t, subscriber, func(update *SFUStatusUpdate) bool {
+		return slices.Contains(update.RemovedRooms, "kitchen") ||
+			(len(update.Rooms) == 1 && len(update.Rooms[0].RemovedClients) == 1)
+	})
+
+	s.statusHub.unsubscribe(subscriber)
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, open := <-subscriber.updates:
+			if !open {
+				return
+			}
+		case <-timeout:
+			t.Fatal("updates weren't closed on unsubscribing")
+		}
+	}
+}
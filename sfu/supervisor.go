@@ -0,0 +1,197 @@
+package sfu
+
+import (
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Trunks and RTSP sources are servers we connect out to. Each client instance makes one attempt, and once it
+// stops for any reason the SFU waits out a backoff and starts a fresh one, for as long as the server is wanted
+
+const serverBackoffMin = time.Second
+const serverBackoffMax = 2 * time.Minute
+
+// Staying connected this long means the next failure starts the backoff again from the bottom
+const serverStableAfter = 30 * time.Second
+
+type supervisedServer struct {
+	url    string
+	client RemoteClient // nil while backing off
+
+	state       ServerConnectionState
+	failures    int32
+	connectedAt time.Time
+	retryAt     time.Time
+	lastError   string
+}
+
+// Doubles with each failure up to the max, landing somewhere in the upper half so servers don't retry in lockstep
+func serverBackoff(failures int32) time.Duration {
+	backoff := serverBackoffMin
+	for i := int32(1); i < failures && backoff < serverBackoffMax; i++ {
+		backoff *= 2
+	}
+
+	backoff = min(backoff, serverBackoffMax)
+
+	return backoff/2 + rand.N(backoff/2+1)
+}
+
+func (s *Sfu) serverStatus(server *supervisedServer) *ServerState {
+	state := &ServerState{
+		Url:       server.url,
+		State:     server.state,
+		Failures:  server.failures,
+		LastError: server.lastError,
+	}
+
+	if entry, exists := s.intendedServers[server.url]; exists {
+		state.Name = entry.Name
+	}
+
+	if server.state == ServerConnectionState_BackingOff {
+		state.RetryAt = server.retryAt.UnixMilli()
+	}
+
+	return state
+}
+
+// The first reason given for a client stopping, which can come from any of its goroutines
+type failureReason struct {
+	mutex  sync.Mutex
+	reason string
+}
+
+func (f *failureReason) set(reason string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.reason == "" {
+		f.reason = reason
+	}
+}
+
+func (f *failureReason) get() string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.reason
+}
+
+func (s *Sfu) startServer(server *supervisedServer) {
+	server.state = ServerConnectionState_Connecting
+	server.client = s.remoteClientFactory.NewClient(&RemoteClientParameters{
+		logger:      s.logger,
+		trunkurl:    server.url,
+		room:        roomIDFromTrunkURL(server.url),
+		permissions: allPermissions,
+		s:           s,
+	})
+}
+
+func (s *Sfu) serverStates() []*ServerState {
+	states := make([]*ServerState, 0, len(s.servers))
+	for _, server := range s.servers {
+		states = append(states, s.serverStatus(server))
+	}
+
+	return states
+}
+
+// The server a client was started for, if the client is still the current attempt at it
+func (s *Sfu) serverFor(client RemoteClient) *supervisedServer {
+	for _, server := range s.servers {
+		if server.client == client {
+			return server
+		}
+	}
+
+	return nil
+}
+
+func (s *Sfu) onServerConnected(client RemoteClient) {
+	server := s.serverFor(client)
+	if server == nil || server.state != ServerConnectionState_Connecting {
+		return
+	}
+
+	server.state = ServerConnectionState_Connected
+	server.connectedAt = time.Now()
+	server.lastError = ""
+}
+
+func (s *Sfu) onServerStopped(client RemoteClient, reason string) {
+	server := s.serverFor(client)
+	if server == nil {
+		return
+	}
+
+	server.client = nil
+
+	if !s.isIntended(server.url) {
+		delete(s.servers, server.url)
+		return
+	}
+
+	// Asked to stop then wanted again before it finished, so not a failure
+	if server.state == ServerConnectionState_Stopped {
+		server.failures = 0
+		s.startServer(server)
+		return
+	}
+
+	if server.state == ServerConnectionState_Connected && time.Since(server.connectedAt) >= serverStableAfter {
+		server.failures = 0
+	}
+
+	if reason == "" {
+		reason = "Stopped"
+	}
+
+	server.failures++
+	server.lastError = reason
+	server.state = ServerConnectionState_BackingOff
+	server.retryAt = time.Now().Add(serverBackoff(server.failures))
+
+	s.logger.Warn("sfu", "Server "+server.url+" stopped: "+reason+", retrying in "+time.Until(server.retryAt).Round(time.Millisecond).String())
+
+	s.scheduleRedial()
+}
+
+func (s *Sfu) redialServers() {
+	now := time.Now()
+	for _, server := range s.servers {
+		if server.state == ServerConnectionState_BackingOff && !now.Before(server.retryAt) {
+			s.startServer(server)
+		}
+	}
+
+	s.scheduleRedial()
+}
+
+// Wakes up for whichever backing off server is due first
+func (s *Sfu) scheduleRedial() {
+	s.handler.Cancel(sfuRedialServers)
+
+	var next time.Time
+	for _, server := range s.servers {
+		if server.state == ServerConnectionState_BackingOff && (next.IsZero() || server.retryAt.Before(next)) {
+			next = server.retryAt
+		}
+	}
+
+	if !next.IsZero() {
+		s.handler.Timeout(sfuRedialServers, nil, max(time.Until(next), 0))
+	}
+}
+
+// Called by supervised clients once they are up
+func (s *Sfu) serverConnected(client RemoteClient) {
+	s.handler.Send(sfuServerConnected, &sfuCommandMessage{client: client})
+}
+
+// Called by supervised clients as the last thing they do, with why if it wasn't asked for
+func (s *Sfu) serverStopped(client RemoteClient, reason string) {
+	s.handler.Send(sfuServerStopped, &sfuCommandMessage{client: client, reason: reason})
+}
@@ -0,0 +1,172 @@
+package sfu
+
+import (
+	"testing"
+	"time"
+
+	"atomirex.com/umbrella/razor"
+)
+
+func TestServerBackoff(t *testing.T) {
+	tests := []struct {
+		failures int32
+		want     time.Duration
+	}{
+		{failures: 1, want: time.Second},
+		{failures: 2, want: 2 * time.Second},
+		{failures: 5, want: 16 * time.Second},
+		{failures: 8, want: serverBackoffMax},
+		{failures: 1000, want: serverBackoffMax},
+	}
+
+	for _, test := range tests {
+		for range 100 {
+			if backoff := serverBackoff(test.failures); backoff < test.want/2 || backoff > test.want {
+				t.Errorf("%d failures backed off %s, want between %s and %s", test.failures, backoff, test.want/2, test.want)
+			}
+		}
+	}
+}
+
+// Hands out clients which do nothing, remembering each so the test can say when they connect and stop
+type testServerClients struct {
+	started []RemoteClient
+}
+
+func (f *testServerClients) NewClient(params *RemoteClientParameters) RemoteClient {
+	c := &dataRecipient{BaseClient: BaseClient{id: params.trunkurl, room: params.room}}
+	f.started = append(f.started, c)
+	return c
+}
+
+func (f *testServerClients) latest() RemoteClient {
+	return f.started[len(f.started)-1]
+}
+
+// The handler is never looped, so redials are only scheduled and the test does the rest
+func newTestSupervisor() (*Sfu, *testServerClients) {
+	logger := razor.NewLogger(razor.LoggingLevelOff, false)
+	clients := &testServerClients{}
+
+	s := &Sfu{
+		logger:              logger,
+		remoteClientFactory: clients,
+		servers:             make(map[string]*supervisedServer),
+		intendedServers:     make(map[string]*ServerEntry),
+		handler: razor.NewMessageHandler(logger, "sfu", 16, func(what sfuCommand, payload *sfuCommandMessage) bool {
+			return true
+		}),
+	}
+
+	return s, clients
+}
+
+func TestServerSupervision(t *testing.T) {
+	const url = "wss://a.example/ws"
+
+	s, clients := newTestSupervisor()
+
+	s.intendedServers[url] = &ServerEntry{Url: url, Enabled: true}
+	s.evaluateServers()
+
+	server := s.servers[url]
+	if server == nil || server.state != ServerConnectionState_Connecting || len(clients.started) != 1 {
+		t.Fatalf("server wasn't started: %+v", server)
+	}
+
+	first := clients.latest()
+	s.onServerStopped(first, "refused")
+
+	if server.state != ServerConnectionState_BackingOff || server.failures != 1 || server.lastError != "refused" || server.client != nil {
+		t.Fatalf("after failing got %+v", server)
+	}
+
+	// Worked out from a slightly later now
+	if next := s.handler.NextWorkAt(); next.Sub(server.retryAt).Abs() > 10*time.Millisecond || time.Until(next) > time.Second {
+		t.Errorf("redial scheduled at %s for a retry at %s", next, server.retryAt)
+	}
+
+	// Not due yet
+	s.redialServers()
+	if server.state != ServerConnectionState_BackingOff {
+		t.Fatalf("redialed early: %+v", server)
+	}
+
+	server.retryAt = time.Now().Add(-time.Millisecond)
+	s.redialServers()
+
+	if server.state != ServerConnectionState_Connecting || len(clients.started) != 2 {
+		t.Fatalf("server wasn't redialed: %+v", server)
+	}
+
+	// Anything from an earlier attempt is ignored
+	s.onServerStopped(first, "late")
+	s.onServerConnected(first)
+	if server.state != ServerConnectionState_Connecting || server.lastError != "refused" {
+		t.Errorf("old client changed the server: %+v", server)
+	}
+
+	s.onServerConnected(clients.latest())
+	if server.state != ServerConnectionState_Connected || server.lastError != "" {
+		t.Fatalf("after connecting got %+v", server)
+	}
+
+	// Dropping straight after connecting keeps counting
+	s.onServerStopped(clients.latest(), "")
+	if server.failures != 2 || server.lastError != "Stopped" {
+		t.Errorf("after a short connection got %+v", server)
+	}
+
+	// Staying up long enough starts again from the bottom
+	s.redialServers()
+	server.retryAt = time.Now().Add(-time.Millisecond)
+	s.redialServers()
+	s.onServerConnected(clients.latest())
+	server.connectedAt = time.Now().Add(-serverStableAfter)
+
+	s.onServerStopped(clients.latest(), "closed")
+	if server.failures != 1 {
+		t.Errorf("after a long connection got %d failures", server.failures)
+	}
+}
+
+func TestServerStoppedByRequest(t *testing.T) {
+	const url = "wss://a.example/ws"
+
+	s, clients := newTestSupervisor()
+
+	s.intendedServers[url] = &ServerEntry{Url: url, Enabled: true}
+	s.evaluateServers()
+	s.onServerConnected(clients.latest())
+
+	server := s.servers[url]
+
+	// Wanted again before the client finished stopping, so it's restarted without backing off
+	s.intendedServers[url].Enabled = false
+	s.evaluateServers()
+
+	if server.state != ServerConnectionState_Stopped {
+		t.Fatalf("server wasn't stopped: %+v", server)
+	}
+
+	s.intendedServers[url].Enabled = true
+	s.evaluateServers()
+	s.onServerStopped(clients.latest(), "")
+
+	if server.state != ServerConnectionState_Connecting || server.failures != 0 || len(clients.started) != 2 {
+		t.Fatalf("server wasn't restarted: %+v", server)
+	}
+
+	// No longer wanted, so gone once stopped
+	s.intendedServers[url].Enabled = false
+	s.evaluateServers()
+	s.onServerStopped(clients.latest(), "")
+
+	if _, exists := s.servers[url]; exists {
+		t.Error("server is still supervised")
+	}
+
+	if !s.handler.NextWorkAt().Equal(razor.EndOfTime) {
+		t.Error("a redial is still scheduled")
+	}
+}
@@ -2,24 +2,309 @@ package sfu
 
 import (
 	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v4"
 )
 
+// Anything that wants the RTP packets of an incoming track, such as a subscriber's downTrack
+// Called from the goroutine reading the layer, so implementations must be quick and not block
+type packetSink interface {
+	writeRTP(rid string, pkt *rtp.Packet)
+}
+
 type incomingTrack struct {
 	descriptor *TrackDescriptor
-	remote     *webrtc.TrackRemote
-	relay      *webrtc.TrackLocalStaticRTP
+	room       string // The room of the client which published the track
+	codec      webrtc.RTPCodecCapability
 	receiver   *webrtc.RTPReceiver
+
+	// Asks the publisher for a keyframe on a layer, set by whatever owns the track
+	keyframeRequester func(rid string)
+
+	// Subscribers lose packets at the same time, so their requests are boiled down to one per layer
+	keyframeMutex        sync.Mutex
+	lastKeyframeRequests map[string]time.Time
+
+	mutex sync.RWMutex
+
+	// Simulcast layers by rid, where a track without simulcast has the single layer ""
+	layers map[string]*trackLayer
+	sinks  map[packetSink]bool
+
+	// Best quality first, replaced whenever it changes so sinks can read it without taking the lock
+	rankedLayers atomic.Pointer[[]string]
+
+	// For metrics, where out is summed over every subscriber
+	packetsIn   atomic.Uint64
+	bytesIn     atomic.Uint64
+	packetsOut  atomic.Uint64
+	bytesOut    atomic.Uint64
+	writeErrors atomic.Uint64
+
+	// Only for audio, and only when the publisher sends them
+	levels audioLevels
+}
+
+type trackLayer struct {
+	rid string
+
+	// Only touched by the goroutine writing the layer
+	windowStart time.Time
+	windowBytes uint64
+
+	bitrate atomic.Uint64 // bits per second over the last window
+
+	// Video from the start of the last keyframe up to the latest packet, so new subscribers can start straight away
+	// Only added to by the goroutine writing the layer, and empty while waiting for a keyframe. A keyframe can take
+	// several packets which each look like one, such as H264's SPS and PPS followed by the IDR slices, so the first
+	// packet of the keyframe is the first one with its timestamp
+	gopMutex sync.Mutex
+	gop      []*rtp.Packet
+	gopBytes int
+}
+
+// Beyond this a layer's keyframes are too far apart to be worth keeping everything since, as with browsers which only
+// send them when asked, so new subscribers ask for one instead
+const maxCachedGopBytes = 512 * 1024
+
+// Publishers are asked for a keyframe on each layer at most this often, however many subscribers want one
+const keyframeRequestInterval = 500 * time.Millisecond
+
+// How often the layer bitrates are measured, and so how often the ranking can change
+const layerBitrateWindow = time.Second
+
+func newIncomingTrack(descriptor *TrackDescriptor, room string) *incomingTrack {
+	t := &incomingTrack{
+		descriptor: descriptor,
+		room:       room,
+		layers:     make(map[string]*trackLayer),
+		sinks:      make(map[packetSink]bool),
+
+		lastKeyframeRequests: make(map[string]time.Time),
+	}
+
+	t.rankedLayers.Store(&[]string{})
+	t.levels.current.Store(-1)
+
+	return t
 }
 
 func (it *incomingTrack) String() string {
-	return fmt.Sprintf("{IncomingTrack id: %s}", it.descriptor.UmbrellaId)
+	return fmt.Sprintf("{IncomingTrack id: %s room: %s}", it.descriptor.UmbrellaId, it.room)
+}
+
+func (it *incomingTrack) addLayer(rid string) {
+	it.mutex.Lock()
+	defer it.mutex.Unlock()
+
+	if _, exists := it.layers[rid]; !exists {
+		it.layers[rid] = &trackLayer{rid: rid, windowStart: time.Now()}
+		it.rankLayers()
+	}
+}
+
+// Returns true if that was the last layer
+func (it *incomingTrack) removeLayer(rid string) bool {
+	it.mutex.Lock()
+	defer it.mutex.Unlock()
+
+	delete(it.layers, rid)
+	it.rankLayers()
+
+	return len(it.layers) == 0
+}
+
+func (it *incomingTrack) isSimulcast() bool {
+	layers := *it.rankedLayers.Load()
+	return len(layers) > 1 || (len(layers) == 1 && layers[0] != "")
+}
+
+func (it *incomingTrack) getRankedLayers() []string {
+	return *it.rankedLayers.Load()
+}
+
+func (it *incomingTrack) layerBitrate(rid string) uint64 {
+	it.mutex.RLock()
+	defer it.mutex.RUnlock()
+
+	layer, exists := it.layers[rid]
+	if !exists {
+		return 0
+	}
+
+	return layer.bitrate.Load()
+}
+
+func (it *incomingTrack) addSink(sink packetSink) {
+	it.mutex.Lock()
+	defer it.mutex.Unlock()
+
+	it.sinks[sink] = true
+}
+
+func (it *incomingTrack) removeSink(sink packetSink) {
+	it.mutex.Lock()
+	defer it.mutex.Unlock()
+
+	delete(it.sinks, sink)
+}
+
+func (it *incomingTrack) requestKeyframe(rid string) {
+	if it.keyframeRequester == nil {
+		return
+	}
+
+	it.keyframeMutex.Lock()
+	now := time.Now()
+	throttled := now.Sub(it.lastKeyframeRequests[rid]) < keyframeRequestInterval
+	if !throttled {
+		it.lastKeyframeRequests[rid] = now
+	}
+	it.keyframeMutex.Unlock()
+
+	if !throttled {
+		it.keyframeRequester(rid)
+	}
+}
+
+// Passes a packet read from one layer to every sink
+func (it *incomingTrack) writeRTP(rid string, pkt *rtp.Packet) {
+	it.mutex.RLock()
+
+	layer, exists := it.layers[rid]
+	if !exists {
+		it.mutex.RUnlock()
+		return
+	}
+
+	it.packetsIn.Add(1)
+	it.bytesIn.Add(uint64(pkt.MarshalSize()))
+
+	for sink := range it.sinks {
+		sink.writeRTP(rid, pkt)
+	}
+
+	it.mutex.RUnlock()
+
+	// After the sinks, so a sink starting on this packet gets everything before it from the cache
+	if it.descriptor.Kind == TrackKind_Video {
+		layer.cachePacket(it.codec.MimeType, pkt)
+	}
+
+	layer.windowBytes += uint64(len(pkt.Payload))
+	if elapsed := time.Since(layer.windowStart); elapsed >= layerBitrateWindow {
+		layer.bitrate.Store(uint64(float64(layer.windowBytes*8) / elapsed.Seconds()))
+		layer.windowBytes = 0
+		layer.windowStart = time.Now()
+
+		if it.isSimulcast() {
+			it.mutex.Lock()
+			it.rankLayers()
+			it.mutex.Unlock()
+		}
+	}
+}
+
+func (l *trackLayer) cachePacket(mimeType string, pkt *rtp.Packet) {
+	l.gopMutex.Lock()
+	defer l.gopMutex.Unlock()
+
+	if startsGop(mimeType, pkt, l.gop) {
+		// Replaced rather than truncated, since sinks may still be replaying the old one
+		l.gop = nil
+		l.gopBytes = 0
+	} else if len(l.gop) == 0 {
+		return
+	}
+
+	if l.gopBytes+len(pkt.Payload) > maxCachedGopBytes {
+		l.gop = nil
+		l.gopBytes = 0
+		return
+	}
+
+	// The packet and its buffer get reused by whatever is reading the track
+	l.gop = append(l.gop, pkt.Clone())
+	l.gopBytes += len(pkt.Payload)
+}
+
+// Whether a packet is the first of a new keyframe rather than more of the one the gop starts with
+func startsGop(mimeType string, pkt *rtp.Packet, gop []*rtp.Packet) bool {
+	if !isKeyframe(mimeType, pkt.Payload) {
+		return false
+	}
+
+	return len(gop) == 0 || gop[0].Timestamp != pkt.Timestamp
+}
+
+// The packets of a layer from its last keyframe on, for sinks, which are called with the read lock held
+func (it *incomingTrack) cachedGop(rid string) []*rtp.Packet {
+	layer, exists := it.layers[rid]
+	if !exists {
+		return nil
+	}
+
+	layer.gopMutex.Lock()
+	defer layer.gopMutex.Unlock()
+
+	return slices.Clone(layer.gop)
+}
+
+// Orders the layers best first, by measured bitrate once every layer has one, and otherwise by the usual rid names
+// Must be called with the lock held
+func (it *incomingTrack) rankLayers() {
+	ranked := make([]string, 0, len(it.layers))
+	allMeasured := true
+	for rid, layer := range it.layers {
+		ranked = append(ranked, rid)
+		allMeasured = allMeasured && layer.bitrate.Load() > 0
+	}
+
+	_, hasFull := it.layers["f"]
+
+	sort.Slice(ranked, func(i, j int) bool {
+		if allMeasured {
+			return it.layers[ranked[i]].bitrate.Load() > it.layers[ranked[j]].bitrate.Load()
+		}
+
+		return ridQualityGuess(ranked[i], hasFull) > ridQualityGuess(ranked[j], hasFull)
+	})
+
+	it.rankedLayers.Store(&ranked)
+}
+
+// Browsers and libraries tend to name layers q/h/f, l/m/h or 0/1/2 from low to high
+// so "h" is the middle layer if there is an "f" and otherwise the top
+func ridQualityGuess(rid string, hasFull bool) int {
+	switch rid {
+	case "q", "l", "0":
+		return 0
+	case "m", "1":
+		return 1
+	case "h":
+		if hasFull {
+			return 1
+		}
+		return 2
+	case "f", "2":
+		return 2
+	}
+
+	return 1
 }
 
 type incomingTrackWithClientState struct {
 	track *incomingTrack
 
+	// rid -> the pion track for that layer
+	remotes map[string]*webrtc.TrackRemote
+
 	transceiverMid string // The mid of the transceiver when the track is received, until then ""
 }
 
@@ -41,6 +326,7 @@ type outgoingTrackWithClientState struct {
 	source         *incomingTrack
 	remoteNotified bool // Indicates we have sent upstreamTracks including this track to the remote device
 	remoteAccepted bool // Indicates we have received confirmation this track is expected by the remote device
+	remoteRejected bool // The remote left it out of its acceptance, so it isn't sent until offered again
 }
 
 func (ot *outgoingTrackWithClientState) String() string {
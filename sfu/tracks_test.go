@@ -0,0 +1,232 @@
+package sfu
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Real looking H264 payloads, as a browser or camera packetizes them
+var (
+	h264SPS = []byte{0x67, 0x42, 0xC0, 0x1F, 0xDA, 0x01}
+	h264PPS = []byte{0x68, 0xCE, 0x3C, 0x80}
+
+	// SPS and PPS together, each with a 16 bit size
+	h264STAPA = append(append(append([]byte{0x78, 0x00, byte(len(h264SPS))}, h264SPS...), 0x00, byte(len(h264PPS))), h264PPS...)
+
+	h264IDRStart  = []byte{0x7C, 0x85, 0xB8, 0x00} // FU-A indicator then start bit and IDR
+	h264IDRMiddle = []byte{0x7C, 0x05, 0x12, 0x34}
+	h264IDREnd    = []byte{0x7C, 0x45, 0x56, 0x78}
+	h264Slice     = []byte{0x41, 0x9A, 0x02} // A single NALU non IDR slice
+)
+
+func h264Packet(seq uint16, timestamp uint32, payload []byte) *rtp.Packet {
+	return &rtp.Packet{
+		Header:  rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: timestamp},
+		Payload: payload,
+	}
+}
+
+func newTestVideoTrack(mimeType string) *incomingTrack {
+	it := newIncomingTrack(&TrackDescriptor{UmbrellaId: "video", StreamId: "stream", Kind: TrackKind_Video}, "room")
+	it.codec = webrtc.RTPCodecCapability{MimeType: mimeType, ClockRate: 90000}
+	it.addLayer("")
+
+	return it
+}
+
+func TestCachedGopKeepsWholeKeyframes(t *testing.T) {
+	tests := []struct {
+		name     string
+		packets  [][]byte // A new timestamp every time the payload is nil
+		wantGop  [][]byte
+		wantNone bool
+	}{
+		{
+			name:    "stap-a then fu-a idr",
+			packets: [][]byte{h264STAPA, h264IDRStart, h264IDRMiddle, h264IDREnd, nil, h264Slice, nil, h264Slice},
+			wantGop: [][]byte{h264STAPA, h264IDRStart, h264IDRMiddle, h264IDREnd, h264Slice, h264Slice},
+		},
+		{
+			name:    "separate sps and pps then idr",
+			packets: [][]byte{h264SPS, h264PPS, h264IDRStart, h264IDREnd, nil, h264Slice},
+			wantGop: [][]byte{h264SPS, h264PPS, h264IDRStart, h264IDREnd, h264Slice},
+		},
+		{
+			name:    "several idr slices in one frame",
+			packets: [][]byte{h264STAPA, h264IDRStart, h264IDREnd, h264IDRStart, h264IDREnd, nil, h264Slice},
+			wantGop: [][]byte{h264STAPA, h264IDRStart, h264IDREnd, h264IDRStart, h264IDREnd, h264Slice},
+		},
+		{
+			name:    "next keyframe replaces it",
+			packets: [][]byte{h264STAPA, h264IDRStart, h264IDREnd, nil, h264Slice, nil, h264SPS, h264PPS, h264IDRStart, h264IDREnd},
+			wantGop: [][]byte{h264SPS, h264PPS, h264IDRStart, h264IDREnd},
+		},
+		{
+			name:     "waits for a keyframe",
+			packets:  [][]byte{h264Slice, nil, h264IDRMiddle, h264IDREnd},
+			wantNone: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			it := newTestVideoTrack(webrtc.MimeTypeH264)
+
+			seq, timestamp := uint16(100), uint32(9000)
+			for _, payload := range test.packets {
+				if payload == nil {
+					timestamp += 3000
+					continue
+				}
+
+				it.writeRTP("", h264Packet(seq, timestamp, payload))
+				seq++
+			}
+
+			gop := it.cachedGop("")
+			if test.wantNone {
+				if len(gop) != 0 {
+					t.Fatalf("got %d cached packets, want none", len(gop))
+				}
+				return
+			}
+
+			if len(gop) != len(test.wantGop) {
+				t.Fatalf("got %d cached packets, want %d", len(gop), len(test.wantGop))
+			}
+
+			for i, pkt := range gop {
+				if !bytes.Equal(pkt.Payload, test.wantGop[i]) {
+					t.Errorf("packet %d got %x, want %x", i, pkt.Payload, test.wantGop[i])
+				}
+			}
+
+			if !isH264ParameterSet(gop[0].Payload) {
+				t.Errorf("gop starts with %x rather than the SPS", gop[0].Payload)
+			}
+		})
+	}
+}
+
+func TestCachedGopCopiesPackets(t *testing.T) {
+	it := newTestVideoTrack(webrtc.MimeTypeVP8)
+
+	// Readers reuse their buffers, so what was cached mustn't change with them
+	payload := []byte{0x10, 0x00, 0xAA}
+	it.writeRTP("", &rtp.Packet{Header: rtp.Header{SequenceNumber: 1, Timestamp: 1}, Payload: payload})
+	payload[2] = 0xBB
+
+	gop := it.cachedGop("")
+	if len(gop) != 1 || gop[0].Payload[2] != 0xAA {
+		t.Fatalf("cached packet changed with the reader's buffer: %v", gop)
+	}
+}
+
+func TestCachedGopGivesUpWhenTooBig(t *testing.T) {
+	it := newTestVideoTrack(webrtc.MimeTypeVP8)
+
+	big := make([]byte, 1200)
+	big[0] = 0x10
+
+	seq := uint16(0)
+	for written := 0; written <= maxCachedGopBytes; written += len(big) {
+		it.writeRTP("", &rtp.Packet{Header: rtp.Header{SequenceNumber: seq, Timestamp: uint32(seq)}, Payload: big})
+		big[0] = 0x00 // The rest of the keyframe
+		seq++
+	}
+
+	if gop := it.cachedGop(""); len(gop) != 0 {
+		t.Fatalf("got %d cached packets, want none once over the limit", len(gop))
+	}
+}
+
+func TestRankLayers(t *testing.T) {
+	tests := []struct {
+		name     string
+		rids     []string
+		bitrates map[string]uint64
+		want     []string
+	}{
+		{name: "no simulcast", rids: []string{""}, want: []string{""}},
+		{name: "q h f", rids: []string{"h", "q", "f"}, want: []string{"f", "h", "q"}},
+		{name: "l m h", rids: []string{"m", "h", "l"}, want: []string{"h", "m", "l"}},
+		{name: "numbered", rids: []string{"1", "0", "2"}, want: []string{"2", "1", "0"}},
+		{name: "h is the top without f", rids: []string{"q", "h"}, want: []string{"h", "q"}},
+		{
+			name:     "measured beats names",
+			rids:     []string{"q", "h", "f"},
+			bitrates: map[string]uint64{"q": 1500000, "h": 500000, "f": 150000},
+			want:     []string{"q", "h", "f"},
+		},
+		{
+			name:     "names until every layer is measured",
+			rids:     []string{"q", "h", "f"},
+			bitrates: map[string]uint64{"q": 1500000},
+			want:     []string{"f", "h", "q"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			it := newIncomingTrack(&TrackDescriptor{UmbrellaId: "video", Kind: TrackKind_Video}, "room")
+			for _, rid := range test.rids {
+				it.addLayer(rid)
+			}
+
+			for rid, bitrate := range test.bitrates {
+				it.layers[rid].bitrate.Store(bitrate)
+			}
+			it.rankLayers()
+
+			if got := it.getRankedLayers(); !slices.Equal(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+
+			if it.isSimulcast() != (test.rids[0] != "") {
+				t.Errorf("got simulcast %v", it.isSimulcast())
+			}
+		})
+	}
+}
+
+// The SPS on its own or at the start of a STAP-A
+func isH264ParameterSet(payload []byte) bool {
+	switch payload[0] & 0x1F {
+	case h264NaluSPS:
+		return true
+	case h264NaluSTAPA:
+		return len(payload) > 3 && payload[3]&0x1F == h264NaluSPS
+	}
+
+	return false
+}
+
+func TestRequestKeyframeThrottled(t *testing.T) {
+	it, requested := newTestSimulcastTrack("h", "l")
+
+	// However many subscribers lose something at once, each layer is only asked once
+	for range 3 {
+		it.requestKeyframe("h")
+		it.requestKeyframe("l")
+	}
+
+	if !slices.Equal(*requested, []string{"h", "l"}) {
+		t.Fatalf("got requests for %v", *requested)
+	}
+
+	// As if the interval has gone by
+	it.keyframeMutex.Lock()
+	it.lastKeyframeRequests["h"] = it.lastKeyframeRequests["h"].Add(-keyframeRequestInterval)
+	it.keyframeMutex.Unlock()
+
+	it.requestKeyframe("h")
+	it.requestKeyframe("l")
+
+	if !slices.Equal(*requested, []string{"h", "l", "h"}) {
+		t.Errorf("got requests for %v", *requested)
+	}
+}
@@ -0,0 +1,207 @@
+package sfu
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"atomirex.com/umbrella/razor"
+	"github.com/pion/logging"
+	"github.com/pion/turn/v4"
+	"github.com/pion/webrtc/v4"
+)
+
+// An optional built in TURN server, for clients whose NAT or firewall stops them reaching the SFU directly
+// Credentials are either a fixed username and password, or short lived ones derived from a shared secret
+// (the TURN REST API scheme) which are handed out fresh with every page. It only relays to the SFU itself, since
+// anything else would let whoever has credentials reach the LAN, loopback or cloud metadata services through it
+
+const turnRealm = "umbrella"
+
+// How long handed out credentials last when derived from the secret
+const defaultTurnCredentialTTL = 12 * time.Hour
+
+var ErrTurnNoRelayIP = errors.New("TURN needs an IP to relay on")
+var ErrTurnNoCredentials = errors.New("TURN needs a username and password or a secret")
+
+type TurnConfig struct {
+	ListenAddr string // Listened on for both UDP and TCP, like ":3478"
+	RelayIP    net.IP // Where clients send relayed media, so must be reachable by them
+	PublicHost string // The host clients are told to use, defaults to the relay IP
+
+	// Relay ports, with both zero the OS picks
+	MinPort uint16
+	MaxPort uint16
+
+	Username string
+	Password string
+
+	Secret        string
+	CredentialTTL time.Duration
+}
+
+type TurnServer struct {
+	config TurnConfig
+	server *turn.Server
+	logger *razor.Logger
+
+	// The addresses of this machine, which is where the SFU's candidates are, looked up on each permission
+	// since interfaces come and go
+	localIPs func() []net.IP
+}
+
+func NewTurnServer(config TurnConfig, logger *razor.Logger) (*TurnServer, error) {
+	if config.RelayIP == nil {
+		return nil, ErrTurnNoRelayIP
+	}
+
+	if config.Secret == "" && (config.Username == "" || config.Password == "") {
+		return nil, ErrTurnNoCredentials
+	}
+
+	if config.PublicHost == "" {
+		config.PublicHost = config.RelayIP.String()
+	}
+
+	if config.CredentialTTL <= 0 {
+		config.CredentialTTL = defaultTurnCredentialTTL
+	}
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+	loggerFactory.DefaultLogLevel = logging.LogLevelError
+
+	restAuth := turn.LongTermTURNRESTAuthHandler(config.Secret, loggerFactory.NewLogger("turn"))
+	staticKey := turn.GenerateAuthKey(config.Username, turnRealm, config.Password)
+
+	authHandler := func(username string, realm string, srcAddr net.Addr) ([]byte, bool) {
+		if config.Username != "" && username == config.Username {
+			return staticKey, true
+		}
+
+		if config.Secret != "" {
+			return restAuth(username, realm, srcAddr)
+		}
+
+		logger.Warn("turn", "Unknown user "+username+" from "+srcAddr.String())
+		return nil, false
+	}
+
+	udpConn, err := net.ListenPacket("udp4", config.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	tcpListener, err := net.Listen("tcp4", config.ListenAddr)
+	if err != nil {
+		udpConn.Close()
+		return nil, err
+	}
+
+	t := &TurnServer{config: config, logger: logger, localIPs: interfaceIPs}
+
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:         turnRealm,
+		AuthHandler:   authHandler,
+		LoggerFactory: loggerFactory,
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{PacketConn: udpConn, RelayAddressGenerator: config.relayAddressGenerator(), PermissionHandler: t.permitPeer},
+		},
+		ListenerConfigs: []turn.ListenerConfig{
+			{Listener: tcpListener, RelayAddressGenerator: config.relayAddressGenerator(), PermissionHandler: t.permitPeer},
+		},
+	})
+	if err != nil {
+		udpConn.Close()
+		tcpListener.Close()
+		return nil, err
+	}
+
+	t.server = server
+
+	logger.Info("turn", "Listening on "+config.ListenAddr+" relaying on "+config.RelayIP.String())
+
+	return t, nil
+}
+
+// Clients only relay to the SFU, at its public address or one of this machine's own
+func (t *TurnServer) permitPeer(clientAddr net.Addr, peerIP net.IP) bool {
+	if peerIP.IsLoopback() || peerIP.IsLinkLocalUnicast() || peerIP.IsUnspecified() || peerIP.IsMulticast() {
+		t.logger.Warn("turn", "Refusing relay from "+clientAddr.String()+" to "+peerIP.String())
+		return false
+	}
+
+	if peerIP.Equal(t.config.RelayIP) {
+		return true
+	}
+
+	for _, ip := range t.localIPs() {
+		if peerIP.Equal(ip) {
+			return true
+		}
+	}
+
+	t.logger.Warn("turn", "Refusing relay from "+clientAddr.String()+" to "+peerIP.String())
+	return false
+}
+
+func interfaceIPs() []net.IP {
+	ips := make([]net.IP, 0)
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ips
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+
+	return ips
+}
+
+func (c *TurnConfig) relayAddressGenerator() turn.RelayAddressGenerator {
+	if c.MinPort == 0 && c.MaxPort == 0 {
+		return &turn.RelayAddressGeneratorStatic{RelayAddress: c.RelayIP, Address: "0.0.0.0"}
+	}
+
+	return &turn.RelayAddressGeneratorPortRange{RelayAddress: c.RelayIP, Address: "0.0.0.0", MinPort: c.MinPort, MaxPort: c.MaxPort}
+}
+
+// What to use this server as, with new credentials each time if they come from the secret
+// The user only ends up in the username, which is handy when reading logs
+func (t *TurnServer) ICEServers(user string) []webrtc.ICEServer {
+	_, port, err := net.SplitHostPort(t.config.ListenAddr)
+	if err != nil || port == "" {
+		port = "3478"
+	}
+
+	hostPort := net.JoinHostPort(t.config.PublicHost, port)
+
+	username, password := t.config.Username, t.config.Password
+	if t.config.Secret != "" {
+		username, password, err = turn.GenerateLongTermTURNRESTCredentials(t.config.Secret, user, t.config.CredentialTTL)
+		if err != nil {
+			t.logger.Error("turn", "Failed to generate credentials "+err.Error())
+			return []webrtc.ICEServer{}
+		}
+	}
+
+	return []webrtc.ICEServer{
+		{
+			URLs: []string{
+				fmt.Sprintf("turn:%s?transport=udp", hostPort),
+				fmt.Sprintf("turn:%s?transport=tcp", hostPort),
+			},
+			Username:       username,
+			Credential:     password,
+			CredentialType: webrtc.ICECredentialTypePassword,
+		},
+	}
+}
+
+func (t *TurnServer) Close() error {
+	return t.server.Close()
+}
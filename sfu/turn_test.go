@@ -0,0 +1,119 @@
+package sfu
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"atomirex.com/umbrella/razor"
+	"github.com/pion/webrtc/v4"
+)
+
+func newTestTurnServer() *TurnServer {
+	return &TurnServer{
+		config: TurnConfig{
+			ListenAddr: ":3478",
+			RelayIP:    net.ParseIP("203.0.113.10"),
+			PublicHost: "turn.example.com",
+			Secret:     "turnsecret",
+
+			CredentialTTL: time.Hour,
+		},
+		logger: razor.NewLogger(razor.LoggingLevelOff, false),
+		localIPs: func() []net.IP {
+			return []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("192.168.1.20"), net.ParseIP("fe80::1"), net.ParseIP("fd00::20")}
+		},
+	}
+}
+
+func TestTurnPermitPeer(t *testing.T) {
+	tests := []struct {
+		peer string
+		want bool
+	}{
+		{peer: "203.0.113.10", want: true}, // The relay IP, where the SFU is reached from outside
+		{peer: "192.168.1.20", want: true}, // This machine on the LAN
+		{peer: "fd00::20", want: true},
+		{peer: "192.168.1.1", want: false}, // Anything else on the LAN
+		{peer: "10.0.0.5", want: false},
+		{peer: "198.51.100.7", want: false}, // Somewhere else on the internet
+		{peer: "127.0.0.1", want: false},
+		{peer: "::1", want: false},
+		{peer: "169.254.169.254", want: false}, // Cloud metadata
+		{peer: "fe80::1", want: false},
+		{peer: "0.0.0.0", want: false},
+		{peer: "224.0.0.251", want: false},
+	}
+
+	turnServer := newTestTurnServer()
+	client := &net.UDPAddr{IP: net.ParseIP("198.51.100.99"), Port: 50000}
+
+	for _, test := range tests {
+		t.Run(test.peer, func(t *testing.T) {
+			if got := turnServer.permitPeer(client, net.ParseIP(test.peer)); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPageICEServers(t *testing.T) {
+	keys := map[string][]byte{"main": []byte("mainsecret")}
+	auth := NewAuthenticator(keys, [][]byte{[]byte("trunksecret")})
+
+	token, err := auth.Sign("main", &AccessClaims{Identity: "alice", CanSubscribe: true, ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		auth     *Authenticator
+		url      string
+		header   string
+		wantTurn bool
+		wantUser string
+	}{
+		{name: "auth off", auth: nil, url: "/sfu", wantTurn: true, wantUser: "web"},
+		{name: "only trunk secrets", auth: NewAuthenticator(nil, [][]byte{[]byte("trunksecret")}), url: "/sfu", wantTurn: true, wantUser: "web"},
+		{name: "no token", auth: auth, url: "/sfu", wantTurn: false},
+		{name: "token in url", auth: auth, url: "/sfu?token=" + token, wantTurn: true, wantUser: "alice"},
+		{name: "bearer token", auth: auth, url: "/sfu", header: "Bearer " + token, wantTurn: true, wantUser: "alice"},
+		{name: "bad token", auth: auth, url: "/sfu?token=nonsense", wantTurn: false},
+		{name: "invalid room", auth: auth, url: "/sfu?room=bad/room&token=" + token, wantTurn: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &Sfu{auth: test.auth, turnServer: newTestTurnServer(), iceServers: DefaultICEServers()}
+
+			r := httptest.NewRequest("GET", test.url, nil)
+			if test.header != "" {
+				r.Header.Set("Authorization", test.header)
+			}
+
+			servers := s.PageICEServers(r)
+
+			var turnServer *webrtc.ICEServer
+			for i, server := range servers {
+				if strings.HasPrefix(server.URLs[0], "turn:") {
+					turnServer = &servers[i]
+				}
+			}
+
+			if (turnServer != nil) != test.wantTurn {
+				t.Fatalf("got TURN %v, want %v", turnServer != nil, test.wantTurn)
+			}
+
+			if len(servers) == 0 || !strings.HasPrefix(servers[0].URLs[0], "stun:") {
+				t.Errorf("the STUN servers should always be there, got %v", servers)
+			}
+
+			if turnServer != nil && !strings.HasSuffix(turnServer.Username, ":"+test.wantUser) {
+				t.Errorf("got TURN username %s, want it for %s", turnServer.Username, test.wantUser)
+			}
+		})
+	}
+}
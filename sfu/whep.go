@@ -0,0 +1,73 @@
+package sfu
+
+import (
+	"io"
+	"net/http"
+	"strings"
+)
+
+// WHEP playback, which works just like WHIP with the media going the other way
+// A tracks query parameter of comma separated umbrella ids limits what is sent, otherwise it's the whole room
+func (s *Sfu) WhepHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/whep"), "/")
+
+	if id == "" {
+		switch r.Method {
+		case http.MethodPost:
+			s.whepSubscribe(w, r)
+		case http.MethodOptions:
+			w.Header().Set("Accept-Post", "application/sdp")
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	s.handleSessionResource(w, r, id)
+}
+
+func (s *Sfu) whepSubscribe(w http.ResponseWriter, r *http.Request) {
+	roomId, permissions, ok := s.authorizeSessionRequest(w, r, "WHEP")
+	if !ok {
+		return
+	}
+
+	if !permissions.canSubscribe {
+		http.Error(w, "Not allowed to subscribe", http.StatusForbidden)
+		return
+	}
+
+	offer, err := io.ReadAll(io.LimitReader(r.Body, maxSessionBodySize))
+	if err != nil {
+		http.Error(w, "Failed to read payload", http.StatusBadRequest)
+		return
+	}
+
+	requested := make([]string, 0)
+	for _, umbrellaId := range strings.Split(r.URL.Query().Get("tracks"), ",") {
+		if umbrellaId = strings.TrimSpace(umbrellaId); umbrellaId != "" {
+			requested = append(requested, umbrellaId)
+		}
+	}
+
+	c, err := newWhepClient(s, roomId, permissions, r.RemoteAddr, requested)
+	if err != nil {
+		s.logger.Error("sfu", "Failed to create WHEP client: "+err.Error())
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+
+	// Unlike WHIP the slots for tracks have to exist before the room starts handing them over
+	answer, err := c.negotiate(string(offer))
+	if err != nil {
+		s.logger.Warn("sfu", "WHEP negotiation failed for "+r.RemoteAddr+": "+err.Error())
+		c.stop()
+		http.Error(w, "Failed to negotiate: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.startSession(c)
+
+	writeSessionCreated(w, r, c.sessionId, answer)
+}
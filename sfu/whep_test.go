@@ -0,0 +1,199 @@
+package sfu
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func viewingOffer(pc *webrtc.PeerConnection) error {
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		if _, err := pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Only sends, so there's nothing for a WHEP session to put in it
+func sendingOffer(pc *webrtc.PeerConnection) error {
+	video, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "stream")
+	if err != nil {
+		return err
+	}
+
+	_, err = pc.AddTransceiverFromTrack(video, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+	return err
+}
+
+func newTestRoomTrack(umbrellaId string, streamId string, kind TrackKind) *incomingTrack {
+	it := newIncomingTrack(&TrackDescriptor{UmbrellaId: umbrellaId, StreamId: streamId, Kind: kind}, "room")
+
+	if kind == TrackKind_Video {
+		it.codec = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+	} else {
+		it.codec = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}
+	}
+
+	return it
+}
+
+func TestWhepSession(t *testing.T) {
+	s := newTestSfu(t)
+	pc, offer := newTestOffer(t, viewingOffer)
+
+	w := httptest.NewRecorder()
+	s.WhepHandler(w, sessionRequest(http.MethodPost, "/whep?room=kitchen&tracks=a,b", "application/sdp", offer, ""))
+
+	if w.Code != http.StatusCreated || w.Header().Get("Content-Type") != "application/sdp" {
+		t.Fatalf("got status %d, %s", w.Code, w.Body.String())
+	}
+
+	location := w.Header().Get("Location")
+	if !strings.HasPrefix(location, "/whep/") {
+		t.Fatalf("got location %q", location)
+	}
+
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: w.Body.String()}); err != nil {
+		t.Fatalf("answer was refused: %v", err)
+	}
+
+	// A slot for each section of the offer, which only ever sends
+	if count := strings.Count(w.Body.String(), "a=sendonly"); count != 2 {
+		t.Errorf("answer sends %d tracks, want 2", count)
+	}
+
+	steps := []struct {
+		name       string
+		method     string
+		wantStatus int
+	}{
+		{name: "end", method: http.MethodDelete, wantStatus: http.StatusOK},
+		{name: "already ended", method: http.MethodDelete, wantStatus: http.StatusNotFound},
+	}
+
+	for _, step := range steps {
+		w := httptest.NewRecorder()
+		s.WhepHandler(w, sessionRequest(step.method, location, "", "", ""))
+
+		if w.Code != step.wantStatus {
+			t.Errorf("%s got status %d, want %d", step.name, w.Code, step.wantStatus)
+		}
+	}
+}
+
+func TestWhepNothingToReceive(t *testing.T) {
+	s := newTestSfu(t)
+	_, offer := newTestOffer(t, sendingOffer)
+
+	w := httptest.NewRecorder()
+	s.WhepHandler(w, sessionRequest(http.MethodPost, "/whep?room=kitchen", "application/sdp", offer, ""))
+
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), ErrNothingToReceive.Error()) {
+		t.Errorf("got status %d, %s", w.Code, w.Body.String())
+	}
+}
+
+func TestWhepRefusals(t *testing.T) {
+	s, _, _ := newTestAdminAuth(t)
+
+	publisher, err := s.auth.Sign("main", &AccessClaims{Identity: "carol", CanPublish: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		token       string
+		wantStatus  int
+	}{
+		{name: "options", method: http.MethodOptions, wantStatus: http.StatusNoContent},
+		{name: "get", method: http.MethodGet, wantStatus: http.StatusMethodNotAllowed},
+		{name: "not sdp", method: http.MethodPost, contentType: "application/json", wantStatus: http.StatusUnsupportedMediaType},
+		{name: "no token", method: http.MethodPost, contentType: "application/sdp", wantStatus: http.StatusUnauthorized},
+		{name: "can't subscribe", method: http.MethodPost, contentType: "application/sdp", token: publisher, wantStatus: http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.WhepHandler(w, sessionRequest(test.method, "/whep", test.contentType, "v=0", test.token))
+
+			if w.Code != test.wantStatus {
+				t.Errorf("got status %d, want %d", w.Code, test.wantStatus)
+			}
+		})
+	}
+}
+
+func TestWhepFillsSlots(t *testing.T) {
+	// The order tracks arrive in, each filling what it can straight away
+	arrivals := []struct {
+		umbrellaId string
+		streamId   string
+		kind       TrackKind
+	}{
+		{"cam1", "s1", TrackKind_Video},
+		{"mic1", "s1", TrackKind_Audio},
+		{"cam2", "s2", TrackKind_Video},
+		{"mic2", "s2", TrackKind_Audio},
+		{"mic3", "s1", TrackKind_Audio},
+	}
+
+	tests := []struct {
+		name      string
+		requested []string
+		removed   string
+		wantSent  []string // By slot, video then audio
+	}{
+		{name: "first to arrive", wantSent: []string{"cam1", "mic1"}},
+		{name: "only what was asked for", requested: []string{"cam2", "mic2"}, wantSent: []string{"cam2", "mic2"}},
+		{name: "video replaced when removed", removed: "cam1", wantSent: []string{"cam2", "mic1"}},
+		{name: "audio replaced from the video's stream", removed: "mic1", wantSent: []string{"cam1", "mic3"}},
+		{name: "empty when nothing's left", requested: []string{"cam1", "mic2"}, removed: "cam1", wantSent: []string{"", "mic2"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestSfu(t)
+			_, offer := newTestOffer(t, viewingOffer)
+
+			c, err := newWhepClient(s, "kitchen", allPermissions, "192.0.2.1:1234", test.requested)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(c.stop)
+
+			if _, err := c.negotiate(offer); err != nil {
+				t.Fatal(err)
+			}
+
+			tracks := make(map[string]*incomingTrack)
+			for _, arrival := range arrivals {
+				tracks[arrival.umbrellaId] = newTestRoomTrack(arrival.umbrellaId, arrival.streamId, arrival.kind)
+				c.AddOutgoingTracksForIncomingTrack(tracks[arrival.umbrellaId])
+			}
+
+			if test.removed != "" {
+				c.RemoveOutgoingTracksForIncomingTrack(tracks[test.removed])
+			}
+
+			status := c.getStatus()
+			if status == nil || len(status.Senders) != len(test.wantSent) {
+				t.Fatalf("got status %+v", status)
+			}
+
+			for i, sender := range status.Senders {
+				if sender.UmbrellaId != test.wantSent[i] || sender.HasTrack != (test.wantSent[i] != "") {
+					t.Errorf("slot %d sends %q, want %q", i, sender.UmbrellaId, test.wantSent[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package sfu
+
+import (
+	"io"
+	"net/http"
+	"strings"
+)
+
+// WHIP (RFC 9725) publishing, a POST to the endpoint creates a session at a resource under it
+// which is then PATCHed with trickled candidates and DELETEd to end it
+func (s *Sfu) WhipHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/whip"), "/")
+
+	if id == "" {
+		switch r.Method {
+		case http.MethodPost:
+			s.whipPublish(w, r)
+		case http.MethodOptions:
+			w.Header().Set("Accept-Post", "application/sdp")
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	s.handleSessionResource(w, r, id)
+}
+
+func (s *Sfu) whipPublish(w http.ResponseWriter, r *http.Request) {
+	roomId, permissions, ok := s.authorizeSessionRequest(w, r, "WHIP")
+	if !ok {
+		return
+	}
+
+	if !permissions.canPublish {
+		http.Error(w, "Not allowed to publish", http.StatusForbidden)
+		return
+	}
+
+	offer, err := io.ReadAll(io.LimitReader(r.Body, maxSessionBodySize))
+	if err != nil {
+		http.Error(w, "Failed to read payload", http.StatusBadRequest)
+		return
+	}
+
+	c, err := newWhipClient(s, roomId, permissions, r.RemoteAddr)
+	if err != nil {
+		s.logger.Error("sfu", "Failed to create WHIP client: "+err.Error())
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+
+	s.startSession(c)
+
+	answer, err := c.negotiate(string(offer))
+	if err != nil {
+		s.logger.Warn("sfu", "WHIP negotiation failed for "+r.RemoteAddr+": "+err.Error())
+		s.endSession(c)
+		http.Error(w, "Failed to negotiate: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeSessionCreated(w, r, c.sessionId, answer)
+}
@@ -0,0 +1,203 @@
+package sfu
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"atomirex.com/umbrella/razor"
+	"github.com/pion/webrtc/v4"
+)
+
+func newTestSfu(t *testing.T) *Sfu {
+	return NewSfu(razor.NewLogger(razor.LoggingLevelOff, false), 40000, 60000, nil, ICEMuxPorts{}, "")
+}
+
+// A peer connection set up by configure, with an offer which has all its candidates
+func newTestOffer(t *testing.T, configure func(pc *webrtc.PeerConnection) error) (*webrtc.PeerConnection, string) {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	if err := configure(pc); err != nil {
+		t.Fatal(err)
+	}
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gatheringComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gatheringComplete
+
+	return pc, pc.LocalDescription().SDP
+}
+
+func sessionRequest(method string, target string, contentType string, body string, token string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return r
+}
+
+func publishingOffer(pc *webrtc.PeerConnection) error {
+	video, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "stream")
+	if err != nil {
+		return err
+	}
+
+	if _, err := pc.AddTrack(video); err != nil {
+		return err
+	}
+
+	audio, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "stream")
+	if err != nil {
+		return err
+	}
+
+	_, err = pc.AddTrack(audio)
+	return err
+}
+
+func TestWhipSession(t *testing.T) {
+	s := newTestSfu(t)
+	pc, offer := newTestOffer(t, publishingOffer)
+
+	w := httptest.NewRecorder()
+	s.WhipHandler(w, sessionRequest(http.MethodPost, "/whip?room=kitchen", "application/sdp", offer, ""))
+
+	if w.Code != http.StatusCreated || w.Header().Get("Content-Type") != "application/sdp" {
+		t.Fatalf("got status %d, %s", w.Code, w.Body.String())
+	}
+
+	location := w.Header().Get("Location")
+	if !strings.HasPrefix(location, "/whip/") {
+		t.Fatalf("got location %q", location)
+	}
+
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: w.Body.String()}); err != nil {
+		t.Fatalf("answer was refused: %v", err)
+	}
+
+	// Takes both tracks and sends nothing back
+	if count := strings.Count(w.Body.String(), "a=recvonly"); count != 2 {
+		t.Errorf("answer receives %d tracks, want 2", count)
+	}
+
+	steps := []struct {
+		name        string
+		method      string
+		contentType string
+		body        string
+		wantStatus  int
+	}{
+		{name: "trickle", method: http.MethodPatch, contentType: "application/trickle-ice-sdpfrag", body: "a=mid:0\r\na=candidate:1 1 udp 2130706431 192.0.2.1 50000 typ host\r\n", wantStatus: http.StatusNoContent},
+		{name: "trickle as something else", method: http.MethodPatch, contentType: "application/sdp", wantStatus: http.StatusUnsupportedMediaType},
+		{name: "put", method: http.MethodPut, wantStatus: http.StatusMethodNotAllowed},
+		{name: "end", method: http.MethodDelete, wantStatus: http.StatusOK},
+		{name: "already ended", method: http.MethodDelete, wantStatus: http.StatusNotFound},
+		{name: "trickle after ending", method: http.MethodPatch, contentType: "application/trickle-ice-sdpfrag", wantStatus: http.StatusNotFound},
+	}
+
+	for _, step := range steps {
+		w := httptest.NewRecorder()
+		s.WhipHandler(w, sessionRequest(step.method, location, step.contentType, step.body, ""))
+
+		if w.Code != step.wantStatus {
+			t.Errorf("%s got status %d, want %d", step.name, w.Code, step.wantStatus)
+		}
+	}
+}
+
+func TestWhipRefusals(t *testing.T) {
+	s, _, _ := newTestAdminAuth(t)
+
+	viewer, err := s.auth.Sign("main", &AccessClaims{Identity: "bob", CanSubscribe: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		token       string
+		wantStatus  int
+	}{
+		{name: "options", method: http.MethodOptions, wantStatus: http.StatusNoContent},
+		{name: "get", method: http.MethodGet, wantStatus: http.StatusMethodNotAllowed},
+		{name: "not sdp", method: http.MethodPost, contentType: "application/json", wantStatus: http.StatusUnsupportedMediaType},
+		{name: "no token", method: http.MethodPost, contentType: "application/sdp", wantStatus: http.StatusUnauthorized},
+		{name: "bad token", method: http.MethodPost, contentType: "application/sdp", token: "guess", wantStatus: http.StatusUnauthorized},
+		{name: "can't publish", method: http.MethodPost, contentType: "application/sdp", token: viewer, wantStatus: http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.WhipHandler(w, sessionRequest(test.method, "/whip", test.contentType, "v=0", test.token))
+
+			if w.Code != test.wantStatus {
+				t.Errorf("got status %d, want %d", w.Code, test.wantStatus)
+			}
+		})
+	}
+}
+
+func TestSessionLocationKeepsPrefix(t *testing.T) {
+	// As seen once the prefix has been stripped on the way in
+	r := httptest.NewRequest(http.MethodPost, "/umbrella/whip/?room=kitchen", nil)
+	r.URL.Path = "/whip/"
+
+	w := httptest.NewRecorder()
+	writeSessionCreated(w, r, "abc", "v=0")
+
+	if location := w.Header().Get("Location"); location != "/umbrella/whip/abc" {
+		t.Errorf("got location %q", location)
+	}
+}
+
+func TestParseTrickleSDPFrag(t *testing.T) {
+	frag := strings.Join([]string{
+		"a=ice-ufrag:abcd",
+		"a=ice-pwd:secret",
+		"m=audio 9 UDP/TLS/RTP/SAVPF 0",
+		"a=mid:0",
+		"a=candidate:1 1 udp 2130706431 192.0.2.1 50000 typ host",
+		"a=candidate:2 1 udp 1694498815 198.51.100.1 50001 typ srflx raddr 192.0.2.1 rport 50000",
+		"m=video 9 UDP/TLS/RTP/SAVPF 0",
+		"a=candidate:3 1 tcp 1518280447 192.0.2.1 9 typ host tcptype passive",
+		"a=end-of-candidates",
+	}, "\r\n")
+
+	candidates := parseTrickleSDPFrag(frag)
+	if len(candidates) != 3 {
+		t.Fatalf("got %d candidates, want 3", len(candidates))
+	}
+
+	if !strings.HasPrefix(candidates[0].Candidate, "candidate:1 ") || candidates[0].SDPMid == nil || *candidates[0].SDPMid != "0" {
+		t.Errorf("first candidate is %+v", candidates[0])
+	}
+
+	// No mid for the second media section, so it goes by index
+	if candidates[2].SDPMid != nil || candidates[2].SDPMLineIndex == nil || *candidates[2].SDPMLineIndex != 1 {
+		t.Errorf("last candidate is %+v", candidates[2])
+	}
+
+	if got := parseTrickleSDPFrag("a=end-of-candidates"); len(got) != 0 {
+		t.Errorf("got %d candidates from none", len(got))
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"atomirex.com/umbrella/sfu"
+)
+
+// Mints an access token with the auth keys from UMBRELLA_CONFIG or UMBRELLA_AUTH_KEYS, as the server would load them, for example:
+// umbrella token -kid main -identity alice -room kitchen -publish -subscribe -ttl 24h
+func runTokenCommand(args []string) {
+	flags := flag.NewFlagSet("token", flag.ExitOnError)
+	kid := flags.String("kid", "", "id of the auth key to sign with")
+	identity := flags.String("identity", "", "identity of the token holder")
+	room := flags.String("room", "", "room the token is limited to, empty for any room")
+	publish := flags.Bool("publish", false, "allow publishing tracks")
+	subscribe := flags.Bool("subscribe", false, "allow receiving tracks")
+	admin := flags.Bool("admin", false, "allow kicking clients and muting tracks through the API")
+	trunk := flags.Bool("trunk", false, "for another umbrella node to trunk in with")
+	ttl := flags.Duration("ttl", 24*time.Hour, "how long the token is valid for")
+	flags.Parse(args)
+
+	cfg, err := loadConfig(os.Getenv("UMBRELLA_CONFIG"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	now := time.Now()
+	token, err := sfu.NewAuthenticator(cfg.authKeys(), nil).Sign(*kid, &sfu.AccessClaims{
+		Identity:     *identity,
+		Room:         *room,
+		CanPublish:   *publish,
+		CanSubscribe: *subscribe,
+		Admin:        *admin,
+		Trunk:        *trunk,
+		IssuedAt:     now.Unix(),
+		ExpiresAt:    now.Add(*ttl).Unix(),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println(token)
+}